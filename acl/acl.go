@@ -0,0 +1,376 @@
+// Package acl decides which destinations the clients of a server may
+// connect to, based on a rule list loaded from a file.
+//
+// A rule file holds one rule per line in the form ACTION,CONDITION,...
+// where ACTION is ALLOW or DENY and every CONDITION is TYPE=VALUE. A rule
+// matches when all of its conditions do, a rule without conditions matches
+// everything. Empty lines and lines starting with '#' are ignored. The
+// condition types are
+//
+//	CIDR    the destination IP address is within the network VALUE
+//	DOMAIN  the destination host name matches the pattern VALUE, either a
+//	        name, "*." followed by a name matching its subdomains, or "*"
+//	PORT    the destination port is VALUE or within the range VALUE-VALUE
+//	USER    the name of the client identity, see package identity, equals
+//	        VALUE, a common name if it has no prefix, "*" matches any
+//	        client with an identity
+//	GROUP   the client is in the group VALUE
+//
+// A line FINAL,ACTION sets the action of destinations no rule matches,
+// ALLOW by default.
+//
+// Rules are evaluated in order and the first match wins. Private,
+// loopback, link-local and other non public addresses are denied unless
+// the matching rule is an ALLOW rule with a CIDR condition containing the
+// address, a rule that only names the host or port does not open them, so
+// that clients cannot reach the server's own network by default. NAT64 and
+// 6to4 addresses are private if the IPv4 address they embed is.
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Randomsock5/tcptunnel/identity"
+)
+
+// Decision is the outcome of checking a destination.
+type Decision struct {
+	Allow bool
+	// Rule is the rule that decided, "FINAL" for the final action and
+	// "PRIVATE" when the address is private and no rule allowed it.
+	Rule string
+}
+
+func (d Decision) String() string {
+	if d.Allow {
+		return "allow (" + d.Rule + ")"
+	}
+	return "deny (" + d.Rule + ")"
+}
+
+// Destination describes the connection being checked.
+type Destination struct {
+	// Host is the destination host as requested, a name or an IP address.
+	Host string
+	// IP is the address that is going to be connected to, Host resolved.
+	IP   net.IP
+	Port int
+	// User is the identity of the client, it may be empty.
+	User string
+	// Groups are the groups of the client.
+	Groups []string
+}
+
+type conditionType string
+
+const (
+	cidr   conditionType = "CIDR"
+	domain conditionType = "DOMAIN"
+	port   conditionType = "PORT"
+	user   conditionType = "USER"
+	group  conditionType = "GROUP"
+)
+
+type condition struct {
+	typ   conditionType
+	value string
+
+	network  *net.IPNet
+	min, max int
+}
+
+func (c *condition) match(d Destination) bool {
+	switch c.typ {
+	case cidr:
+		return d.IP != nil && c.network.Contains(d.IP)
+	case domain:
+		host := strings.ToLower(strings.TrimSuffix(d.Host, "."))
+		if net.ParseIP(host) != nil {
+			return false
+		}
+		switch {
+		case c.value == "*":
+			return true
+		case strings.HasPrefix(c.value, "*."):
+			return strings.HasSuffix(host, c.value[1:])
+		}
+		return host == c.value
+	case port:
+		return d.Port >= c.min && d.Port <= c.max
+	case user:
+		if c.value == "*" {
+			return d.User != ""
+		}
+		return d.User == c.value
+	case group:
+		for _, g := range d.Groups {
+			if g == c.value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type rule struct {
+	allow      bool
+	conditions []*condition
+	text       string
+}
+
+func (r *rule) match(d Destination) bool {
+	for _, c := range r.conditions {
+		if !c.match(d) {
+			return false
+		}
+	}
+	return true
+}
+
+// opens reports whether the rule names ip by a CIDR condition.
+func (r *rule) opens(ip net.IP) bool {
+	for _, c := range r.conditions {
+		if c.typ == cidr && c.network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type ruleSet struct {
+	rules []*rule
+	final bool
+}
+
+// Policy checks destinations against the most recently loaded rules. It is
+// safe for concurrent use.
+type Policy struct {
+	set atomic.Value // *ruleSet
+}
+
+// New returns a Policy without rules, which allows all public addresses.
+func New() *Policy {
+	p := &Policy{}
+	p.Reset()
+	return p
+}
+
+// Load replaces the rules of p by those of the file at path. p is left
+// unchanged if the file cannot be read or holds an invalid rule.
+func (p *Policy) Load(path string) error {
+	set, err := load(path)
+	if err != nil {
+		return err
+	}
+	p.set.Store(set)
+	return nil
+}
+
+// Reset removes the rules of p.
+func (p *Policy) Reset() {
+	p.set.Store(&ruleSet{final: true})
+}
+
+// Check returns the decision of the first rule matching d.
+func (p *Policy) Check(d Destination) Decision {
+	set := p.set.Load().(*ruleSet)
+	for _, r := range set.rules {
+		if !r.match(d) {
+			continue
+		}
+		if r.allow && d.IP != nil && Private(d.IP) && !r.opens(d.IP) {
+			break
+		}
+		return Decision{Allow: r.allow, Rule: r.text}
+	}
+	if d.IP != nil && Private(d.IP) {
+		return Decision{Rule: "PRIVATE"}
+	}
+	return Decision{Allow: set.final, Rule: "FINAL"}
+}
+
+func load(path string) (*ruleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	set := &ruleSet{final: true}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := set.add(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// add parses line and appends the rule it holds.
+func (s *ruleSet) add(line string) error {
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	if strings.ToUpper(fields[0]) == "FINAL" {
+		if len(fields) != 2 {
+			return fmt.Errorf("expected FINAL,ACTION")
+		}
+		allow, err := parseAction(fields[1])
+		if err != nil {
+			return err
+		}
+		s.final = allow
+		return nil
+	}
+
+	allow, err := parseAction(fields[0])
+	if err != nil {
+		return err
+	}
+	r := &rule{allow: allow, text: strings.Join(fields, ",")}
+	for _, f := range fields[1:] {
+		c, err := parseCondition(f)
+		if err != nil {
+			return err
+		}
+		r.conditions = append(r.conditions, c)
+	}
+	s.rules = append(s.rules, r)
+	return nil
+}
+
+func parseAction(s string) (allow bool, err error) {
+	switch strings.ToUpper(s) {
+	case "ALLOW":
+		return true, nil
+	case "DENY":
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown action %q", s)
+}
+
+func parseCondition(s string) (*condition, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return nil, fmt.Errorf("expected TYPE=VALUE in %q", s)
+	}
+	c := &condition{
+		typ:   conditionType(strings.ToUpper(strings.TrimSpace(s[:i]))),
+		value: strings.TrimSpace(s[i+1:]),
+	}
+
+	var err error
+	switch c.typ {
+	case cidr:
+		if _, c.network, err = net.ParseCIDR(c.value); err != nil {
+			ip := net.ParseIP(c.value)
+			if ip == nil {
+				return nil, err
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			c.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+	case domain:
+		c.value = strings.ToLower(strings.TrimSuffix(c.value, "."))
+		if c.value == "" {
+			return nil, fmt.Errorf("empty domain pattern")
+		}
+	case port:
+		lo, hi := c.value, c.value
+		if j := strings.Index(c.value, "-"); j >= 0 {
+			lo, hi = c.value[:j], c.value[j+1:]
+		}
+		c.min, err = strconv.Atoi(lo)
+		if err == nil {
+			c.max, err = strconv.Atoi(hi)
+		}
+		if err != nil || c.min <= 0 || c.max > 0xffff || c.min > c.max {
+			return nil, fmt.Errorf("invalid port range %q", c.value)
+		}
+	case user, group:
+		if c.value == "" {
+			return nil, fmt.Errorf("empty %s", strings.ToLower(string(c.typ)))
+		}
+		if c.typ == user && c.value != "*" {
+			c.value = identity.Qualify(c.value)
+		}
+	default:
+		return nil, fmt.Errorf("unknown condition type %q", s[:i])
+	}
+	return c, nil
+}
+
+// privateNetworks are the networks not reachable on the public Internet.
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/3",
+	"::/127",
+	"64:ff9b:1::/48",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = n
+	}
+	return networks
+}
+
+// IPv6 addresses in nat64 and sixToFour embed an IPv4 address, they are
+// private if it is.
+var (
+	nat64     = parseNetworks("64:ff9b::/96")[0]
+	sixToFour = parseNetworks("2002::/16")[0]
+)
+
+// Private reports whether ip is a private, loopback, link-local, multicast
+// or otherwise special purpose address.
+func Private(ip net.IP) bool {
+	switch {
+	case ip.To4() != nil:
+		ip = ip.To4()
+	case nat64.Contains(ip):
+		ip = ip.To16()[12:16]
+	case sixToFour.Contains(ip):
+		ip = ip.To16()[2:6]
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
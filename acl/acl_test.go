@@ -0,0 +1,119 @@
+package acl
+
+import (
+	"net"
+	"testing"
+)
+
+// newPolicy returns a Policy holding the rules of lines.
+func newPolicy(t *testing.T, lines ...string) *Policy {
+	set := &ruleSet{final: true}
+	for _, line := range lines {
+		if err := set.add(line); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+	}
+	p := New()
+	p.set.Store(set)
+	return p
+}
+
+func TestPolicy_Check(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		host  string
+		port  int
+		user  string
+		allow bool
+		rule  string
+	}{
+		{name: "no rules", host: "192.0.2.1", port: 80, allow: true, rule: "FINAL"},
+		{name: "first match wins", rules: []string{"DENY,PORT=80", "ALLOW,PORT=80"},
+			host: "192.0.2.1", port: 80, rule: "DENY,PORT=80"},
+		{name: "later rule after miss", rules: []string{"DENY,PORT=25", "ALLOW,PORT=80", "FINAL,DENY"},
+			host: "192.0.2.1", port: 80, allow: true, rule: "ALLOW,PORT=80"},
+		{name: "final deny", rules: []string{"ALLOW,PORT=443", "FINAL,DENY"},
+			host: "192.0.2.1", port: 80, rule: "FINAL"},
+		{name: "final allow", rules: []string{"DENY,PORT=443", "FINAL,ALLOW"},
+			host: "192.0.2.1", port: 80, allow: true, rule: "FINAL"},
+
+		{name: "private denied by default", host: "10.1.2.3", port: 80, rule: "PRIVATE"},
+		{name: "loopback denied by default", host: "127.0.0.1", port: 80, rule: "PRIVATE"},
+		{name: "private not opened by port", rules: []string{"ALLOW,PORT=80"},
+			host: "10.1.2.3", port: 80, rule: "PRIVATE"},
+		{name: "private not opened by other network", rules: []string{"ALLOW,CIDR=192.168.0.0/16"},
+			host: "10.1.2.3", port: 80, rule: "PRIVATE"},
+		{name: "private opened by covering network", rules: []string{"ALLOW,CIDR=10.0.0.0/8,PORT=80"},
+			host: "10.1.2.3", port: 80, allow: true, rule: "ALLOW,CIDR=10.0.0.0/8,PORT=80"},
+		{name: "private opened by address", rules: []string{"ALLOW,CIDR=10.1.2.3"},
+			host: "10.1.2.3", port: 80, allow: true, rule: "ALLOW,CIDR=10.1.2.3"},
+		{name: "private denied by rule", rules: []string{"DENY,CIDR=10.0.0.0/8"},
+			host: "10.1.2.3", port: 80, rule: "DENY,CIDR=10.0.0.0/8"},
+
+		{name: "mapped IPv6 is private", host: "::ffff:10.1.2.3", port: 80, rule: "PRIVATE"},
+		{name: "mapped IPv6 matches IPv4 network", rules: []string{"ALLOW,CIDR=10.0.0.0/8"},
+			host: "::ffff:10.1.2.3", port: 80, allow: true, rule: "ALLOW,CIDR=10.0.0.0/8"},
+		{name: "NAT64 of private is private", host: "64:ff9b::a01:203", port: 80, rule: "PRIVATE"},
+		{name: "NAT64 of public is public", host: "64:ff9b::c000:201", port: 80, allow: true, rule: "FINAL"},
+		{name: "6to4 of private is private", host: "2002:a01:203::1", port: 80, rule: "PRIVATE"},
+		{name: "6to4 of public is public", host: "2002:c000:201::1", port: 80, allow: true, rule: "FINAL"},
+		{name: "unique local is private", host: "fd00::1", port: 80, rule: "PRIVATE"},
+
+		{name: "domain exact", rules: []string{"DENY,DOMAIN=example.com"},
+			host: "Example.COM.", port: 80, rule: "DENY,DOMAIN=example.com"},
+		{name: "domain exact not subdomain", rules: []string{"DENY,DOMAIN=example.com"},
+			host: "www.example.com", port: 80, allow: true, rule: "FINAL"},
+		{name: "domain wildcard subdomain", rules: []string{"DENY,DOMAIN=*.example.com"},
+			host: "a.b.example.com", port: 80, rule: "DENY,DOMAIN=*.example.com"},
+		{name: "domain wildcard not parent", rules: []string{"DENY,DOMAIN=*.example.com"},
+			host: "example.com", port: 80, allow: true, rule: "FINAL"},
+		{name: "domain wildcard not suffix", rules: []string{"DENY,DOMAIN=*.example.com"},
+			host: "badexample.com", port: 80, allow: true, rule: "FINAL"},
+		{name: "domain any not address", rules: []string{"DENY,DOMAIN=*"},
+			host: "192.0.2.1", port: 80, allow: true, rule: "FINAL"},
+
+		{name: "port range low", rules: []string{"DENY,PORT=8000-8080"},
+			host: "192.0.2.1", port: 8000, rule: "DENY,PORT=8000-8080"},
+		{name: "port range high", rules: []string{"DENY,PORT=8000-8080"},
+			host: "192.0.2.1", port: 8080, rule: "DENY,PORT=8000-8080"},
+		{name: "port range outside", rules: []string{"DENY,PORT=8000-8080"},
+			host: "192.0.2.1", port: 8081, allow: true, rule: "FINAL"},
+
+		{name: "user is a common name", rules: []string{"DENY,USER=alice"},
+			host: "192.0.2.1", port: 80, user: "cn:alice", rule: "DENY,USER=alice"},
+		{name: "user does not match alternative name", rules: []string{"DENY,USER=alice"},
+			host: "192.0.2.1", port: 80, user: "dns:alice", allow: true, rule: "FINAL"},
+		{name: "user with prefix", rules: []string{"DENY,USER=dns:alice"},
+			host: "192.0.2.1", port: 80, user: "dns:alice", rule: "DENY,USER=dns:alice"},
+		{name: "any user", rules: []string{"DENY,USER=*"},
+			host: "192.0.2.1", port: 80, user: "dns:alice", rule: "DENY,USER=*"},
+		{name: "any user needs an identity", rules: []string{"DENY,USER=*"},
+			host: "192.0.2.1", port: 80, allow: true, rule: "FINAL"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPolicy(t, tt.rules...)
+			d := Destination{Host: tt.host, Port: tt.port, User: tt.user}
+			if ip := net.ParseIP(tt.host); ip != nil {
+				d.IP = ip
+			} else {
+				d.IP = net.ParseIP("192.0.2.1")
+			}
+
+			got := p.Check(d)
+			if got.Allow != tt.allow || got.Rule != tt.rule {
+				t.Errorf("Check(%s:%d) = %v, want allow=%v rule %q", tt.host, tt.port, got, tt.allow, tt.rule)
+			}
+		})
+	}
+}
+
+func TestParseCondition_Invalid(t *testing.T) {
+	for _, s := range []string{"PORT=0", "PORT=80-70", "PORT=65536", "PORT=x", "CIDR=10.0.0.0/33", "DOMAIN=", "USER=", "HOST=x", "PORT"} {
+		if _, err := parseCondition(s); err == nil {
+			t.Errorf("parseCondition(%q) succeeded", s)
+		}
+	}
+}
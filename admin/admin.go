@@ -0,0 +1,88 @@
+// Package admin implements the tt-server control-plane service.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"strings"
+
+	pb "github.com/Randomsock5/tcptunnel/proto"
+	"github.com/Randomsock5/tcptunnel/transport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type adminService struct {
+	sessions *transport.Registry
+	reload   func() error
+}
+
+// NewServer returns an Admin service operating on the sessions recorded in
+// registry. reload is invoked by ReloadConfig and may be nil.
+func NewServer(registry *transport.Registry, reload func() error) pb.AdminServer {
+	return &adminService{sessions: registry, reload: reload}
+}
+
+func (s *adminService) ListSessions(ctx context.Context, req *pb.ListSessionsRequest) (*pb.ListSessionsResponse, error) {
+	var resp pb.ListSessionsResponse
+	for _, session := range s.sessions.Sessions() {
+		resp.Sessions = append(resp.Sessions, &pb.Session{
+			Id:         session.ID,
+			Peer:       session.Peer,
+			CommonName: session.CommonName,
+			Target:     session.Target,
+			BytesUp:    session.BytesUp(),
+			BytesDown:  session.BytesDown(),
+			AgeSeconds: int64(session.Age().Seconds()),
+			Identity:   session.Identity,
+			Groups:     session.Groups,
+		})
+	}
+	return &resp, nil
+}
+
+func (s *adminService) KillSession(ctx context.Context, req *pb.KillSessionRequest) (*pb.KillSessionResponse, error) {
+	if !s.sessions.Kill(req.GetId()) {
+		return nil, status.Errorf(codes.NotFound, "session %d not found", req.GetId())
+	}
+	log.Printf("admin: killed session %d", req.GetId())
+	return &pb.KillSessionResponse{}, nil
+}
+
+func (s *adminService) DrainServer(ctx context.Context, req *pb.DrainServerRequest) (*pb.DrainServerResponse, error) {
+	s.sessions.Drain()
+	log.Println("admin: draining server")
+	return &pb.DrainServerResponse{ActiveSessions: int32(s.sessions.Len())}, nil
+}
+
+func (s *adminService) ReloadConfig(ctx context.Context, req *pb.ReloadConfigRequest) (*pb.ReloadConfigResponse, error) {
+	if s.reload == nil {
+		return nil, status.Error(codes.Unimplemented, "reload is not supported")
+	}
+	if err := s.reload(); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "reload failed: %v", err)
+	}
+	log.Println("admin: configuration reloaded")
+	return &pb.ReloadConfigResponse{}, nil
+}
+
+// TokenAuth returns an interceptor that only lets through calls carrying
+// "authorization: Bearer <token>" metadata.
+func TokenAuth(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, v := range md.Get("authorization") {
+			if !strings.HasPrefix(v, "Bearer ") {
+				continue
+			}
+			given := v[len("Bearer "):]
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+				return handler(ctx, req)
+			}
+		}
+		return nil, status.Error(codes.Unauthenticated, "invalid admin token")
+	}
+}
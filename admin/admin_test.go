@@ -0,0 +1,79 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	pb "github.com/Randomsock5/tcptunnel/proto"
+	"github.com/Randomsock5/tcptunnel/transport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestTokenAuth(t *testing.T) {
+	tests := []struct {
+		name string
+		md   metadata.MD
+		code codes.Code
+	}{
+		{name: "bearer token", md: metadata.Pairs("authorization", "Bearer s3cret"), code: codes.OK},
+		{name: "one of several", md: metadata.Pairs("authorization", "Basic xyz", "authorization", "Bearer s3cret"), code: codes.OK},
+		{name: "no metadata", code: codes.Unauthenticated},
+		{name: "no authorization", md: metadata.Pairs("x-token", "s3cret"), code: codes.Unauthenticated},
+		{name: "bare token", md: metadata.Pairs("authorization", "s3cret"), code: codes.Unauthenticated},
+		{name: "other scheme", md: metadata.Pairs("authorization", "Basic s3cret"), code: codes.Unauthenticated},
+		{name: "wrong token", md: metadata.Pairs("authorization", "Bearer guess"), code: codes.Unauthenticated},
+		{name: "token prefix", md: metadata.Pairs("authorization", "Bearer s3cre"), code: codes.Unauthenticated},
+		{name: "empty token", md: metadata.Pairs("authorization", "Bearer "), code: codes.Unauthenticated},
+	}
+
+	auth := TokenAuth("s3cret")
+	for _, tt := range tests {
+		ctx := context.Background()
+		if tt.md != nil {
+			ctx = metadata.NewIncomingContext(ctx, tt.md)
+		}
+		called := false
+		_, err := auth(ctx, nil, &grpc.UnaryServerInfo{}, func(context.Context, interface{}) (interface{}, error) {
+			called = true
+			return nil, nil
+		})
+		if code := status.Code(err); code != tt.code {
+			t.Errorf("%s: code %v, want %v", tt.name, code, tt.code)
+		}
+		if called != (tt.code == codes.OK) {
+			t.Errorf("%s: handler called %v", tt.name, called)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	registry := transport.NewRegistry()
+	reloadErr := errors.New("bad rules")
+	s := NewServer(registry, func() error { return reloadErr })
+	ctx := context.Background()
+
+	if _, err := s.KillSession(ctx, &pb.KillSessionRequest{Id: 1}); status.Code(err) != codes.NotFound {
+		t.Errorf("KillSession of an unknown session = %v, want NotFound", err)
+	}
+	if _, err := s.ReloadConfig(ctx, &pb.ReloadConfigRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("failed ReloadConfig = %v, want FailedPrecondition", err)
+	}
+	reloadErr = nil
+	if _, err := s.ReloadConfig(ctx, &pb.ReloadConfigRequest{}); err != nil {
+		t.Errorf("ReloadConfig = %v", err)
+	}
+	if _, err := NewServer(registry, nil).ReloadConfig(ctx, &pb.ReloadConfigRequest{}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("ReloadConfig without reload = %v, want Unimplemented", err)
+	}
+
+	if _, err := s.DrainServer(ctx, &pb.DrainServerRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if !registry.Draining() {
+		t.Error("registry not draining after DrainServer")
+	}
+}
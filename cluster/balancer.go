@@ -0,0 +1,255 @@
+package cluster
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+// balancerName is the name the cluster balancer is registered with.
+const balancerName = "tt_cluster"
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(balancerName, pickerBuilder{}))
+}
+
+type pickerBuilder struct{}
+
+// Build returns a picker over the ready connections, grouped by server and
+// ordered like the servers of the cluster.
+func (pickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+	if len(readySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	p := &picker{}
+	groups := make(map[*member]*group)
+	for addr, sc := range readySCs {
+		s, ok := addr.Metadata.(*slot)
+		if !ok {
+			continue
+		}
+		atomic.StoreInt32(&s.ready, 1)
+
+		g, ok := groups[s.member]
+		if !ok {
+			g = &group{member: s.member}
+			groups[s.member] = g
+			p.groups = append(p.groups, g)
+			p.cluster = s.member.cluster
+		}
+		g.conns = append(g.conns, conn{sc, s})
+	}
+
+	sort.Slice(p.groups, func(i, j int) bool { return p.groups[i].member.index < p.groups[j].member.index })
+	for _, g := range p.groups {
+		conns := g.conns
+		sort.Slice(conns, func(i, j int) bool { return conns[i].slot.index < conns[j].slot.index })
+	}
+	return p
+}
+
+type conn struct {
+	sc   balancer.SubConn
+	slot *slot
+}
+
+// group holds the ready connections to one server.
+type group struct {
+	member *member
+	conns  []conn
+}
+
+type picker struct {
+	cluster *Cluster
+	groups  []*group
+	next    uint64
+}
+
+func (p *picker) Pick(ctx context.Context, opts balancer.PickOptions) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	groups := p.groups
+	if server, ok := ctx.Value(serverKey{}).(string); ok {
+		groups = nil
+		for _, g := range p.groups {
+			if g.member.Addr == server {
+				groups = append(groups, g)
+			}
+		}
+		if len(groups) == 0 {
+			return nil, nil, balancer.ErrTransientFailure
+		}
+	}
+
+	// Servers failing their health checks are avoided as long as
+	// another one is available.
+	candidates := make([]*group, 0, len(groups))
+	for _, g := range groups {
+		if g.member.isHealthy() {
+			candidates = append(candidates, g)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = groups
+	}
+	if len(candidates) == 0 {
+		return nil, nil, balancer.ErrNoSubConnAvailable
+	}
+
+	var g *group
+	switch p.cluster.opts.Policy {
+	case RoundRobin:
+		g = p.roundRobin(candidates)
+	case LeastStreams:
+		g = leastStreams(candidates)
+	case LowestRTT:
+		g = lowestRTT(candidates)
+	default:
+		g = candidates[0]
+	}
+
+	c := g.pick(ctx, p.cluster.opts.Placement)
+	if t, ok := ctx.Value(trackerKey{}).(*Tracker); ok {
+		t.set(c.slot)
+	}
+
+	s, m := c.slot, c.slot.member
+	atomic.AddInt64(&s.streams, 1)
+	atomic.AddInt64(&m.streams, 1)
+	if m.saturated() {
+		go p.cluster.grow(m)
+	}
+	return c.sc, func(balancer.DoneInfo) {
+		atomic.AddInt64(&s.streams, -1)
+		atomic.AddInt64(&m.streams, -1)
+	}, nil
+}
+
+// roundRobin picks the candidates in turn, each as often as its weight.
+func (p *picker) roundRobin(candidates []*group) *group {
+	total := 0
+	for _, g := range candidates {
+		total += g.member.Weight
+	}
+
+	n := int(atomic.AddUint64(&p.next, 1) % uint64(total))
+	for _, g := range candidates {
+		if n < g.member.Weight {
+			return g
+		}
+		n -= g.member.Weight
+	}
+	return candidates[0]
+}
+
+func leastStreams(candidates []*group) *group {
+	best := candidates[0]
+	for _, g := range candidates[1:] {
+		// g.streams/g.weight < best.streams/best.weight
+		if atomic.LoadInt64(&g.member.streams)*int64(best.member.Weight) <
+			atomic.LoadInt64(&best.member.streams)*int64(g.member.Weight) {
+			best = g
+		}
+	}
+	return best
+}
+
+// lowestRTT picks the candidate with the lowest measured RTT, servers that
+// have not been measured yet come last.
+func lowestRTT(candidates []*group) *group {
+	best := candidates[0]
+	bestRTT := atomic.LoadInt64(&best.member.rtt)
+	for _, g := range candidates[1:] {
+		rtt := atomic.LoadInt64(&g.member.rtt)
+		if rtt != 0 && (bestRTT == 0 || rtt < bestRTT) {
+			best, bestRTT = g, rtt
+		}
+	}
+	return best
+}
+
+// pick chooses the connection of the group a stream is placed on.
+func (g *group) pick(ctx context.Context, placement Placement) conn {
+	if placement == Hash {
+		if key, ok := ctx.Value(keyKey{}).(string); ok {
+			h := fnv.New32a()
+			h.Write([]byte(key))
+			return g.conns[h.Sum32()%uint32(len(g.conns))]
+		}
+	}
+
+	// Least load: the fewest streams, preferring connections whose flow
+	// control did not stall recently.
+	best := g.conns[0]
+	for _, c := range g.conns[1:] {
+		cp, bp := c.slot.isPressured(), best.slot.isPressured()
+		if cp != bp {
+			if bp {
+				best = c
+			}
+			continue
+		}
+		if atomic.LoadInt64(&c.slot.streams) < atomic.LoadInt64(&best.slot.streams) {
+			best = c
+		}
+	}
+	return best
+}
+
+type keyKey struct{}
+
+// WithKey returns a context whose streams are placed on a connection chosen
+// by hashing key when the Hash placement is used, typically the host of the
+// local client a stream serves.
+func WithKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, keyKey{}, key)
+}
+
+type serverKey struct{}
+
+// WithServer returns a context whose streams are only sent to the server at
+// addr, they fail if it has no ready connection.
+func WithServer(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, serverKey{}, addr)
+}
+
+type trackerKey struct{}
+
+// Tracker records the server the streams started with its context were
+// sent to.
+type Tracker struct {
+	mu   sync.Mutex
+	slot *slot
+}
+
+// WithTracker returns a context carrying a new Tracker.
+func WithTracker(ctx context.Context) (context.Context, *Tracker) {
+	t := &Tracker{}
+	return context.WithValue(ctx, trackerKey{}, t), t
+}
+
+// Addr returns the address of the server picked last, or "" if no stream
+// has been started.
+func (t *Tracker) Addr() string {
+	if s := t.picked(); s != nil {
+		return s.member.Addr
+	}
+	return ""
+}
+
+func (t *Tracker) picked() *slot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.slot
+}
+
+func (t *Tracker) set(s *slot) {
+	t.mu.Lock()
+	t.slot = s
+	t.mu.Unlock()
+}
@@ -0,0 +1,284 @@
+// Package cluster spreads the streams of a tunnel client over several
+// tt-servers. It plugs a resolver and a balancer into gRPC so that a single
+// grpc.ClientConn keeps a connection to every server, each dialed with its
+// own transport password and TLS settings, and picks a server for every
+// stream according to a Policy and the result of periodic health checks.
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Randomsock5/tcptunnel/transport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+)
+
+// Policy selects the server a new stream is sent to.
+type Policy string
+
+const (
+	// Failover sends all streams to the first healthy server in the list.
+	Failover Policy = "failover"
+	// RoundRobin rotates over the healthy servers in proportion to their
+	// weights.
+	RoundRobin Policy = "round_robin"
+	// LeastStreams picks the healthy server with the fewest active streams
+	// relative to its weight.
+	LeastStreams Policy = "least_streams"
+	// LowestRTT picks the healthy server with the lowest round trip time
+	// of the health checks.
+	LowestRTT Policy = "lowest_rtt"
+)
+
+// ParsePolicy returns the Policy named s.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case Failover, RoundRobin, LeastStreams, LowestRTT:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown balancing policy %q", s)
+}
+
+// Placement selects the pooled connection to a server a new stream is
+// placed on.
+type Placement string
+
+const (
+	// LeastLoad places streams on the connection with the fewest active
+	// streams, avoiding connections whose flow control stalled recently.
+	LeastLoad Placement = "least_load"
+	// Hash places streams by hashing the key set with WithKey, streams
+	// without a key are placed by LeastLoad.
+	Hash Placement = "hash"
+)
+
+// ParsePlacement returns the Placement named s.
+func ParsePlacement(s string) (Placement, error) {
+	switch p := Placement(s); p {
+	case LeastLoad, Hash:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown stream placement %q", s)
+}
+
+// Options configure a Cluster.
+type Options struct {
+	// Policy selects the server of each stream, Failover by default.
+	Policy Policy
+	// HealthInterval is the interval of the health checks of every
+	// server, which ask its gRPC health service whether the proxy service
+	// is serving.
+	HealthInterval time.Duration
+
+	// PoolSize is the number of connections opened to every server, at
+	// least one.
+	PoolSize int
+	// MaxPoolSize bounds the number of connections to a server. Another
+	// connection is opened while fewer are open and all of them carry
+	// StreamThreshold streams or are stalled by flow control.
+	MaxPoolSize int
+	// StreamThreshold is the number of streams a connection carries
+	// before the pool grows.
+	StreamThreshold int
+	// Placement selects the connection of each stream among those to the
+	// chosen server, LeastLoad by default.
+	Placement Placement
+}
+
+// Server describes one tt-server of a cluster.
+type Server struct {
+	// Addr is the host:port of the server.
+	Addr string
+	// Weight is the share of streams the server gets relative to the
+	// others, it defaults to 1.
+	Weight int
+	// Password is the key of the encrypted transport.
+	Password string
+	// TLS is the client TLS configuration used for the server.
+	TLS *tls.Config
+}
+
+// Cluster is a set of servers reached through one grpc.ClientConn.
+type Cluster struct {
+	id      string
+	opts    Options
+	members []*member
+
+	ccMu sync.Mutex
+	cc   resolver.ClientConn
+
+	done chan struct{}
+}
+
+var (
+	clustersMu sync.Mutex
+	lastID     int
+	clusters   = make(map[string]*Cluster)
+)
+
+// New returns a Cluster of servers.
+func New(servers []Server, opts Options) (*Cluster, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("cluster: no servers")
+	}
+	if opts.Policy == "" {
+		opts.Policy = Failover
+	}
+	if opts.Placement == "" {
+		opts.Placement = LeastLoad
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 1
+	}
+	if opts.MaxPoolSize < opts.PoolSize {
+		opts.MaxPoolSize = opts.PoolSize
+	}
+
+	c := &Cluster{
+		opts: opts,
+		done: make(chan struct{}),
+	}
+	for i, s := range servers {
+		if _, _, err := net.SplitHostPort(s.Addr); err != nil {
+			return nil, fmt.Errorf("cluster: server %q: %v", s.Addr, err)
+		}
+		if s.Weight <= 0 {
+			s.Weight = 1
+		}
+		m := &member{
+			Server:  s,
+			cluster: c,
+			index:   i,
+			creds:   credentials.NewTLS(s.TLS),
+		}
+		for j := 0; j < opts.PoolSize; j++ {
+			m.slots = append(m.slots, &slot{member: m, index: j})
+		}
+		c.members = append(c.members, m)
+	}
+
+	clustersMu.Lock()
+	lastID++
+	c.id = strconv.Itoa(lastID)
+	clusters[c.id] = c
+	clustersMu.Unlock()
+
+	return c, nil
+}
+
+// Dial returns a grpc.ClientConn balancing over the servers of the cluster
+// and starts the health checks, which are sent over it. It must be called
+// once. opts must not set a dialer, transport credentials, a balancer or a
+// stream interceptor.
+func (c *Cluster) Dial(opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append(opts,
+		grpc.WithTransportCredentials(&clusterCreds{}),
+		grpc.WithDialer(c.dial),
+		grpc.WithBalancerName(balancerName),
+		grpc.WithStreamInterceptor(c.streamInterceptor),
+	)
+	conn, err := grpc.Dial(scheme+":///"+c.id, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range c.members {
+		go m.probe(conn, c.opts.HealthInterval, c.done)
+	}
+	return conn, nil
+}
+
+// Close stops the health checks of the cluster.
+func (c *Cluster) Close() {
+	clustersMu.Lock()
+	delete(clusters, c.id)
+	clustersMu.Unlock()
+	close(c.done)
+}
+
+// addresses returns an address for every pooled connection, they only
+// differ in the slot carried as metadata.
+func (c *Cluster) addresses() []resolver.Address {
+	var addrs []resolver.Address
+	for _, m := range c.members {
+		m.mu.Lock()
+		for _, s := range m.slots {
+			addrs = append(addrs, resolver.Address{Addr: m.Addr, Metadata: s})
+		}
+		m.mu.Unlock()
+	}
+	return addrs
+}
+
+// updateAddresses hands the current addresses to gRPC.
+func (c *Cluster) updateAddresses() {
+	c.ccMu.Lock()
+	defer c.ccMu.Unlock()
+	if c.cc != nil {
+		c.cc.NewAddress(c.addresses())
+	}
+}
+
+func (c *Cluster) member(addr string) *member {
+	for _, m := range c.members {
+		if m.Addr == addr {
+			return m
+		}
+	}
+	return nil
+}
+
+// dial opens the encrypted transport to the server at addr.
+func (c *Cluster) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	m := c.member(addr)
+	if m == nil {
+		return nil, fmt.Errorf("cluster: unknown server %q", addr)
+	}
+	conn, err := transport.Dial(addr, m.Password, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &memberConn{Conn: conn, member: m}, nil
+}
+
+// memberConn carries the server a connection was dialed to into the TLS
+// handshake.
+type memberConn struct {
+	net.Conn
+	member *member
+}
+
+// clusterCreds performs the TLS handshake of every connection with the
+// settings of the server it was dialed to.
+type clusterCreds struct{}
+
+func (clusterCreds) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	mc, ok := rawConn.(*memberConn)
+	if !ok {
+		return nil, nil, fmt.Errorf("cluster: connection to %v not dialed by the cluster", rawConn.RemoteAddr())
+	}
+	return mc.member.creds.ClientHandshake(ctx, authority, rawConn)
+}
+
+func (clusterCreds) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, fmt.Errorf("cluster: server handshake not supported")
+}
+
+func (clusterCreds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "tls", SecurityVersion: "1.2"}
+}
+
+func (c *clusterCreds) Clone() credentials.TransportCredentials {
+	return &clusterCreds{}
+}
+
+func (clusterCreds) OverrideServerName(string) error {
+	return nil
+}
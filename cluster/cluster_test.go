@@ -0,0 +1,277 @@
+package cluster
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/resolver"
+)
+
+// fakeSubConn is a connection of a picker, slot tells them apart as
+// pointers to empty structs may be equal.
+type fakeSubConn struct {
+	slot *slot
+}
+
+func (fakeSubConn) UpdateAddresses([]resolver.Address) {}
+func (fakeSubConn) Connect()                           {}
+
+// newTestCluster returns a cluster of servers, all healthy, and a picker
+// over a ready connection per pooled slot, which slots maps back to the
+// slot.
+func newTestCluster(t *testing.T, opts Options, servers ...Server) (*Cluster, balancer.Picker, map[balancer.SubConn]*slot) {
+	c, err := New(servers, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range c.members {
+		atomic.StoreInt32(&m.healthy, 1)
+	}
+	p, slots := buildPicker(c)
+	return c, p, slots
+}
+
+// buildPicker builds a picker over the current slots of c.
+func buildPicker(c *Cluster) (balancer.Picker, map[balancer.SubConn]*slot) {
+	ready := make(map[resolver.Address]balancer.SubConn)
+	slots := make(map[balancer.SubConn]*slot)
+	for _, addr := range c.addresses() {
+		s := addr.Metadata.(*slot)
+		sc := &fakeSubConn{s}
+		ready[addr] = sc
+		slots[sc] = s
+	}
+	return pickerBuilder{}.Build(ready), slots
+}
+
+// pickN picks n times with ctx and returns how often each server was
+// picked. Streams are finished right away unless keep is set.
+func pickN(t *testing.T, p balancer.Picker, slots map[balancer.SubConn]*slot, ctx context.Context, n int, keep bool) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		sc, done, err := p.Pick(ctx, balancer.PickOptions{})
+		if err != nil {
+			t.Fatalf("Pick: %v", err)
+		}
+		counts[slots[sc].member.Addr]++
+		if !keep {
+			done(balancer.DoneInfo{})
+		}
+	}
+	return counts
+}
+
+func TestPicker_Policy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		// setup changes the state of the members a and b before picking.
+		setup func(a, b *member)
+		want  map[string]int
+	}{
+		{name: "failover picks the first", policy: Failover,
+			want: map[string]int{"a:1": 30}},
+		{name: "failover skips unhealthy", policy: Failover,
+			setup: func(a, b *member) { atomic.StoreInt32(&a.healthy, 0) },
+			want:  map[string]int{"b:1": 30}},
+		{name: "all unhealthy still picked", policy: Failover,
+			setup: func(a, b *member) { atomic.StoreInt32(&a.healthy, 0); atomic.StoreInt32(&b.healthy, 0) },
+			want:  map[string]int{"a:1": 30}},
+		{name: "round robin by weight", policy: RoundRobin,
+			want: map[string]int{"a:1": 10, "b:1": 20}},
+		{name: "round robin skips unhealthy", policy: RoundRobin,
+			setup: func(a, b *member) { atomic.StoreInt32(&b.healthy, 0) },
+			want:  map[string]int{"a:1": 30}},
+		{name: "least streams relative to weight", policy: LeastStreams,
+			setup: func(a, b *member) { atomic.StoreInt64(&a.streams, 3); atomic.StoreInt64(&b.streams, 5) },
+			want:  map[string]int{"b:1": 30}},
+		{name: "least streams prefers lighter", policy: LeastStreams,
+			setup: func(a, b *member) { atomic.StoreInt64(&a.streams, 1); atomic.StoreInt64(&b.streams, 5) },
+			want:  map[string]int{"a:1": 30}},
+		{name: "lowest rtt", policy: LowestRTT,
+			setup: func(a, b *member) { atomic.StoreInt64(&a.rtt, 20); atomic.StoreInt64(&b.rtt, 10) },
+			want:  map[string]int{"b:1": 30}},
+		{name: "unmeasured rtt comes last", policy: LowestRTT,
+			setup: func(a, b *member) { atomic.StoreInt64(&b.rtt, 10) },
+			want:  map[string]int{"b:1": 30}},
+	}
+	for _, tt := range tests {
+		c, p, slots := newTestCluster(t, Options{Policy: tt.policy},
+			Server{Addr: "a:1"}, Server{Addr: "b:1", Weight: 2})
+		if tt.setup != nil {
+			tt.setup(c.members[0], c.members[1])
+		}
+		got := pickN(t, p, slots, context.Background(), 30, false)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: picked %v, want %v", tt.name, got, tt.want)
+		}
+		for addr, n := range tt.want {
+			if got[addr] != n {
+				t.Errorf("%s: picked %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+		c.Close()
+	}
+}
+
+func TestPicker_WithServer(t *testing.T) {
+	c, p, slots := newTestCluster(t, Options{}, Server{Addr: "a:1"}, Server{Addr: "b:1"})
+	defer c.Close()
+
+	got := pickN(t, p, slots, WithServer(context.Background(), "b:1"), 10, false)
+	if got["b:1"] != 10 {
+		t.Errorf("picked %v with server b:1, want only b:1", got)
+	}
+
+	// The server is used even while it fails its health checks
+	atomic.StoreInt32(&c.members[1].healthy, 0)
+	got = pickN(t, p, slots, WithServer(context.Background(), "b:1"), 10, false)
+	if got["b:1"] != 10 {
+		t.Errorf("picked %v with unhealthy server b:1, want only b:1", got)
+	}
+
+	if _, _, err := p.Pick(WithServer(context.Background(), "c:1"), balancer.PickOptions{}); err != balancer.ErrTransientFailure {
+		t.Errorf("Pick with unknown server = %v, want %v", err, balancer.ErrTransientFailure)
+	}
+}
+
+func TestPicker_Placement(t *testing.T) {
+	c, p, slots := newTestCluster(t, Options{Placement: Hash, PoolSize: 4}, Server{Addr: "a:1"})
+	defer c.Close()
+
+	// Streams with the same key share a connection
+	for _, key := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		ctx := WithKey(context.Background(), key)
+		first, done, err := p.Pick(ctx, balancer.PickOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(balancer.DoneInfo{})
+		for i := 0; i < 10; i++ {
+			sc, done, err := p.Pick(ctx, balancer.PickOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			done(balancer.DoneInfo{})
+			if sc != first {
+				t.Errorf("key %s placed on slots %d and %d", key, slots[first].index, slots[sc].index)
+				break
+			}
+		}
+	}
+
+	// Streams without a key are spread by load
+	used := make(map[int]bool)
+	for i := 0; i < 4; i++ {
+		sc, _, err := p.Pick(context.Background(), balancer.PickOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		used[slots[sc].index] = true
+	}
+	if len(used) != 4 {
+		t.Errorf("4 streams without key placed on slots %v, want all 4", used)
+	}
+}
+
+func TestPicker_LeastLoad(t *testing.T) {
+	c, p, slots := newTestCluster(t, Options{PoolSize: 3}, Server{Addr: "a:1"})
+	defer c.Close()
+	s := c.members[0].slots
+
+	atomic.StoreInt64(&s[0].streams, 2)
+	atomic.StoreInt64(&s[1].streams, 1)
+	atomic.StoreInt64(&s[2].streams, 0)
+	sc, done, _ := p.Pick(context.Background(), balancer.PickOptions{})
+	done(balancer.DoneInfo{})
+	if got := slots[sc].index; got != 2 {
+		t.Errorf("placed on slot %d, want the idle slot 2", got)
+	}
+
+	// A connection stalled by flow control is avoided despite its load
+	atomic.StoreInt64(&s[2].pressured, time.Now().Add(time.Minute).UnixNano())
+	sc, done, _ = p.Pick(context.Background(), balancer.PickOptions{})
+	done(balancer.DoneInfo{})
+	if got := slots[sc].index; got != 1 {
+		t.Errorf("placed on slot %d, want slot 1 as slot 2 is pressured", got)
+	}
+}
+
+func TestCluster_Grow(t *testing.T) {
+	c, err := New([]Server{{Addr: "a:1"}}, Options{PoolSize: 1, MaxPoolSize: 2, StreamThreshold: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	m := c.members[0]
+	buildPicker(c)
+
+	atomic.StoreInt64(&m.slots[0].streams, 1)
+	if m.saturated() {
+		t.Fatal("saturated with 1 stream below the threshold of 2")
+	}
+	atomic.StoreInt64(&m.slots[0].streams, 2)
+	if !m.saturated() {
+		t.Fatal("not saturated with 2 streams at the threshold of 2")
+	}
+	atomic.StoreInt64(&m.slots[0].streams, 0)
+	atomic.StoreInt64(&m.slots[0].pressured, time.Now().Add(time.Minute).UnixNano())
+	if !m.saturated() {
+		t.Fatal("not saturated with every connection under pressure")
+	}
+
+	// The pool only grows once the connection added last became ready
+	c.grow(m)
+	c.grow(m)
+	if n := len(m.slots); n != 2 {
+		t.Fatalf("pool of %d connections after growing, want 2", n)
+	}
+	if m.saturated() {
+		t.Error("saturated with an unused connection")
+	}
+
+	// It stays within MaxPoolSize
+	buildPicker(c)
+	atomic.StoreInt64(&m.slots[1].streams, 2)
+	c.grow(m)
+	if n := len(m.slots); n != 2 {
+		t.Errorf("pool of %d connections after growing at MaxPoolSize 2, want 2", n)
+	}
+}
+
+func TestCluster_GrowUntilReady(t *testing.T) {
+	c, err := New([]Server{{Addr: "a:1"}}, Options{PoolSize: 1, MaxPoolSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	m := c.members[0]
+
+	buildPicker(c)
+	c.grow(m)
+	c.grow(m)
+	if n := len(m.slots); n != 2 {
+		t.Fatalf("pool of %d connections while the new one is not ready, want 2", n)
+	}
+	buildPicker(c)
+	c.grow(m)
+	if n := len(m.slots); n != 3 {
+		t.Errorf("pool of %d connections after the new one became ready, want 3", n)
+	}
+}
+
+func TestMember_SampleRTT(t *testing.T) {
+	m := &member{}
+	m.sampleRTT(100 * time.Millisecond)
+	if got := time.Duration(m.rtt); got != 100*time.Millisecond {
+		t.Errorf("first sample gives rtt %v, want 100ms", got)
+	}
+	m.sampleRTT(200 * time.Millisecond)
+	if got := time.Duration(m.rtt); got != 125*time.Millisecond {
+		t.Errorf("second sample gives rtt %v, want 125ms", got)
+	}
+}
@@ -0,0 +1,108 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	// rttWeight is the weight of a new sample in the smoothed RTT.
+	rttWeight = 0.25
+
+	// healthService is the service whose status the health checks ask
+	// for, a server that stops forwarding or drains reports it as not
+	// serving.
+	healthService = "proto.ProxyService"
+)
+
+// member is the state kept for one server of a cluster.
+type member struct {
+	// rtt is the smoothed round trip time of the health checks in
+	// nanoseconds, streams the number of active streams and healthy is 1
+	// while the last health check succeeded. All are accessed atomically,
+	// the 64-bit fields must stay first to be aligned.
+	rtt     int64
+	streams int64
+	healthy int32
+
+	Server
+	cluster *Cluster
+	index   int
+	creds   credentials.TransportCredentials
+
+	mu    sync.Mutex
+	slots []*slot
+}
+
+func (m *member) isHealthy() bool {
+	return atomic.LoadInt32(&m.healthy) == 1
+}
+
+// probe asks the health service of the server over conn every interval
+// whether it is serving and measures the time the answer takes, until done
+// is closed. Any answer but SERVING, or none within interval, makes the
+// server unhealthy.
+func (m *member) probe(conn *grpc.ClientConn, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	client := healthpb.NewHealthClient(conn)
+	first := true
+	for {
+		err := m.check(client, interval)
+
+		healthy := int32(0)
+		if err == nil {
+			healthy = 1
+		}
+		if old := atomic.SwapInt32(&m.healthy, healthy); old != healthy || first {
+			if err != nil {
+				log.Printf("cluster: server %s unhealthy: %v", m.Addr, err)
+			} else {
+				log.Printf("cluster: server %s healthy, rtt %v", m.Addr, time.Duration(atomic.LoadInt64(&m.rtt)))
+			}
+		}
+		first = false
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// check asks the health service of the server whether it is serving,
+// waiting up to timeout for a connection to it to become ready.
+func (m *member) check(client healthpb.HealthClient, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(WithServer(context.Background(), m.Addr), timeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: healthService}, grpc.FailFast(false))
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("health status %v", resp.Status)
+	}
+	m.sampleRTT(time.Since(start))
+	return nil
+}
+
+func (m *member) sampleRTT(d time.Duration) {
+	old := atomic.LoadInt64(&m.rtt)
+	if old == 0 {
+		atomic.StoreInt64(&m.rtt, int64(d))
+		return
+	}
+	atomic.StoreInt64(&m.rtt, int64(float64(old)*(1-rttWeight)+float64(d)*rttWeight))
+}
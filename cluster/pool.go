@@ -0,0 +1,112 @@
+package cluster
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+const (
+	// pressureDelay is how long a send may block on flow control before
+	// the connection is considered under pressure.
+	pressureDelay = 50 * time.Millisecond
+
+	// pressureWindow is how long a connection stays under pressure after
+	// a stalled send.
+	pressureWindow = 5 * time.Second
+)
+
+// slot is one of the pooled connections to a server.
+type slot struct {
+	// streams is the number of active streams, pressured holds the time
+	// in nanoseconds until which the connection is under flow control
+	// pressure and ready is 1 once the connection has been ready. All
+	// are accessed atomically, the 64-bit fields must stay first to be
+	// aligned.
+	streams   int64
+	pressured int64
+	ready     int32
+
+	member *member
+	index  int
+}
+
+func (s *slot) isPressured() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&s.pressured)
+}
+
+// saturated reports whether every connection of the server carries at
+// least the stream threshold or is under flow control pressure.
+func (m *member) saturated() bool {
+	threshold := int64(m.cluster.opts.StreamThreshold)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.slots {
+		if atomic.LoadInt64(&s.streams) < threshold && !s.isPressured() {
+			return false
+		}
+	}
+	return true
+}
+
+// grow adds a connection to the pool of m unless the pool is full or a
+// connection added before has not become ready yet.
+func (c *Cluster) grow(m *member) {
+	m.mu.Lock()
+	if len(m.slots) >= c.opts.MaxPoolSize {
+		m.mu.Unlock()
+		return
+	}
+	for _, s := range m.slots {
+		if atomic.LoadInt32(&s.ready) == 0 {
+			m.mu.Unlock()
+			return
+		}
+	}
+	m.slots = append(m.slots, &slot{member: m, index: len(m.slots)})
+	size := len(m.slots)
+	m.mu.Unlock()
+
+	log.Printf("cluster: server %s pool grown to %d connections", m.Addr, size)
+	c.updateAddresses()
+}
+
+// streamInterceptor watches the sends of every stream and marks the
+// connection it was placed on as under pressure when a send stalls.
+func (c *Cluster) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	t, ok := ctx.Value(trackerKey{}).(*Tracker)
+	if !ok {
+		ctx, t = WithTracker(ctx)
+	}
+
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s := t.picked()
+	if s == nil {
+		return stream, nil
+	}
+	return &pressureStream{ClientStream: stream, slot: s}, nil
+}
+
+type pressureStream struct {
+	grpc.ClientStream
+	slot *slot
+}
+
+func (p *pressureStream) SendMsg(m interface{}) error {
+	start := time.Now()
+	err := p.ClientStream.SendMsg(m)
+	if now := time.Now(); now.Sub(start) > pressureDelay {
+		atomic.StoreInt64(&p.slot.pressured, now.Add(pressureWindow).UnixNano())
+		if m := p.slot.member; m.saturated() {
+			go m.cluster.grow(m)
+		}
+	}
+	return err
+}
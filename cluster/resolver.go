@@ -0,0 +1,42 @@
+package cluster
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// scheme is the target scheme of cluster connections, the endpoint of the
+// target is the ID of the cluster.
+const scheme = "tt-cluster"
+
+func init() {
+	resolver.Register(resolverBuilder{})
+}
+
+type resolverBuilder struct{}
+
+func (resolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+	clustersMu.Lock()
+	c, ok := clusters[target.Endpoint]
+	clustersMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("cluster: unknown cluster %q", target.Endpoint)
+	}
+
+	c.ccMu.Lock()
+	c.cc = cc
+	c.ccMu.Unlock()
+	c.updateAddresses()
+	return nopResolver{}, nil
+}
+
+func (resolverBuilder) Scheme() string {
+	return scheme
+}
+
+// nopResolver does nothing, the cluster pushes address updates itself.
+type nopResolver struct{}
+
+func (nopResolver) ResolveNow(resolver.ResolveNowOption) {}
+func (nopResolver) Close()                               {}
@@ -0,0 +1,232 @@
+// Package config loads the TOML configuration files of tt-client and
+// tt-server.
+//
+// A configuration is decoded into a struct whose fields carry, besides
+// their toml tag, a flag tag naming the command line flag they set. The
+// settings of a file are applied as values of those flags, unless the flag
+// was given on the command line, so that flags override the file:
+//
+//	type config struct {
+//		Listen struct {
+//			SOCKS5 *string `toml:"socks5" flag:"socks5"`
+//		} `toml:"listen"`
+//	}
+//
+// Tagged fields are pointers, left nil when the file does not set them, or
+// string slices, which are joined with commas.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Load decodes the TOML file at path into v. Keys v has no field for are
+// an error, they are most likely typos.
+func Load(path string, v interface{}) error {
+	md, err := toml.DecodeFile(path, v)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return fmt.Errorf("%s: unknown keys %s", path, strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// Flags returns the flag values set by the tagged fields of the struct v
+// points to, keyed by flag name.
+func Flags(v interface{}) map[string]string {
+	values := make(map[string]string)
+	collect(reflect.ValueOf(v).Elem(), values)
+	return values
+}
+
+func collect(v reflect.Value, values map[string]string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		name := t.Field(i).Tag.Get("flag")
+		if name == "" {
+			if field.Kind() == reflect.Struct {
+				collect(field, values)
+			}
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.Ptr:
+			if !field.IsNil() {
+				values[name] = format(field.Elem())
+			}
+		case reflect.Slice:
+			if !field.IsNil() {
+				items := make([]string, field.Len())
+				for j := range items {
+					items[j] = format(field.Index(j))
+				}
+				values[name] = strings.Join(items, ",")
+			}
+		}
+	}
+}
+
+func format(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+// Explicit returns the names of the flags of fs given on the command line.
+func Explicit(fs *flag.FlagSet) map[string]bool {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// Apply sets the flags of fs to values, except those in explicit.
+func Apply(fs *flag.FlagSet, values map[string]string, explicit map[string]bool) error {
+	for name, value := range values {
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("setting %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Changed returns the sorted names of the flags of fs, except those in
+// explicit, whose current value differs from values.
+func Changed(fs *flag.FlagSet, values map[string]string, explicit map[string]bool) []string {
+	var changed []string
+	for name, value := range values {
+		if f := fs.Lookup(name); f != nil && !explicit[name] && f.Value.String() != value {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Subset returns the values of the named flags of fs. Flags values does not
+// set get their default value, so that settings removed from a file are
+// reset when applied.
+func Subset(fs *flag.FlagSet, values map[string]string, names ...string) map[string]string {
+	subset := make(map[string]string)
+	for _, name := range names {
+		if value, ok := values[name]; ok {
+			subset[name] = value
+		} else if f := fs.Lookup(name); f != nil {
+			subset[name] = f.DefValue
+		}
+	}
+	return subset
+}
+
+// Reader returns the flag values set by the configuration file at path.
+type Reader func(path string) (map[string]string, error)
+
+// File is the configuration file of a program, given by its -config flag.
+type File struct {
+	fs         *flag.FlagSet
+	path       *string
+	read       Reader
+	reloadable []string
+	explicit   map[string]bool
+}
+
+// NewFile defines the -config flag on fs. The file is read by read, changes
+// of the flags named by reloadable are applied on reload, changes of the
+// others need a restart.
+func NewFile(fs *flag.FlagSet, read Reader, reloadable ...string) *File {
+	return &File{
+		fs:         fs,
+		path:       fs.String("config", "", "Set TOML configuration file, flags given on the command line override its settings"),
+		read:       read,
+		reloadable: reloadable,
+	}
+}
+
+// Path returns the path of the file, "" if none was given.
+func (f *File) Path() string {
+	return *f.path
+}
+
+// Load applies the file to the flags not given on the command line. It must
+// be called once, after the flags have been parsed.
+func (f *File) Load() error {
+	f.explicit = Explicit(f.fs)
+	if f.Path() == "" {
+		return nil
+	}
+
+	values, err := f.read(f.Path())
+	if err != nil {
+		return err
+	}
+	return Apply(f.fs, values, f.explicit)
+}
+
+// Reload rereads the file and applies the changes of the reloadable flags
+// not given on the command line. Changes of other flags are logged. Reload
+// does nothing without a file. It must not be called concurrently, nor with
+// anything reading the reloadable flags.
+func (f *File) Reload() error {
+	if f.Path() == "" {
+		return nil
+	}
+	values, err := f.read(f.Path())
+	if err != nil {
+		return err
+	}
+
+	for _, name := range Changed(f.fs, values, f.explicit) {
+		if !f.isReloadable(name) {
+			log.Printf("reload: -%s changed, restart to apply", name)
+		}
+	}
+	return Apply(f.fs, Subset(f.fs, values, f.reloadable...), f.explicit)
+}
+
+func (f *File) isReloadable(name string) bool {
+	for _, r := range f.reloadable {
+		if r == name {
+			return true
+		}
+	}
+	return false
+}
+
+// OnHangup calls fn every time the process receives SIGHUP.
+func OnHangup(fn func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			fn()
+		}
+	}()
+}
@@ -0,0 +1,223 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Listen struct {
+		SOCKS5 *string `toml:"socks5" flag:"socks5"`
+		Port   *int    `toml:"port" flag:"port"`
+	} `toml:"listen"`
+	Rules   []string `toml:"rules" flag:"rules"`
+	Verbose *bool    `toml:"verbose" flag:"verbose"`
+	// Durations are kept as strings, the flags parse them
+	Timeout *string `toml:"timeout" flag:"timeout"`
+	Comment *string `toml:"comment"`
+}
+
+func readTestConfig(path string) (map[string]string, error) {
+	var c testConfig
+	if err := Load(path, &c); err != nil {
+		return nil, err
+	}
+	return Flags(&c), nil
+}
+
+// newFlagSet returns a flag set defining the flags of testConfig.
+func newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("socks5", "", "")
+	fs.Int("port", 1080, "")
+	fs.String("rules", "", "")
+	fs.Bool("verbose", false, "")
+	fs.Duration("timeout", time.Second, "")
+	return fs
+}
+
+// writeFile replaces the content of the file at path.
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	writeFile(t, f.Name(), content)
+	return f.Name()
+}
+
+func TestFlags(t *testing.T) {
+	path := tempFile(t, `
+verbose = true
+timeout = "2s"
+rules = ["a.txt", "b.txt"]
+comment = "not a flag"
+
+[listen]
+socks5 = "127.0.0.1:1080"
+`)
+	defer os.Remove(path)
+
+	values, err := readTestConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"socks5":  "127.0.0.1:1080",
+		"rules":   "a.txt,b.txt",
+		"verbose": "true",
+		"timeout": "2s",
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Flags = %v, want %v", values, want)
+	}
+}
+
+func TestLoad_UnknownKeys(t *testing.T) {
+	path := tempFile(t, "verbose = true\n[listen]\nsocks = \"x\"\n")
+	defer os.Remove(path)
+
+	_, err := readTestConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "unknown keys listen.socks") {
+		t.Errorf("Load with a typo = %v, want an unknown keys error", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	fs := newFlagSet()
+	if err := fs.Parse([]string{"-port", "2080"}); err != nil {
+		t.Fatal(err)
+	}
+	explicit := Explicit(fs)
+	if !reflect.DeepEqual(explicit, map[string]bool{"port": true}) {
+		t.Errorf("Explicit = %v, want only port", explicit)
+	}
+
+	// Flags given on the command line win
+	if err := Apply(fs, map[string]string{"port": "3080", "socks5": ":1080"}, explicit); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.Lookup("port").Value.String(); got != "2080" {
+		t.Errorf("explicit -port = %s after Apply, want 2080", got)
+	}
+	if got := fs.Lookup("socks5").Value.String(); got != ":1080" {
+		t.Errorf("-socks5 = %s after Apply, want :1080", got)
+	}
+
+	if err := Apply(fs, map[string]string{"verbose": "maybe"}, explicit); err == nil {
+		t.Error("Apply of an invalid bool succeeded")
+	}
+}
+
+func TestChanged(t *testing.T) {
+	fs := newFlagSet()
+	fs.Parse([]string{"-port", "2080", "-socks5", ":1080"})
+	explicit := Explicit(fs)
+
+	got := Changed(fs, map[string]string{
+		"port":    "3080",
+		"socks5":  ":1080",
+		"verbose": "true",
+		"rules":   "",
+		"timeout": "2s",
+	}, explicit)
+	if want := []string{"timeout", "verbose"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Changed = %v, want %v", got, want)
+	}
+}
+
+func TestSubset(t *testing.T) {
+	fs := newFlagSet()
+	got := Subset(fs, map[string]string{"socks5": ":1080", "verbose": "true"}, "socks5", "port", "unknown")
+	want := map[string]string{"socks5": ":1080", "port": "1080"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Subset = %v, want %v", got, want)
+	}
+}
+
+func TestFile_Reload(t *testing.T) {
+	path := tempFile(t, `
+rules = ["a.txt"]
+verbose = true
+[listen]
+port = 2080
+socks5 = ":1080"
+`)
+	defer os.Remove(path)
+
+	fs := newFlagSet()
+	f := NewFile(fs, readTestConfig, "rules", "verbose", "socks5")
+	if err := fs.Parse([]string{"-config", path, "-socks5", ":9050"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Load(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(when string, want map[string]string) {
+		for name, value := range want {
+			if got := fs.Lookup(name).Value.String(); got != value {
+				t.Errorf("%s: -%s = %s, want %s", when, name, got, value)
+			}
+		}
+	}
+	check("after Load", map[string]string{"rules": "a.txt", "verbose": "true", "port": "2080", "socks5": ":9050"})
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	// Removed settings are reset, explicit flags are kept and changes that
+	// need a restart are only logged
+	writeFile(t, path, `
+rules = ["b.txt"]
+[listen]
+port = 3080
+socks5 = ":1081"
+`)
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	check("after Reload", map[string]string{"rules": "b.txt", "verbose": "false", "port": "2080", "socks5": ":9050"})
+	if !strings.Contains(logged.String(), "-port changed, restart to apply") {
+		t.Errorf("changed -port not logged, log:\n%s", logged.String())
+	}
+	if strings.Contains(logged.String(), "-rules") || strings.Contains(logged.String(), "-socks5") {
+		t.Errorf("reloadable or explicit flags logged:\n%s", logged.String())
+	}
+
+	// A broken file changes nothing
+	writeFile(t, path, "rules = [\n")
+	if err := f.Reload(); err == nil {
+		t.Error("Reload of a broken file succeeded")
+	}
+	check("after a failed Reload", map[string]string{"rules": "b.txt", "port": "2080"})
+}
+
+func TestFile_NoPath(t *testing.T) {
+	fs := newFlagSet()
+	f := NewFile(fs, func(string) (map[string]string, error) {
+		t.Error("read called without a file")
+		return nil, nil
+	})
+	fs.Parse(nil)
+	if err := f.Load(); err != nil {
+		t.Error(err)
+	}
+	if err := f.Reload(); err != nil {
+		t.Error(err)
+	}
+}
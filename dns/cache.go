@@ -0,0 +1,93 @@
+package dns
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Cache keeps responses for as long as the lowest TTL of their records.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[question]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	key     question
+	msg     []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// NewCache returns a Cache holding up to size responses.
+func NewCache(size int) *Cache {
+	return &Cache{
+		size:    size,
+		entries: make(map[question]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns a copy of the cached response to q with the given ID and its
+// TTLs decreased by the time spent in the cache.
+func (c *Cache) get(q question, id uint16) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[q]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*cacheEntry)
+	now := time.Now()
+	if now.After(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, q)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+
+	msg := append([]byte(nil), entry.msg...)
+	binary.BigEndian.PutUint16(msg, id)
+	ageTTLs(msg, uint32(now.Sub(entry.stored)/time.Second))
+	return msg
+}
+
+// put caches msg, the response to q, if it is cacheable.
+func (c *Cache) put(q question, msg []byte) {
+	if code := rcode(msg); code != rcodeSuccess && code != rcodeNXDomain {
+		return
+	}
+	if msg[2]&(flagTC>>8) != 0 {
+		return
+	}
+	ttl, ok := minTTL(msg)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		key:     q,
+		msg:     append([]byte(nil), msg...),
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[q]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[q] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,80 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// FakeIP hands out addresses from a private IPv4 network in place of the
+// real addresses of domain names, so that connections to a name can be
+// recognized by their destination address, as in transparent proxying,
+// and the name resolved on the far side of the tunnel. When the network is
+// exhausted the oldest mappings are reused.
+type FakeIP struct {
+	mu      sync.Mutex
+	network *net.IPNet
+	base    uint32
+	size    uint32
+	next    uint32
+	byName  map[string]uint32
+	byIP    map[uint32]string
+}
+
+// NewFakeIP returns a FakeIP handing out the addresses of the IPv4 network
+// cidr.
+func NewFakeIP(cidr string) (*FakeIP, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip := network.IP.To4()
+	ones, bits := network.Mask.Size()
+	if ip == nil || bits != 32 || ones > 30 {
+		return nil, fmt.Errorf("dns: fake IP network %s must be IPv4 with at least 4 addresses", cidr)
+	}
+
+	return &FakeIP{
+		network: network,
+		base:    binary.BigEndian.Uint32(ip),
+		// The network and broadcast addresses are not used
+		size:   uint32(1)<<uint(32-ones) - 2,
+		byName: make(map[string]uint32),
+		byIP:   make(map[uint32]string),
+	}, nil
+}
+
+// Assign returns the address mapped to name, mapping a new one if needed.
+func (f *FakeIP) Assign(name string) net.IP {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	offset, ok := f.byName[name]
+	if !ok {
+		offset = f.next + 1
+		f.next = (f.next + 1) % f.size
+		if old, ok := f.byIP[offset]; ok {
+			delete(f.byName, old)
+		}
+		f.byName[name] = offset
+		f.byIP[offset] = name
+	}
+
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, f.base+offset)
+	return ip
+}
+
+// Lookup returns the name ip is mapped to.
+func (f *FakeIP) Lookup(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || !f.network.Contains(ip4) {
+		return "", false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name, ok := f.byIP[binary.BigEndian.Uint32(ip4)-f.base]
+	return name, ok
+}
@@ -0,0 +1,218 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	TypeA    = 1
+	TypeAAAA = 28
+	typeOPT  = 41
+	classIN  = 1
+
+	headerLen = 12
+
+	rcodeSuccess  = 0
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+
+	// maxUDPSize is the largest response sent over UDP to clients that do
+	// not announce a larger size with EDNS.
+	maxUDPSize = 512
+)
+
+// Header flag bits
+const (
+	flagQR = 1 << 15
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+	flagRA = 1 << 7
+)
+
+var errMalformed = errors.New("dns: malformed message")
+
+// question is the first question of a message.
+type question struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+// parseQuestion returns the first question of msg and the offset of the
+// section following it.
+func parseQuestion(msg []byte) (question, int, error) {
+	if len(msg) < headerLen || binary.BigEndian.Uint16(msg[4:]) == 0 {
+		return question{}, 0, errMalformed
+	}
+
+	name, off, err := readName(msg, headerLen)
+	if err != nil {
+		return question{}, 0, err
+	}
+	if off+4 > len(msg) {
+		return question{}, 0, errMalformed
+	}
+	q := question{
+		name:   name,
+		qtype:  binary.BigEndian.Uint16(msg[off:]),
+		qclass: binary.BigEndian.Uint16(msg[off+2:]),
+	}
+	return q, off + 4, nil
+}
+
+// readName reads the domain name at off, following compression pointers,
+// and returns it in lower case without the trailing dot together with the
+// offset following it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errMalformed
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), next, nil
+		case l&0xC0 == 0xC0:
+			if off+2 > len(msg) || jumps > 16 {
+				return "", 0, errMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		case l&0xC0 != 0:
+			return "", 0, errMalformed
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// walkRecords calls fn with the type, class and the offset of the TTL of
+// every resource record following the questions of msg.
+func walkRecords(msg []byte, fn func(rtype, rclass uint16, ttlOff int)) error {
+	if len(msg) < headerLen {
+		return errMalformed
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := headerLen
+	for i := 0; i < qdcount; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return err
+		}
+		off = next + 4
+	}
+	for i := 0; i < rrcount; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return errMalformed
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		rclass := binary.BigEndian.Uint16(msg[off+2:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		if off+10+rdlen > len(msg) {
+			return errMalformed
+		}
+		fn(rtype, rclass, off+4)
+		off += 10 + rdlen
+	}
+	return nil
+}
+
+// minTTL returns the lowest TTL of the records of msg. ok is false if msg
+// holds no records.
+func minTTL(msg []byte) (ttl uint32, ok bool) {
+	err := walkRecords(msg, func(rtype, rclass uint16, ttlOff int) {
+		if rtype == typeOPT {
+			return
+		}
+		if t := binary.BigEndian.Uint32(msg[ttlOff:]); !ok || t < ttl {
+			ttl, ok = t, true
+		}
+	})
+	return ttl, ok && err == nil
+}
+
+// ageTTLs decreases the TTLs of the records of msg by elapsed seconds.
+func ageTTLs(msg []byte, elapsed uint32) {
+	walkRecords(msg, func(rtype, rclass uint16, ttlOff int) {
+		if rtype == typeOPT {
+			return
+		}
+		t := binary.BigEndian.Uint32(msg[ttlOff:])
+		if t > elapsed {
+			t -= elapsed
+		} else {
+			t = 0
+		}
+		binary.BigEndian.PutUint32(msg[ttlOff:], t)
+	})
+}
+
+// udpSize returns the largest response the client of query accepts over
+// UDP.
+func udpSize(query []byte) int {
+	size := maxUDPSize
+	walkRecords(query, func(rtype, rclass uint16, ttlOff int) {
+		if rtype == typeOPT && int(rclass) > size {
+			size = int(rclass)
+		}
+	})
+	return size
+}
+
+func rcode(msg []byte) int {
+	return int(msg[3] & 0x0F)
+}
+
+// reply returns a response to query holding its question and no records.
+// qend is the offset following the question.
+func reply(query []byte, qend int, code int, flags uint16) []byte {
+	msg := make([]byte, qend)
+	copy(msg, query[:qend])
+	binary.BigEndian.PutUint16(msg[2:], flagQR|flagRA|flags|
+		binary.BigEndian.Uint16(query[2:])&flagRD|uint16(code))
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[6:], 0)
+	binary.BigEndian.PutUint16(msg[8:], 0)
+	binary.BigEndian.PutUint16(msg[10:], 0)
+	return msg
+}
+
+// answerA returns a response to query answering its question with ip.
+func answerA(query []byte, qend int, ip net.IP, ttl uint32) []byte {
+	msg := reply(query, qend, rcodeSuccess, 0)
+	binary.BigEndian.PutUint16(msg[6:], 1)
+
+	rr := make([]byte, 16)
+	// Pointer to the name of the question
+	binary.BigEndian.PutUint16(rr[0:], 0xC000|headerLen)
+	binary.BigEndian.PutUint16(rr[2:], TypeA)
+	binary.BigEndian.PutUint16(rr[4:], classIN)
+	binary.BigEndian.PutUint32(rr[6:], ttl)
+	binary.BigEndian.PutUint16(rr[10:], 4)
+	copy(rr[12:], ip.To4())
+	return append(msg, rr...)
+}
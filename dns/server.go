@@ -0,0 +1,240 @@
+// Package dns implements a DNS forwarder for clients of the tunnel. Queries
+// received over UDP or TCP are sent as DNS-over-TCP to an upstream server,
+// which is reached through whatever Dial is given, normally a stream of the
+// tunnel, so that names resolve as seen from the far side of it. Responses
+// are cached, upstreams can be chosen per domain and A queries can be
+// answered with fake addresses mapped back to names on connect.
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// fakeTTL is the TTL of fake answers. Fake addresses stay mapped until the
+// network is exhausted, so it only bounds how long clients keep a mapping
+// that was reused meanwhile.
+const fakeTTL = 1
+
+// DefaultTimeout bounds an exchange with an upstream if Server.Timeout is
+// zero.
+const DefaultTimeout = 5 * time.Second
+
+// Server answers DNS queries by forwarding them to upstream servers.
+type Server struct {
+	// Upstream is the host:port of the server queries are forwarded to.
+	Upstream string
+	// Domains maps domain names to the upstream used for them and their
+	// subdomains instead of Upstream. The longest matching name wins.
+	Domains map[string]string
+	// Dial opens a TCP connection to an upstream.
+	Dial func(ctx context.Context, addr string) (net.Conn, error)
+	// Cache keeps responses if not nil.
+	Cache *Cache
+	// FakeIP answers A queries with fake addresses if not nil. AAAA
+	// queries are then answered with no records.
+	FakeIP *FakeIP
+	// Timeout bounds an exchange with an upstream.
+	Timeout time.Duration
+}
+
+// ListenAndServe serves queries on the UDP and TCP address addr.
+func (s *Server) ListenAndServe(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	errc := make(chan error, 2)
+	go func() { errc <- s.ServeUDP(pc) }()
+	go func() { errc <- s.ServeTCP(l) }()
+	return <-errc
+}
+
+// ServeUDP serves queries received on conn until reading from it fails.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	for {
+		buf := make([]byte, 65535)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		go func(query []byte) {
+			msg, err := s.Resolve(context.Background(), query)
+			if err != nil {
+				log.Printf("dns: query from %v: %v", addr, err)
+			}
+			if msg == nil {
+				return
+			}
+			if len(msg) > udpSize(query) {
+				msg = truncate(msg)
+			}
+			conn.WriteTo(msg, addr)
+		}(buf[:n])
+	}
+}
+
+// ServeTCP serves queries on connections accepted from l until accepting
+// fails.
+func (s *Server) ServeTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+		query, err := readMsg(conn)
+		if err != nil {
+			return
+		}
+		msg, err := s.Resolve(context.Background(), query)
+		if err != nil {
+			log.Printf("dns: query from %v: %v", conn.RemoteAddr(), err)
+		}
+		if msg == nil {
+			return
+		}
+		if err := writeMsg(conn, msg); err != nil {
+			return
+		}
+	}
+}
+
+// Resolve returns the response to query. If the query fails the returned
+// response is SERVFAIL and the error tells why. It is nil only if query is
+// too malformed to be answered.
+func (s *Server) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	q, qend, err := parseQuestion(query)
+	if err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(query)
+
+	if s.FakeIP != nil && q.qclass == classIN {
+		switch q.qtype {
+		case TypeA:
+			return answerA(query, qend, s.FakeIP.Assign(q.name), fakeTTL), nil
+		case TypeAAAA:
+			return reply(query, qend, rcodeSuccess, 0), nil
+		}
+	}
+
+	if s.Cache != nil {
+		if msg := s.Cache.get(q, id); msg != nil {
+			return msg, nil
+		}
+	}
+
+	msg, err := s.exchange(ctx, s.upstream(q.name), query)
+	if err != nil {
+		return reply(query, qend, rcodeServFail, 0), err
+	}
+	if s.Cache != nil {
+		s.Cache.put(q, msg)
+	}
+	return msg, nil
+}
+
+// upstream returns the upstream for name.
+func (s *Server) upstream(name string) string {
+	upstream, match := s.Upstream, ""
+	for domain, addr := range s.Domains {
+		if len(domain) > len(match) && (name == domain || strings.HasSuffix(name, "."+domain)) {
+			upstream, match = addr, domain
+		}
+	}
+	return upstream
+}
+
+var errIDMismatch = errors.New("dns: response ID does not match query")
+
+// exchange sends query to upstream over TCP and returns the response.
+func (s *Server) exchange(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := s.Dial(ctx, upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := writeMsg(conn, query); err != nil {
+		return nil, err
+	}
+	msg, err := readMsg(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) < headerLen || binary.BigEndian.Uint16(msg) != binary.BigEndian.Uint16(query) {
+		return nil, errIDMismatch
+	}
+	return msg, nil
+}
+
+// truncate returns msg without records and the TC bit set, telling the
+// client to retry over TCP.
+func truncate(msg []byte) []byte {
+	_, qend, err := parseQuestion(msg)
+	if err != nil {
+		qend = headerLen
+		binary.BigEndian.PutUint16(msg[4:], 0)
+	}
+	msg = msg[:qend]
+	msg[2] |= flagTC >> 8
+	binary.BigEndian.PutUint16(msg[6:], 0)
+	binary.BigEndian.PutUint16(msg[8:], 0)
+	binary.BigEndian.PutUint16(msg[10:], 0)
+	return msg
+}
+
+// readMsg reads a message prefixed with its length as sent over TCP.
+func readMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeMsg writes msg prefixed with its length as sent over TCP.
+func writeMsg(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,242 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubServer is an in-process DNS-over-TCP server answering every A query
+// with ip, or with many copies of it for names starting with "big.".
+type stubServer struct {
+	ip      net.IP
+	queries int32
+	l       net.Listener
+}
+
+func newStubServer(t *testing.T, ip string) *stubServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubServer{ip: net.ParseIP(ip), l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *stubServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		query, err := readMsg(conn)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.queries, 1)
+
+		q, qend, err := parseQuestion(query)
+		if err != nil {
+			return
+		}
+		msg := answerA(query, qend, s.ip, 60)
+		if strings.HasPrefix(q.name, "big.") {
+			rr := msg[qend:]
+			for i := 1; i < 40; i++ {
+				msg = append(msg, rr...)
+			}
+			binary.BigEndian.PutUint16(msg[6:], 40)
+		}
+		writeMsg(conn, msg)
+	}
+}
+
+func (s *stubServer) addr() string { return s.l.Addr().String() }
+
+func (s *stubServer) close() { s.l.Close() }
+
+func newQuery(id uint16, name string, qtype uint16) []byte {
+	msg := make([]byte, headerLen)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[2:], flagRD)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, classIN)
+	return msg
+}
+
+// answers returns the addresses of the A records of msg.
+func answers(t *testing.T, msg []byte) []string {
+	var ips []string
+	err := walkRecords(msg, func(rtype, rclass uint16, ttlOff int) {
+		if rtype == TypeA {
+			ips = append(ips, net.IP(msg[ttlOff+6:ttlOff+10]).String())
+		}
+	})
+	if err != nil {
+		t.Fatalf("malformed response: %v", err)
+	}
+	return ips
+}
+
+func dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func TestServer_Resolve(t *testing.T) {
+	upstream := newStubServer(t, "192.0.2.1")
+	defer upstream.close()
+	corp := newStubServer(t, "10.0.0.1")
+	defer corp.close()
+
+	s := &Server{
+		Upstream: upstream.addr(),
+		Domains:  map[string]string{"corp.example": corp.addr()},
+		Dial:     dialTCP,
+		Cache:    NewCache(16),
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		ips      []string
+		upstream *stubServer
+		queries  int32
+	}{
+		{name: "forward", query: "www.example.com", ips: []string{"192.0.2.1"}, upstream: upstream, queries: 1},
+		{name: "cached", query: "WWW.example.com", ips: []string{"192.0.2.1"}, upstream: upstream, queries: 1},
+		{name: "domain override", query: "git.corp.example", ips: []string{"10.0.0.1"}, upstream: corp, queries: 1},
+		{name: "domain itself", query: "corp.example", ips: []string{"10.0.0.1"}, upstream: corp, queries: 2},
+		{name: "suffix boundary", query: "notcorp.example", ips: []string{"192.0.2.1"}, upstream: upstream, queries: 2},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := uint16(100 + i)
+			msg, err := s.Resolve(context.Background(), newQuery(id, tt.query, TypeA))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := binary.BigEndian.Uint16(msg); got != id {
+				t.Errorf("ID = %d, want %d", got, id)
+			}
+			if got := answers(t, msg); strings.Join(got, ",") != strings.Join(tt.ips, ",") {
+				t.Errorf("answers = %v, want %v", got, tt.ips)
+			}
+			if got := atomic.LoadInt32(&tt.upstream.queries); got != tt.queries {
+				t.Errorf("upstream queries = %d, want %d", got, tt.queries)
+			}
+		})
+	}
+}
+
+func TestServer_UpstreamFailure(t *testing.T) {
+	upstream := newStubServer(t, "192.0.2.1")
+	upstream.close()
+
+	s := &Server{Upstream: upstream.addr(), Dial: dialTCP, Timeout: time.Second}
+	msg, err := s.Resolve(context.Background(), newQuery(1, "www.example.com", TypeA))
+	if err == nil {
+		t.Error("expected an error")
+	}
+	if msg == nil || rcode(msg) != rcodeServFail {
+		t.Errorf("response = %v, want SERVFAIL", msg)
+	}
+}
+
+func TestServer_FakeIP(t *testing.T) {
+	fake, err := NewFakeIP("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{FakeIP: fake}
+
+	resolve := func(name string, qtype uint16) []string {
+		msg, err := s.Resolve(context.Background(), newQuery(1, name, qtype))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return answers(t, msg)
+	}
+
+	a := resolve("a.example", TypeA)
+	if len(a) != 1 || a[0] != "198.18.0.1" {
+		t.Fatalf("a.example = %v, want [198.18.0.1]", a)
+	}
+	if got := resolve("a.example", TypeA); got[0] != a[0] {
+		t.Errorf("a.example remapped to %v", got)
+	}
+	if got := resolve("a.example", TypeAAAA); len(got) != 0 {
+		t.Errorf("AAAA answers = %v, want none", got)
+	}
+	if name, ok := fake.Lookup(net.ParseIP(a[0])); !ok || name != "a.example" {
+		t.Errorf("Lookup(%s) = %q, %v", a[0], name, ok)
+	}
+
+	// The network holds two addresses, a third name reuses the first one
+	resolve("b.example", TypeA)
+	if got := resolve("c.example", TypeA); got[0] != a[0] {
+		t.Errorf("c.example = %v, want %s", got, a[0])
+	}
+	if name, _ := fake.Lookup(net.ParseIP(a[0])); name != "c.example" {
+		t.Errorf("Lookup(%s) = %q, want c.example", a[0], name)
+	}
+	if _, ok := fake.Lookup(net.ParseIP("192.0.2.1")); ok {
+		t.Error("Lookup of an address outside the network succeeded")
+	}
+}
+
+func TestServer_UDP(t *testing.T) {
+	upstream := newStubServer(t, "192.0.2.1")
+	defer upstream.close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s := &Server{Upstream: upstream.addr(), Dial: dialTCP}
+	go s.ServeUDP(pc)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	exchange := func(name string) []byte {
+		if _, err := conn.Write(newQuery(7, name, TypeA)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+
+	if got := answers(t, exchange("www.example.com")); len(got) != 1 || got[0] != "192.0.2.1" {
+		t.Errorf("answers = %v, want [192.0.2.1]", got)
+	}
+
+	msg := exchange("big.example.com")
+	if len(msg) > maxUDPSize || msg[2]&(flagTC>>8) == 0 {
+		t.Errorf("large response of %d bytes not truncated", len(msg))
+	}
+}
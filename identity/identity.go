@@ -0,0 +1,211 @@
+// Package identity names the clients of a server by their verified
+// certificates and assigns them to policy groups.
+//
+// The names of a certificate are its subject common name, organizations
+// and organizational units and its subject alternative names, each with a
+// prefix telling its kind:
+//
+//	cn:alice
+//	o:Example Inc
+//	ou:Engineering
+//	dns:laptop.example.com
+//	email:alice@example.com
+//	uri:spiffe://example.com/laptop/1
+//	ip:192.0.2.1
+//
+// A mapping file holds one mapping per line in the form PATTERN GROUP,...
+// where PATTERN is a name, in which '*' matches any run of characters
+// except '/'. A PATTERN without a known prefix is a common name. A client
+// is in the groups of every pattern matching one of its names. Empty lines
+// and lines starting with '#' are ignored, for example
+//
+//	# laptops of the engineering team
+//	ou:Engineering                  staff,engineering
+//	uri:spiffe://example.com/ci/*   ci
+//	alice                           admins
+package identity
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// Identity is who a client is.
+type Identity struct {
+	// Name identifies the client in logs, stats, limits and ACLs. It is
+	// the subject common name of its certificate or, without one, its
+	// first subject alternative name, with its prefix, so that a common
+	// name cannot pass for an alternative name or the other way round.
+	Name string
+	// Names are all names of the certificate, see the package comment.
+	Names []string
+	// Groups are the groups the names are mapped to.
+	Groups []string
+}
+
+// prefixes are the kinds of names.
+var prefixes = []string{"cn:", "o:", "ou:", "dns:", "email:", "uri:", "ip:"}
+
+// FromCertificate returns the identity of the client presenting cert,
+// without groups.
+func FromCertificate(cert *x509.Certificate) Identity {
+	var id Identity
+	add := func(prefix, name string) {
+		if name != "" {
+			id.Names = append(id.Names, prefix+name)
+		}
+	}
+
+	add("cn:", cert.Subject.CommonName)
+	for _, name := range cert.DNSNames {
+		add("dns:", name)
+	}
+	for _, name := range cert.EmailAddresses {
+		add("email:", name)
+	}
+	for _, uri := range cert.URIs {
+		add("uri:", uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		add("ip:", ip.String())
+	}
+	if len(id.Names) > 0 {
+		id.Name = id.Names[0]
+	}
+
+	// Organizations describe a client but do not name it
+	for _, o := range cert.Subject.Organization {
+		add("o:", o)
+	}
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		add("ou:", ou)
+	}
+	return id
+}
+
+// Lookup returns the first name of id of the kind prefix, such as "cn:",
+// without the prefix.
+func (id Identity) Lookup(prefix string) string {
+	for _, name := range id.Names {
+		if strings.HasPrefix(name, prefix) {
+			return name[len(prefix):]
+		}
+	}
+	return ""
+}
+
+type mapping struct {
+	pattern string
+	groups  []string
+}
+
+// Map assigns identities to groups by the most recently loaded mapping
+// file. It is safe for concurrent use.
+type Map struct {
+	mappings atomic.Value // []mapping
+}
+
+// NewMap returns a Map without mappings, which assigns no groups.
+func NewMap() *Map {
+	m := &Map{}
+	m.Reset()
+	return m
+}
+
+// Reset removes the mappings of m.
+func (m *Map) Reset() {
+	m.mappings.Store([]mapping(nil))
+}
+
+// Load replaces the mappings of m by those of the file at path. m is left
+// unchanged if the file cannot be read or holds an invalid mapping.
+func (m *Map) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var mappings []mapping
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		mp, err := parseMapping(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		mappings = append(mappings, mp)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	m.mappings.Store(mappings)
+	return nil
+}
+
+func parseMapping(line string) (mapping, error) {
+	i := strings.LastIndexAny(line, " \t")
+	if i < 0 {
+		return mapping{}, fmt.Errorf("expected PATTERN GROUP,...")
+	}
+	mp := mapping{pattern: Qualify(strings.TrimSpace(line[:i]))}
+	if _, err := path.Match(mp.pattern, ""); err != nil {
+		return mapping{}, fmt.Errorf("invalid pattern %q", mp.pattern)
+	}
+	for _, g := range strings.Split(line[i+1:], ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			mp.groups = append(mp.groups, g)
+		}
+	}
+	if len(mp.groups) == 0 {
+		return mapping{}, fmt.Errorf("no groups for %q", mp.pattern)
+	}
+	return mp, nil
+}
+
+// Qualify returns name with the prefix of a common name if it has no known
+// prefix, such as a name given by a user.
+func Qualify(name string) string {
+	for _, p := range prefixes {
+		if strings.HasPrefix(name, p) {
+			return name
+		}
+	}
+	return "cn:" + name
+}
+
+// Groups returns the groups of id, in the order of the mapping file and
+// without duplicates.
+func (m *Map) Groups(id Identity) []string {
+	var groups []string
+	seen := make(map[string]bool)
+	for _, mp := range m.mappings.Load().([]mapping) {
+		if !mp.matches(id.Names) {
+			continue
+		}
+		for _, g := range mp.groups {
+			if !seen[g] {
+				seen[g] = true
+				groups = append(groups, g)
+			}
+		}
+	}
+	return groups
+}
+
+func (mp mapping) matches(names []string) bool {
+	for _, name := range names {
+		if ok, _ := path.Match(mp.pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package identity
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFromCertificate(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/laptop/1")
+	tests := []struct {
+		name      string
+		cert      *x509.Certificate
+		wantName  string
+		wantNames []string
+	}{
+		{
+			name: "common name and alternative names",
+			cert: &x509.Certificate{
+				Subject:        pkix.Name{CommonName: "alice", Organization: []string{"Example Inc"}, OrganizationalUnit: []string{"Engineering"}},
+				DNSNames:       []string{"laptop.example.com"},
+				EmailAddresses: []string{"alice@example.com"},
+				URIs:           []*url.URL{spiffe},
+				IPAddresses:    []net.IP{net.ParseIP("192.0.2.1")},
+			},
+			wantName: "cn:alice",
+			wantNames: []string{"cn:alice", "dns:laptop.example.com", "email:alice@example.com",
+				"uri:spiffe://example.com/laptop/1", "ip:192.0.2.1", "o:Example Inc", "ou:Engineering"},
+		},
+		{
+			name:      "first alternative name without common name",
+			cert:      &x509.Certificate{DNSNames: []string{"alice", "b.example.com"}},
+			wantName:  "dns:alice",
+			wantNames: []string{"dns:alice", "dns:b.example.com"},
+		},
+		{
+			name:      "organization does not name",
+			cert:      &x509.Certificate{Subject: pkix.Name{Organization: []string{"Example Inc"}}},
+			wantName:  "",
+			wantNames: []string{"o:Example Inc"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := FromCertificate(tt.cert)
+			if id.Name != tt.wantName {
+				t.Errorf("Name = %q, want %q", id.Name, tt.wantName)
+			}
+			if !reflect.DeepEqual(id.Names, tt.wantNames) {
+				t.Errorf("Names = %q, want %q", id.Names, tt.wantNames)
+			}
+		})
+	}
+
+	// A common name and an alternative name of the same text are different
+	// clients
+	cn := FromCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+	dns := FromCertificate(&x509.Certificate{DNSNames: []string{"alice"}})
+	if cn.Name == dns.Name {
+		t.Errorf("common name and DNS name alice share the name %q", cn.Name)
+	}
+	if got := cn.Lookup("cn:"); got != "alice" {
+		t.Errorf("Lookup(cn:) = %q, want alice", got)
+	}
+}
+
+func TestMap_Groups(t *testing.T) {
+	m := loadMap(t, `
+# comment
+ou:Engineering                  staff,engineering
+uri:spiffe://example.com/ci/*   ci
+alice                           admins,staff
+dns:*.example.com               laptops
+email:*@example.com             staff
+`)
+
+	tests := []struct {
+		name  string
+		names []string
+		want  []string
+	}{
+		{name: "common name without prefix", names: []string{"cn:alice"}, want: []string{"admins", "staff"}},
+		{name: "alternative name is not common name", names: []string{"dns:alice"}},
+		{name: "order of the file without duplicates", names: []string{"cn:alice", "ou:Engineering"},
+			want: []string{"staff", "engineering", "admins"}},
+		{name: "star within a path segment", names: []string{"uri:spiffe://example.com/ci/runner"}, want: []string{"ci"}},
+		{name: "star does not cross slashes", names: []string{"uri:spiffe://example.com/ci/a/b"}},
+		{name: "subdomain", names: []string{"dns:laptop.example.com"}, want: []string{"laptops"}},
+		{name: "not the bare domain", names: []string{"dns:example.com"}},
+		{name: "email", names: []string{"email:bob@example.com"}, want: []string{"staff"}},
+		{name: "no names", names: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := m.Groups(Identity{Names: tt.names})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Groups(%q) = %q, want %q", tt.names, got, tt.want)
+			}
+		})
+	}
+
+	m.Reset()
+	if got := m.Groups(Identity{Names: []string{"cn:alice"}}); got != nil {
+		t.Errorf("Groups after Reset = %q", got)
+	}
+}
+
+func TestMap_LoadInvalid(t *testing.T) {
+	for _, content := range []string{"alice", "alice ,", "[ admins"} {
+		m := loadMap(t, "cn:bob admins")
+		path := writeFile(t, content)
+		err := m.Load(path)
+		os.Remove(path)
+		if err == nil {
+			t.Errorf("Load(%q) succeeded", content)
+		}
+		// A failed load keeps the previous mappings
+		if got := m.Groups(Identity{Names: []string{"cn:bob"}}); len(got) != 1 {
+			t.Errorf("Groups after failed Load(%q) = %q", content, got)
+		}
+	}
+}
+
+func loadMap(t *testing.T, content string) *Map {
+	path := writeFile(t, content)
+	defer os.Remove(path)
+
+	m := NewMap()
+	if err := m.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// writeFile writes content to a new temporary file and returns its path.
+func writeFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "identities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(strings.TrimSpace(content) + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
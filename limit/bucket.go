@@ -0,0 +1,131 @@
+package limit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket of bytes. It holds at most one second worth of
+// its rate, a nil Bucket and one with a rate of 0 do not limit.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full Bucket refilled with rate bytes per second, nil
+// if rate is not positive.
+func NewBucket(rate int64) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return newBucket(float64(rate), float64(rate))
+}
+
+func newBucket(rate, burst float64) *Bucket {
+	return &Bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// set changes the rate and size of b. The tokens b holds are kept up to the
+// new size, a bucket that did not limit starts full.
+func (b *Bucket) set(rate, burst float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rate == b.rate && burst == b.burst {
+		return
+	}
+
+	b.refill(time.Now())
+	if b.rate <= 0 {
+		b.tokens = burst
+	}
+	b.rate, b.burst = rate, burst
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// setRate changes the rate of b to rate bytes per second, holding one
+// second worth.
+func (b *Bucket) setRate(rate Size) {
+	b.set(float64(rate), float64(rate))
+}
+
+// refill adds the tokens accumulated since the last call. b.mu must be
+// held.
+func (b *Bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Wait takes n bytes from b. When b runs short the missing bytes are
+// borrowed and Wait sleeps until they are refilled, so that n may exceed
+// the size of the bucket and concurrent callers queue up.
+func (b *Bucket) Wait(ctx context.Context, n int) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// take removes one token from b if it holds one, else it returns how long
+// until it does.
+func (b *Bucket) take() time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full reports whether b has refilled completely.
+func (b *Bucket) full() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	return b.tokens >= b.burst
+}
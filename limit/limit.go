@@ -0,0 +1,226 @@
+// Package limit throttles the traffic of the streams of a server, caps
+// their number and counts their traffic against per user quotas.
+//
+// Rates are enforced by token buckets, one per stream and one shared by
+// all streams of a user, in each direction. A stream waits for the slower
+// of its two buckets. Quotas limit the bytes a user transfers per day and
+// per month, counting both directions, and are checked when a stream
+// starts, so a stream running when a quota is used up is not interrupted.
+// The number of concurrent streams and the rate at which a user opens
+// new ones are checked at the same time.
+//
+// All limits may be changed while streams are open, the buckets of open
+// streams take up new rates with their next bytes.
+package limit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamRetryAfter is the retry hint for a stream refused because too many
+// are open, which is not known to change at any particular time.
+const streamRetryAfter = time.Second
+
+// Rates are the rate limits in bytes per second, 0 for none. Up is the
+// direction from the client to the target.
+type Rates struct {
+	UserUp     Size
+	UserDown   Size
+	StreamUp   Size
+	StreamDown Size
+}
+
+// Streams limits the number of streams, 0 for no limit.
+type Streams struct {
+	// Max is the number of concurrent streams of all users.
+	Max int
+	// PerUser is the number of concurrent streams of each user.
+	PerUser int
+	// Rate is the number of streams each user may open per second, in
+	// bursts of up to a second worth.
+	Rate float64
+}
+
+// LimitError is returned for a stream refused by a Streams limit.
+type LimitError struct {
+	User   string
+	Reason string
+	// RetryAfter is when a new stream may succeed.
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("stream of %q refused: %s", e.User, e.Reason)
+}
+
+// RetryAfter returns how long the client of a stream refused with err
+// should wait before trying again.
+func RetryAfter(err error) time.Duration {
+	switch e := err.(type) {
+	case *LimitError:
+		return e.RetryAfter
+	case *QuotaError:
+		return time.Until(e.Reset)
+	}
+	return 0
+}
+
+// Limiter applies rates, stream limits and a quota to the streams of users.
+type Limiter struct {
+	settings atomic.Value // settings
+	quota    *Quota
+
+	mu    sync.Mutex
+	open  int
+	users map[string]*user
+}
+
+type user struct {
+	up, down *Bucket
+	opens    *Bucket
+	streams  int
+}
+
+type settings struct {
+	rates   Rates
+	streams Streams
+}
+
+// NewLimiter returns a Limiter enforcing rates, streams and quota, which
+// may be nil.
+func NewLimiter(rates Rates, streams Streams, quota *Quota) *Limiter {
+	l := &Limiter{quota: quota, users: make(map[string]*user)}
+	l.Set(rates, streams)
+	return l
+}
+
+// Set replaces the rates and stream limits of l. Streams already open are
+// not closed by lower stream limits.
+func (l *Limiter) Set(rates Rates, streams Streams) {
+	l.settings.Store(settings{rates: rates, streams: streams})
+}
+
+func (l *Limiter) current() settings {
+	return l.settings.Load().(settings)
+}
+
+// Open starts a stream of the user identified by name. It returns a
+// *QuotaError if the user has no quota left and a *LimitError if the
+// stream exceeds a Streams limit. The stream must be closed. A nil
+// Limiter returns a nil Stream, which does not limit.
+func (l *Limiter) Open(name string) (*Stream, error) {
+	if l == nil {
+		return nil, nil
+	}
+	if err := l.quota.Check(name); err != nil {
+		return nil, err
+	}
+
+	set := l.current()
+	l.mu.Lock()
+	u, ok := l.users[name]
+	if !ok {
+		u = &user{
+			up:    newBucket(0, 0),
+			down:  newBucket(0, 0),
+			opens: newBucket(0, 0),
+		}
+		l.users[name] = u
+	}
+	if r := set.streams.Rate; r > 0 {
+		u.opens.set(r, math.Max(r, 1))
+	} else {
+		u.opens.set(0, 0)
+	}
+	if err := l.admit(name, u, set.streams); err != nil {
+		if u.streams == 0 && u.opens.full() {
+			delete(l.users, name)
+		}
+		l.mu.Unlock()
+		return nil, err
+	}
+	l.open++
+	u.streams++
+	l.mu.Unlock()
+
+	return &Stream{
+		limiter: l,
+		name:    name,
+		user:    u,
+		up:      newBucket(0, 0),
+		down:    newBucket(0, 0),
+	}, nil
+}
+
+// Stream limits the traffic of one stream.
+type Stream struct {
+	limiter  *Limiter
+	name     string
+	user     *user
+	up, down *Bucket
+}
+
+// Up accounts n bytes sent from the client, waiting as the rates require.
+func (s *Stream) Up(ctx context.Context, n int) error {
+	if s == nil {
+		return nil
+	}
+	s.limiter.quota.Add(s.name, n)
+	rates := s.limiter.current().rates
+	s.up.setRate(rates.StreamUp)
+	s.user.up.setRate(rates.UserUp)
+	if err := s.up.Wait(ctx, n); err != nil {
+		return err
+	}
+	return s.user.up.Wait(ctx, n)
+}
+
+// Down accounts n bytes sent to the client, waiting as the rates require.
+func (s *Stream) Down(ctx context.Context, n int) error {
+	if s == nil {
+		return nil
+	}
+	s.limiter.quota.Add(s.name, n)
+	rates := s.limiter.current().rates
+	s.down.setRate(rates.StreamDown)
+	s.user.down.setRate(rates.UserDown)
+	if err := s.down.Wait(ctx, n); err != nil {
+		return err
+	}
+	return s.user.down.Wait(ctx, n)
+}
+
+// Close ends the stream, the buckets of a user are released with the last
+// of their streams.
+func (s *Stream) Close() {
+	if s == nil {
+		return
+	}
+	l := s.limiter
+	l.mu.Lock()
+	l.open--
+	// A user is forgotten once nothing is left to remember
+	if s.user.streams--; s.user.streams == 0 && s.user.opens.full() {
+		delete(l.users, s.name)
+	}
+	l.mu.Unlock()
+}
+
+// admit checks the limits streams for a new stream of u. l.mu must be held.
+func (l *Limiter) admit(name string, u *user, streams Streams) error {
+	switch {
+	case streams.Max > 0 && l.open >= streams.Max:
+		return &LimitError{User: name, Reason: fmt.Sprintf("server limit of %d streams reached", streams.Max), RetryAfter: streamRetryAfter}
+	case streams.PerUser > 0 && u.streams >= streams.PerUser:
+		return &LimitError{User: name, Reason: fmt.Sprintf("limit of %d streams per client reached", streams.PerUser), RetryAfter: streamRetryAfter}
+	}
+	if wait := u.opens.take(); wait > 0 {
+		return &LimitError{User: name, Reason: fmt.Sprintf("limit of %g new streams per second reached", streams.Rate), RetryAfter: wait}
+	}
+	return nil
+}
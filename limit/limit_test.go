@@ -0,0 +1,388 @@
+package limit
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBucket_Wait(t *testing.T) {
+	ctx := context.Background()
+	b := NewBucket(10000)
+
+	// A full bucket lends the bytes it lacks and waits for them
+	start := time.Now()
+	if err := b.Wait(ctx, 12000); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond || d > 400*time.Millisecond {
+		t.Errorf("borrowing 2000 bytes at 10000/s took %v, want about 200ms", d)
+	}
+
+	// The next caller queues behind the borrowed bytes
+	start = time.Now()
+	if err := b.Wait(ctx, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > 300*time.Millisecond {
+		t.Errorf("waiting for 1000 bytes at 10000/s took %v, want about 100ms", d)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := b.Wait(canceled, 100000); err != context.Canceled {
+		t.Errorf("Wait on canceled context = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestBucket_Unlimited(t *testing.T) {
+	if b := NewBucket(0); b != nil {
+		t.Fatalf("NewBucket(0) = %v, want nil", b)
+	}
+	var nilBucket *Bucket
+	if err := nilBucket.Wait(context.Background(), 1<<30); err != nil {
+		t.Errorf("nil bucket Wait = %v", err)
+	}
+
+	b := newBucket(0, 0)
+	if err := b.Wait(context.Background(), 1<<30); err != nil {
+		t.Errorf("zero rate Wait = %v", err)
+	}
+	if wait := b.take(); wait != 0 {
+		t.Errorf("zero rate take = %v, want 0", wait)
+	}
+	if !b.full() {
+		t.Error("zero rate bucket not full")
+	}
+
+	// A bucket starting to limit starts full
+	b.setRate(1000)
+	if !b.full() {
+		t.Error("bucket not full after setting a rate")
+	}
+}
+
+func TestBucket_SetRate(t *testing.T) {
+	b := NewBucket(1000)
+	b.setRate(10)
+	b.mu.Lock()
+	tokens := b.tokens
+	b.mu.Unlock()
+	if tokens > 10 {
+		t.Errorf("tokens after lowering the rate to 10 = %g, want at most 10", tokens)
+	}
+
+	for i := 0; i < 10; i++ {
+		if wait := b.take(); wait != 0 {
+			t.Fatalf("take %d waits %v", i, wait)
+		}
+	}
+	if wait := b.take(); wait < 50*time.Millisecond || wait > 100*time.Millisecond {
+		t.Errorf("take of empty bucket at 10/s waits %v, want about 100ms", wait)
+	}
+}
+
+func TestUsage_Roll(t *testing.T) {
+	local := func(y int, m time.Month, d, h int) time.Time {
+		return time.Date(y, m, d, h, 0, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name       string
+		now        time.Time
+		day, month int64
+	}{
+		{name: "same day", now: local(2024, 1, 30, 23), day: 100, month: 300},
+		{name: "next day", now: local(2024, 1, 31, 0), day: 0, month: 300},
+		{name: "next month", now: local(2024, 2, 1, 0), day: 0, month: 0},
+		{name: "same day next year", now: local(2025, 1, 30, 12), day: 0, month: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &Usage{Day: "2024-01-30", DayBytes: 100, Month: "2024-01", MonthBytes: 300}
+			u.roll(tt.now)
+			if u.DayBytes != tt.day || u.MonthBytes != tt.month {
+				t.Errorf("roll(%v) = %d day, %d month bytes, want %d, %d", tt.now, u.DayBytes, u.MonthBytes, tt.day, tt.month)
+			}
+			if want := tt.now.Format("2006-01-02"); u.Day != want {
+				t.Errorf("roll(%v) day = %q, want %q", tt.now, u.Day, want)
+			}
+		})
+	}
+}
+
+func TestSize_Set(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Size
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"1500", 1500, true},
+		{"1K", 1 << 10, true},
+		{"1k", 1 << 10, true},
+		{"10MB", 10 << 20, true},
+		{"2GiB", 2 << 30, true},
+		{" 3 T ", 3 << 40, true},
+		{"8388607T", 8388607 << 40, true},
+		{"8388608T", 0, false},
+		{"9223372036854775807", math.MaxInt64, true},
+		{"9223372036854775808", 0, false},
+		{"-1", 0, false},
+		{"1.5K", 0, false},
+		{"1P", 0, false},
+		{"", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var s Size
+			err := s.Set(tt.value)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Set(%q) error = %v, want ok %v", tt.value, err, tt.ok)
+			}
+			if tt.ok && s != tt.want {
+				t.Errorf("Set(%q) = %d, want %d", tt.value, s, tt.want)
+			}
+		})
+	}
+}
+
+func TestSize_String(t *testing.T) {
+	for _, s := range []Size{0, 1000, 1 << 10, 3 << 20, 1536, 5 << 40} {
+		var parsed Size
+		if err := parsed.Set(s.String()); err != nil || parsed != s {
+			t.Errorf("Set(%q) = %d, %v, want %d", s.String(), parsed, err, s)
+		}
+	}
+}
+
+func TestLimiter_Streams(t *testing.T) {
+	l := NewLimiter(Rates{}, Streams{Max: 3, PerUser: 2}, nil)
+
+	a1, err := l.Open("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2, err := l.Open("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Open("alice"); err == nil {
+		t.Fatal("third stream of alice admitted with a limit of 2 per client")
+	} else if RetryAfter(err) != streamRetryAfter {
+		t.Errorf("RetryAfter = %v, want %v", RetryAfter(err), streamRetryAfter)
+	}
+
+	b1, err := l.Open("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Open("carol"); err == nil {
+		t.Fatal("fourth stream admitted with a limit of 3")
+	}
+
+	a1.Close()
+	a3, err := l.Open("alice")
+	if err != nil {
+		t.Fatalf("stream of alice refused after closing one: %v", err)
+	}
+
+	for _, s := range []*Stream{a2, a3, b1} {
+		s.Close()
+	}
+	if l.open != 0 || len(l.users) != 0 {
+		t.Errorf("after closing all streams %d open, %d users remembered", l.open, len(l.users))
+	}
+
+	// Lower limits apply to new streams
+	l.Set(Rates{}, Streams{PerUser: 1})
+	a4, err := l.Open("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a4.Close()
+	if _, err := l.Open("alice"); err == nil {
+		t.Error("second stream of alice admitted after lowering the limit to 1")
+	}
+}
+
+func TestLimiter_StreamRate(t *testing.T) {
+	l := NewLimiter(Rates{}, Streams{Rate: 20}, nil)
+
+	// A second worth of streams is admitted at once
+	for i := 0; i < 20; i++ {
+		s, err := l.Open("alice")
+		if err != nil {
+			t.Fatalf("stream %d: %v", i, err)
+		}
+		s.Close()
+	}
+	_, err := l.Open("alice")
+	if err == nil {
+		t.Fatal("stream beyond the burst admitted")
+	}
+	wait := RetryAfter(err)
+	if wait <= 0 || wait > 50*time.Millisecond {
+		t.Fatalf("RetryAfter = %v, want up to 50ms", wait)
+	}
+
+	// Other users have their own budget
+	s, err := l.Open("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	time.Sleep(wait)
+	s, err = l.Open("alice")
+	if err != nil {
+		t.Fatalf("stream refused after waiting %v: %v", wait, err)
+	}
+	s.Close()
+
+	// Users are remembered until their budget refills
+	if _, ok := l.users["alice"]; !ok {
+		t.Error("alice forgotten while the budget is used")
+	}
+}
+
+func TestLimiter_SetRates(t *testing.T) {
+	ctx := context.Background()
+	l := NewLimiter(Rates{}, Streams{}, nil)
+	s, err := l.Open("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	start := time.Now()
+	if err := s.Up(ctx, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("unlimited stream waited %v", d)
+	}
+
+	// The open stream takes up the new rate with its next bytes
+	l.Set(Rates{StreamUp: 10000}, Streams{})
+	start = time.Now()
+	if err := s.Up(ctx, 12000); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond || d > 400*time.Millisecond {
+		t.Errorf("12000 bytes at 10000/s took %v, want about 200ms", d)
+	}
+	if err := s.Down(ctx, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	q, err := NewQuota(1000, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLimiter(Rates{}, Streams{}, q)
+
+	s, err := l.Open("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Up(context.Background(), 600)
+	s.Down(context.Background(), 400)
+	s.Close()
+
+	_, err = l.Open("alice")
+	qe, ok := err.(*QuotaError)
+	if !ok {
+		t.Fatalf("Open after using the quota = %v, want a *QuotaError", err)
+	}
+	y, m, d := time.Now().Date()
+	if want := time.Date(y, m, d+1, 0, 0, 0, 0, time.Local); !qe.Reset.Equal(want) || qe.Period != "daily" {
+		t.Errorf("quota error %v resets at %v, want daily at %v", qe, qe.Reset, want)
+	}
+	if _, err := l.Open("bob"); err != nil {
+		t.Errorf("bob refused by the quota of alice: %v", err)
+	}
+
+	// Usage is kept when the limits change
+	q.SetLimits(0, 2000)
+	s, err = l.Open("alice")
+	if err != nil {
+		t.Fatalf("Open after raising the quota: %v", err)
+	}
+	s.Up(context.Background(), 1000)
+	s.Close()
+	if err := q.Check("alice"); err == nil {
+		t.Error("monthly quota of 2000 not exceeded after 2000 bytes")
+	}
+}
+
+func TestQuota_SaveMerges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "quota.json")
+
+	// An upgraded process shares the file with the one draining
+	old, err := NewQuota(0, 0, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Add("alice", 100)
+	if err := old.Save(); err != nil {
+		t.Fatal(err)
+	}
+	upgraded, err := NewQuota(0, 0, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Add("alice", 10)
+	upgraded.Add("alice", 20)
+	upgraded.Add("bob", 5)
+	if err := upgraded.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := NewQuota(0, 0, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for user, want := range map[string]int64{"alice": 130, "bob": 5} {
+		if u := q.get(user); u.DayBytes != want || u.MonthBytes != want {
+			t.Errorf("saved usage of %s = %d/%d, want %d", user, u.DayBytes, u.MonthBytes, want)
+		}
+	}
+	// Saving takes up the traffic other processes saved
+	if u := old.get("bob"); u.DayBytes != 5 {
+		t.Errorf("usage of bob after saving = %d, want 5", u.DayBytes)
+	}
+}
+
+func TestUsage_Add(t *testing.T) {
+	tests := []struct {
+		u, v, want Usage
+	}{
+		{Usage{"2026-10-19", 10, "2026-10", 30}, Usage{"2026-10-19", 5, "2026-10", 5}, Usage{"2026-10-19", 15, "2026-10", 35}},
+		{Usage{"2026-10-19", 10, "2026-10", 30}, Usage{"2026-10-20", 5, "2026-10", 5}, Usage{"2026-10-20", 5, "2026-10", 35}},
+		{Usage{"2026-11-01", 10, "2026-11", 10}, Usage{"2026-10-31", 5, "2026-10", 5}, Usage{"2026-11-01", 10, "2026-11", 10}},
+		{Usage{}, Usage{"2026-10-19", 5, "2026-10", 5}, Usage{"2026-10-19", 5, "2026-10", 5}},
+	}
+	for _, tt := range tests {
+		u := tt.u
+		u.add(&tt.v)
+		if u != tt.want {
+			t.Errorf("%v add %v = %v, want %v", tt.u, tt.v, u, tt.want)
+		}
+	}
+}
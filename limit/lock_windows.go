@@ -0,0 +1,7 @@
+package limit
+
+// lockFile does nothing as without upgrades a single process uses the
+// file.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
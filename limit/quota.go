@@ -0,0 +1,266 @@
+package limit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Usage is the traffic of one user in the current day and month.
+type Usage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+// roll starts new periods once the day or month of now differs from the
+// recorded one.
+func (u *Usage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthBytes = month, 0
+	}
+}
+
+// QuotaError is returned for a user who used up a quota.
+type QuotaError struct {
+	User   string
+	Period string
+	Limit  Size
+	// Reset is when the period ends.
+	Reset time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s quota of %s exceeded by %q", e.Period, e.Limit.String(), e.User)
+}
+
+// add counts the traffic of v in u. Periods of v older than those of u
+// are dropped, newer ones replace them.
+func (u *Usage) add(v *Usage) {
+	switch {
+	case u.Day == v.Day:
+		u.DayBytes += v.DayBytes
+	case u.Day < v.Day:
+		u.Day, u.DayBytes = v.Day, v.DayBytes
+	}
+	switch {
+	case u.Month == v.Month:
+		u.MonthBytes += v.MonthBytes
+	case u.Month < v.Month:
+		u.Month, u.MonthBytes = v.Month, v.MonthBytes
+	}
+}
+
+// Quota counts the traffic of each user against daily and monthly limits.
+// Periods follow the local time of the server.
+type Quota struct {
+	path string
+
+	// saveMu serializes saves.
+	saveMu sync.Mutex
+
+	mu sync.Mutex
+	// daily and monthly are the limits in bytes, 0 for none.
+	daily   Size
+	monthly Size
+	usage   map[string]*Usage
+	// unsaved is the traffic counted since the last save.
+	unsaved map[string]*Usage
+}
+
+// NewQuota returns a Quota persisted to the file at path, restoring the
+// usage recorded there if it exists. An empty path keeps usage in memory.
+// Several processes may share the file, as a server and the one it
+// upgrades to do, each save adds the traffic a process counted to it.
+func NewQuota(daily, monthly Size, path string) (*Quota, error) {
+	q := &Quota{daily: daily, monthly: monthly, path: path,
+		usage: make(map[string]*Usage), unsaved: make(map[string]*Usage)}
+	if path == "" {
+		return q, nil
+	}
+
+	usage, err := readUsage(path)
+	if err != nil {
+		return nil, err
+	}
+	q.usage = usage
+	return q, nil
+}
+
+// SetLimits replaces the daily and monthly limits of q, 0 for none. Usage
+// counted so far is kept.
+func (q *Quota) SetLimits(daily, monthly Size) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.daily, q.monthly = daily, monthly
+	q.mu.Unlock()
+}
+
+// Check returns a *QuotaError if user has no quota left.
+func (q *Quota) Check(user string) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.get(user)
+	y, m, d := time.Now().Date()
+	switch {
+	case q.daily > 0 && u.DayBytes >= int64(q.daily):
+		return &QuotaError{User: user, Period: "daily", Limit: q.daily,
+			Reset: time.Date(y, m, d+1, 0, 0, 0, 0, time.Local)}
+	case q.monthly > 0 && u.MonthBytes >= int64(q.monthly):
+		return &QuotaError{User: user, Period: "monthly", Limit: q.monthly,
+			Reset: time.Date(y, m+1, 1, 0, 0, 0, 0, time.Local)}
+	}
+	return nil
+}
+
+// Add counts n bytes of traffic of user.
+func (q *Quota) Add(user string, n int) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	u := q.get(user)
+	u.DayBytes += int64(n)
+	u.MonthBytes += int64(n)
+	if q.path != "" {
+		u = entry(q.unsaved, user)
+		u.DayBytes += int64(n)
+		u.MonthBytes += int64(n)
+	}
+	q.mu.Unlock()
+}
+
+func (q *Quota) get(user string) *Usage {
+	return entry(q.usage, user)
+}
+
+// entry returns the usage of user in m, in the current periods.
+func entry(m map[string]*Usage, user string) *Usage {
+	u, ok := m[user]
+	if !ok {
+		u = &Usage{}
+		m[user] = u
+	}
+	u.roll(time.Now())
+	return u
+}
+
+// Save adds the traffic counted since the last save to the file of q, if
+// there is any, and takes up what other processes added there. The file
+// is locked while it is read and replaced atomically.
+func (q *Quota) Save() error {
+	if q == nil || q.path == "" {
+		return nil
+	}
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+
+	q.mu.Lock()
+	unsaved := q.unsaved
+	q.unsaved = make(map[string]*Usage)
+	q.mu.Unlock()
+	if len(unsaved) == 0 {
+		return nil
+	}
+
+	usage, err := mergeFile(q.path, unsaved)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err != nil {
+		// Keep the traffic for the next save
+		for user, v := range unsaved {
+			if w, ok := q.unsaved[user]; ok {
+				v.add(w)
+			}
+			q.unsaved[user] = v
+		}
+		return err
+	}
+	for user, u := range usage {
+		// Traffic counted while saving is not in the file yet
+		if v, ok := q.unsaved[user]; ok {
+			u.add(v)
+		}
+		q.usage[user] = u
+	}
+	return nil
+}
+
+// mergeFile adds unsaved to the usage in the file at path and returns the
+// usage it wrote there.
+func mergeFile(path string, unsaved map[string]*Usage) (map[string]*Usage, error) {
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	usage, err := readUsage(path)
+	if err != nil {
+		return nil, err
+	}
+	for user, v := range unsaved {
+		u, ok := usage[user]
+		if !ok {
+			u = &Usage{}
+			usage[user] = u
+		}
+		u.add(v)
+	}
+	b, err := json.MarshalIndent(usage, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(path, b); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// readUsage returns the usage recorded in the file at path, none if it
+// does not exist.
+func readUsage(path string) (map[string]*Usage, error) {
+	usage := make(map[string]*Usage)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &usage); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return usage, nil
+}
+
+// writeFile replaces the file at path by one holding b.
+func writeFile(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,52 @@
+package limit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Size is a number of bytes. As a flag.Value it accepts a number with an
+// optional K, M, G or T suffix, in powers of 1024, and 0 meaning no limit.
+type Size int64
+
+var units = []struct {
+	suffix string
+	size   Size
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+func (s *Size) String() string {
+	for _, u := range units {
+		if *s != 0 && *s%u.size == 0 {
+			return fmt.Sprintf("%d%s", *s/u.size, u.suffix)
+		}
+	}
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *Size) Set(value string) error {
+	v := strings.ToUpper(strings.TrimSpace(value))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+	mult := Size(1)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v, mult = strings.TrimSuffix(v, u.suffix), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	if n > math.MaxInt64/int64(mult) {
+		return fmt.Errorf("size %q too large", value)
+	}
+	*s = Size(n) * mult
+	return nil
+}
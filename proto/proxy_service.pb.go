@@ -27,16 +27,21 @@ type Payload_LoadType int32
 const (
 	Payload_ACK  Payload_LoadType = 0
 	Payload_Load Payload_LoadType = 1
+	// Peer carries the address of the connection accepted for a bind
+	// stream, it is sent once before any Load.
+	Payload_Peer Payload_LoadType = 2
 )
 
 var Payload_LoadType_name = map[int32]string{
 	0: "ACK",
 	1: "Load",
+	2: "Peer",
 }
 
 var Payload_LoadType_value = map[string]int32{
 	"ACK":  0,
 	"Load": 1,
+	"Peer": 2,
 }
 
 func (x Payload_LoadType) String() string {
@@ -94,26 +99,114 @@ func (m *Payload) GetData() []byte {
 	return nil
 }
 
+type DialError_Reason int32
+
+const (
+	DialError_UNKNOWN             DialError_Reason = 0
+	DialError_REFUSED             DialError_Reason = 1
+	DialError_NETWORK_UNREACHABLE DialError_Reason = 2
+	DialError_HOST_UNREACHABLE    DialError_Reason = 3
+	// UNKNOWN_HOST is a destination name that does not resolve.
+	DialError_UNKNOWN_HOST DialError_Reason = 4
+	DialError_TIMEOUT      DialError_Reason = 5
+)
+
+var DialError_Reason_name = map[int32]string{
+	0: "UNKNOWN",
+	1: "REFUSED",
+	2: "NETWORK_UNREACHABLE",
+	3: "HOST_UNREACHABLE",
+	4: "UNKNOWN_HOST",
+	5: "TIMEOUT",
+}
+
+var DialError_Reason_value = map[string]int32{
+	"UNKNOWN":             0,
+	"REFUSED":             1,
+	"NETWORK_UNREACHABLE": 2,
+	"HOST_UNREACHABLE":    3,
+	"UNKNOWN_HOST":        4,
+	"TIMEOUT":             5,
+}
+
+func (x DialError_Reason) String() string {
+	return proto.EnumName(DialError_Reason_name, int32(x))
+}
+
+func (DialError_Reason) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_34ca2fbc94d169de, []int{1, 0}
+}
+
+// DialError is attached to the status of a stream whose destination the
+// server failed to connect to.
+type DialError struct {
+	Reason               DialError_Reason `protobuf:"varint,1,opt,name=reason,proto3,enum=proto.DialError_Reason" json:"reason,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
+	XXX_unrecognized     []byte           `json:"-"`
+	XXX_sizecache        int32            `json:"-"`
+}
+
+func (m *DialError) Reset()         { *m = DialError{} }
+func (m *DialError) String() string { return proto.CompactTextString(m) }
+func (*DialError) ProtoMessage()    {}
+func (*DialError) Descriptor() ([]byte, []int) {
+	return fileDescriptor_34ca2fbc94d169de, []int{1}
+}
+
+func (m *DialError) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DialError.Unmarshal(m, b)
+}
+func (m *DialError) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DialError.Marshal(b, m, deterministic)
+}
+func (m *DialError) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DialError.Merge(m, src)
+}
+func (m *DialError) XXX_Size() int {
+	return xxx_messageInfo_DialError.Size(m)
+}
+func (m *DialError) XXX_DiscardUnknown() {
+	xxx_messageInfo_DialError.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DialError proto.InternalMessageInfo
+
+func (m *DialError) GetReason() DialError_Reason {
+	if m != nil {
+		return m.Reason
+	}
+	return DialError_UNKNOWN
+}
+
 func init() {
+	proto.RegisterEnum("proto.DialError_Reason", DialError_Reason_name, DialError_Reason_value)
 	proto.RegisterEnum("proto.Payload_LoadType", Payload_LoadType_name, Payload_LoadType_value)
 	proto.RegisterType((*Payload)(nil), "proto.Payload")
+	proto.RegisterType((*DialError)(nil), "proto.DialError")
 }
 
 func init() { proto.RegisterFile("proxy_service.proto", fileDescriptor_34ca2fbc94d169de) }
 
 var fileDescriptor_34ca2fbc94d169de = []byte{
-	// 171 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0x2e, 0x28, 0xca, 0xaf,
-	0xa8, 0x8c, 0x2f, 0x4e, 0x2d, 0x2a, 0xcb, 0x4c, 0x4e, 0xd5, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17,
-	0x62, 0x05, 0x53, 0x4a, 0x99, 0x5c, 0xec, 0x01, 0x89, 0x95, 0x39, 0xf9, 0x89, 0x29, 0x42, 0xda,
-	0x5c, 0x2c, 0x69, 0x39, 0x89, 0xe9, 0x12, 0x8c, 0x0a, 0x8c, 0x1a, 0x7c, 0x46, 0xe2, 0x10, 0x75,
-	0x7a, 0x50, 0x59, 0x3d, 0x9f, 0xfc, 0xc4, 0x94, 0x90, 0xca, 0x82, 0xd4, 0x20, 0xb0, 0x22, 0x21,
-	0x21, 0x2e, 0x96, 0x94, 0xc4, 0x92, 0x44, 0x09, 0x26, 0x05, 0x46, 0x0d, 0x9e, 0x20, 0x30, 0x5b,
-	0x49, 0x96, 0x8b, 0x03, 0xa6, 0x4a, 0x88, 0x9d, 0x8b, 0xd9, 0xd1, 0xd9, 0x5b, 0x80, 0x41, 0x88,
-	0x83, 0x8b, 0x05, 0x24, 0x28, 0xc0, 0x68, 0x64, 0xc7, 0xc5, 0x13, 0x00, 0x72, 0x48, 0x30, 0xc4,
-	0x1d, 0x42, 0x7a, 0x5c, 0x6c, 0xc1, 0x25, 0x45, 0xa9, 0x89, 0xb9, 0x42, 0x7c, 0xa8, 0x76, 0x49,
-	0xa1, 0xf1, 0x95, 0x18, 0x34, 0x18, 0x0d, 0x18, 0x93, 0xd8, 0xc0, 0x82, 0xc6, 0x80, 0x00, 0x00,
-	0x00, 0xff, 0xff, 0x87, 0xc9, 0xe5, 0x11, 0xcf, 0x00, 0x00, 0x00,
+	// 287 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x5c, 0x90, 0xd1, 0x4a, 0xc3, 0x30,
+	0x14, 0x86, 0x97, 0xad, 0xeb, 0xe6, 0x71, 0x8c, 0x70, 0x26, 0x6c, 0x78, 0x35, 0x7a, 0xe3, 0x40,
+	0xa8, 0x32, 0xef, 0x85, 0xb9, 0x45, 0x26, 0x9b, 0xed, 0x48, 0x5b, 0x76, 0x59, 0xa2, 0x8d, 0x32,
+	0xa8, 0xa6, 0xa4, 0x45, 0xec, 0x4b, 0xf9, 0x8c, 0x92, 0xb6, 0x0a, 0xdb, 0x55, 0xce, 0xf9, 0xfe,
+	0x8f, 0x13, 0xf8, 0x61, 0x94, 0x69, 0xf5, 0x5d, 0xc6, 0xb9, 0xd4, 0x5f, 0x87, 0x57, 0xe9, 0x66,
+	0x5a, 0x15, 0x0a, 0xbb, 0xd5, 0xe3, 0xe4, 0xd0, 0xdb, 0x89, 0x32, 0x55, 0x22, 0xc1, 0x6b, 0xb0,
+	0xde, 0x52, 0xf1, 0x3e, 0x21, 0x53, 0x32, 0x1b, 0xce, 0xc7, 0xb5, 0xe7, 0x36, 0xa9, 0xbb, 0x55,
+	0x22, 0x09, 0xcb, 0x4c, 0xf2, 0x4a, 0x42, 0x04, 0x2b, 0x11, 0x85, 0x98, 0xb4, 0xa7, 0x64, 0x36,
+	0xe0, 0xd5, 0xec, 0x5c, 0x41, 0xff, 0xcf, 0xc2, 0x1e, 0x74, 0x16, 0xcb, 0x0d, 0x6d, 0x61, 0x1f,
+	0x2c, 0x03, 0x29, 0x31, 0xd3, 0x4e, 0x4a, 0x4d, 0xdb, 0xce, 0x0f, 0x81, 0xb3, 0xd5, 0x41, 0xa4,
+	0x4c, 0x6b, 0xa5, 0xf1, 0x06, 0x6c, 0x2d, 0x45, 0xae, 0x3e, 0x4f, 0x7e, 0xfe, 0x37, 0x5c, 0x5e,
+	0xc5, 0xbc, 0xd1, 0x9c, 0x0c, 0xec, 0x9a, 0xe0, 0x39, 0xf4, 0x22, 0x6f, 0xe3, 0xf9, 0x7b, 0x8f,
+	0xb6, 0xcc, 0xc2, 0xd9, 0x63, 0x14, 0xb0, 0x15, 0x25, 0x38, 0x86, 0x91, 0xc7, 0xc2, 0xbd, 0xcf,
+	0x37, 0x71, 0xe4, 0x71, 0xb6, 0x58, 0xae, 0x17, 0x0f, 0x5b, 0x46, 0xdb, 0x78, 0x01, 0x74, 0xed,
+	0x07, 0xe1, 0x11, 0xed, 0x20, 0x85, 0x41, 0x73, 0x28, 0x36, 0x29, 0xb5, 0xcc, 0xb5, 0xf0, 0xe9,
+	0x99, 0xf9, 0x51, 0x48, 0xbb, 0xf3, 0x7b, 0x18, 0xec, 0x4c, 0x87, 0x41, 0x5d, 0x21, 0xba, 0x60,
+	0x07, 0x85, 0x96, 0xe2, 0x03, 0x87, 0xc7, 0x35, 0x5d, 0x9e, 0xec, 0x4e, 0x6b, 0x46, 0x6e, 0xc9,
+	0x8b, 0x5d, 0xc1, 0xbb, 0xdf, 0x01, 0x00, 0x6e, 0x13, 0x09, 0x8c, 0x8a, 0x01, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
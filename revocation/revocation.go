@@ -0,0 +1,282 @@
+// Package revocation tells whether client certificates have been revoked,
+// by a certificate revocation list and by a deny list.
+//
+// The CRL file holds one or more CRLs, PEM or DER encoded, each signed by
+// one of the CA certificates given to Load and not past its next update. A
+// certificate is revoked if a CRL of its issuer lists its serial number.
+// Once a loaded CRL passes its next update the certificates of its issuer
+// are refused, as it may miss recent revocations, until a newer CRL is
+// loaded.
+//
+// The deny list file holds one certificate per line, either as
+// "serial:HEX", its serial number, or "sha256:HEX", the SHA-256
+// fingerprint of its DER encoding. Colons between hex digits are ignored,
+// so that the output of "openssl x509 -serial" or "-fingerprint -sha256"
+// may be pasted. Empty lines and lines starting with '#' are ignored.
+package revocation
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RevokedError is returned for a revoked certificate.
+type RevokedError struct {
+	Subject string
+	Serial  *big.Int
+	// By is "CRL" or "deny list".
+	By string
+}
+
+func (e *RevokedError) Error() string {
+	return fmt.Sprintf("certificate %q serial %X revoked by %s", e.Subject, e.Serial, e.By)
+}
+
+// ExpiredError is returned for a certificate whose issuer has a CRL past
+// its next update.
+type ExpiredError struct {
+	Subject    string
+	Issuer     string
+	NextUpdate time.Time
+}
+
+func (e *ExpiredError) Error() string {
+	return fmt.Sprintf("certificate %q refused, CRL of %s expired at %v", e.Subject, e.Issuer, e.NextUpdate)
+}
+
+// now returns the current time, tests replace it.
+var now = time.Now
+
+// crl is a CRL together with the subject of the CA that signed it.
+type crl struct {
+	issuer     []byte
+	issuerName string
+	nextUpdate time.Time
+	serials    map[string]bool
+}
+
+type lists struct {
+	crls         []crl
+	serials      map[string]bool
+	fingerprints map[string]bool
+}
+
+// List checks certificates against the most recently loaded files. It is
+// safe for concurrent use.
+type List struct {
+	lists atomic.Value // *lists
+}
+
+// New returns a List that revokes nothing.
+func New() *List {
+	l := &List{}
+	l.lists.Store(&lists{})
+	return l
+}
+
+// Load replaces the contents of l by the CRLs in crlFile, verified against
+// cas, and the deny list in denyFile. Either file may be empty to not use
+// it. l is left unchanged on errors.
+func (l *List) Load(crlFile, denyFile string, cas []*x509.Certificate) error {
+	ls := &lists{}
+	if crlFile != "" {
+		crls, err := loadCRLs(crlFile, cas)
+		if err != nil {
+			return err
+		}
+		ls.crls = crls
+	}
+	if denyFile != "" {
+		var err error
+		if ls.serials, ls.fingerprints, err = loadDenyList(denyFile); err != nil {
+			return err
+		}
+	}
+	l.lists.Store(ls)
+	return nil
+}
+
+// Check returns a *RevokedError if cert is revoked and an *ExpiredError if
+// a CRL of its issuer is past its next update.
+func (l *List) Check(cert *x509.Certificate) error {
+	ls := l.lists.Load().(*lists)
+	serial := serialKey(cert.SerialNumber)
+	revoked := func(by string) error {
+		return &RevokedError{Subject: cert.Subject.CommonName, Serial: cert.SerialNumber, By: by}
+	}
+
+	t := now()
+	for _, c := range ls.crls {
+		if !bytes.Equal(c.issuer, cert.RawIssuer) {
+			continue
+		}
+		if c.serials[serial] {
+			return revoked("CRL")
+		}
+		if !t.Before(c.nextUpdate) {
+			return &ExpiredError{Subject: cert.Subject.CommonName, Issuer: c.issuerName, NextUpdate: c.nextUpdate}
+		}
+	}
+	if ls.serials[serial] {
+		return revoked("deny list")
+	}
+	if len(ls.fingerprints) > 0 {
+		sum := sha256.Sum256(cert.Raw)
+		if ls.fingerprints[hex.EncodeToString(sum[:])] {
+			return revoked("deny list")
+		}
+	}
+	return nil
+}
+
+// CheckChains returns the error of Check for the first certificate of the
+// verified chains, other than their root CAs, that fails it.
+func (l *List) CheckChains(chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		if len(chain) == 0 {
+			continue
+		}
+		for _, cert := range chain[:len(chain)-1] {
+			if err := l.Check(cert); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// NextUpdate returns the earliest next update of the loaded CRLs, the zero
+// time without CRLs.
+func (l *List) NextUpdate() time.Time {
+	var next time.Time
+	for _, c := range l.lists.Load().(*lists).crls {
+		if next.IsZero() || c.nextUpdate.Before(next) {
+			next = c.nextUpdate
+		}
+	}
+	return next
+}
+
+func serialKey(n *big.Int) string {
+	return n.Text(16)
+}
+
+func loadCRLs(path string, cas []*x509.Certificate) ([]crl, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var ders [][]byte
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type == "X509 CRL" {
+				ders = append(ders, block.Bytes)
+			}
+		}
+	} else {
+		ders = append(ders, data)
+	}
+	if len(ders) == 0 {
+		return nil, fmt.Errorf("%s: no CRL found", path)
+	}
+
+	var crls []crl
+	for _, der := range ders {
+		list, err := x509.ParseDERCRL(der)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		issuer := issuerOf(list, cas)
+		if issuer == nil {
+			return nil, fmt.Errorf("%s: CRL of %s is not signed by a known CA", path, list.TBSCertList.Issuer)
+		}
+		// A CRL past its next update may miss recent revocations
+		if list.HasExpired(now()) {
+			return nil, fmt.Errorf("%s: CRL of %s expired at %v", path, list.TBSCertList.Issuer, list.TBSCertList.NextUpdate)
+		}
+		c := crl{
+			issuer:     issuer.RawSubject,
+			issuerName: list.TBSCertList.Issuer.String(),
+			nextUpdate: list.TBSCertList.NextUpdate,
+			serials:    make(map[string]bool),
+		}
+		for _, r := range list.TBSCertList.RevokedCertificates {
+			c.serials[serialKey(r.SerialNumber)] = true
+		}
+		crls = append(crls, c)
+	}
+	return crls, nil
+}
+
+// issuerOf returns the CA of cas that signed list, nil if none did.
+func issuerOf(list *pkix.CertificateList, cas []*x509.Certificate) *x509.Certificate {
+	for _, ca := range cas {
+		if ca.CheckCRLSignature(list) == nil {
+			return ca
+		}
+	}
+	return nil
+}
+
+func loadDenyList(path string) (serials, fingerprints map[string]bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	serials = make(map[string]bool)
+	fingerprints = make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, nil, fmt.Errorf("%s:%d: expected serial:HEX or sha256:HEX", path, n)
+		}
+		kind := strings.ToLower(line[:i])
+		value := strings.TrimSpace(strings.Replace(line[i+1:], ":", "", -1))
+		if len(value)%2 == 1 {
+			value = "0" + value
+		}
+		b, err := hex.DecodeString(value)
+		if err != nil || len(b) == 0 {
+			return nil, nil, fmt.Errorf("%s:%d: invalid hex %q", path, n, line[i+1:])
+		}
+
+		switch kind {
+		case "serial":
+			serials[serialKey(new(big.Int).SetBytes(b))] = true
+		case "sha256":
+			if len(b) != sha256.Size {
+				return nil, nil, fmt.Errorf("%s:%d: SHA-256 fingerprint must have %d bytes", path, n, sha256.Size)
+			}
+			fingerprints[hex.EncodeToString(b)] = true
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: unknown kind %q", path, n, line[:i])
+		}
+	}
+	return serials, fingerprints, scanner.Err()
+}
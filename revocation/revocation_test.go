@@ -0,0 +1,279 @@
+package revocation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a CA issuing certificates and CRLs for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, name string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// crl returns a DER CRL revoking serials that is due for an update at
+// nextUpdate.
+func (ca *testCA) crl(t *testing.T, nextUpdate time.Time, serials ...int64) []byte {
+	var revoked []pkix.RevokedCertificate
+	for _, s := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+	}
+	der, err := ca.cert.CreateCRL(rand.Reader, ca.key, revoked, time.Now().Add(-time.Minute), nextUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func pemCRL(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+// writeFile writes b to a new temporary file and returns its path.
+func writeFile(t *testing.T, b []byte) string {
+	f, err := ioutil.TempFile("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestList_CRL(t *testing.T) {
+	ca := newTestCA(t, "CA")
+	other := newTestCA(t, "Other CA")
+	revoked := ca.issue(t, 10, "revoked")
+	good := ca.issue(t, 11, "good")
+	// Same serial, other issuer
+	otherSerial := other.issue(t, 10, "other")
+
+	next := time.Now().Add(time.Hour)
+	der := ca.crl(t, next, 10)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "DER", data: der},
+		{name: "PEM", data: pemCRL(der)},
+		{name: "PEM with other blocks", data: append(append([]byte("garbage\n"),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...), pemCRL(der)...)},
+		{name: "several PEM", data: append(pemCRL(other.crl(t, next, 99)), pemCRL(der)...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, tt.data)
+			defer os.Remove(path)
+
+			l := New()
+			if err := l.Load(path, "", []*x509.Certificate{other.cert, ca.cert}); err != nil {
+				t.Fatal(err)
+			}
+			err := l.Check(revoked)
+			if re, ok := err.(*RevokedError); !ok || re.By != "CRL" || re.Serial.Int64() != 10 {
+				t.Errorf("Check(revoked) = %v, want revoked by CRL", err)
+			}
+			if err := l.Check(good); err != nil {
+				t.Errorf("Check(good) = %v", err)
+			}
+			if err := l.Check(otherSerial); err != nil {
+				t.Errorf("Check of the same serial from another issuer = %v", err)
+			}
+		})
+	}
+}
+
+func TestList_CRLInvalid(t *testing.T) {
+	ca := newTestCA(t, "CA")
+	unknown := newTestCA(t, "Unknown CA")
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "unknown issuer", data: unknown.crl(t, time.Now().Add(time.Hour), 1), want: "not signed by a known CA"},
+		{name: "expired", data: ca.crl(t, time.Now().Add(-time.Second), 1), want: "expired"},
+		{name: "no CRL in PEM", data: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), want: "no CRL found"},
+		{name: "not DER", data: []byte("not a CRL"), want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, tt.data)
+			defer os.Remove(path)
+
+			l := New()
+			err := l.Load(path, "", []*x509.Certificate{ca.cert})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load = %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestList_CRLExpiry(t *testing.T) {
+	ca := newTestCA(t, "CA")
+	other := newTestCA(t, "Other CA")
+	good := ca.issue(t, 11, "good")
+	otherGood := other.issue(t, 12, "other")
+
+	next := time.Now().Add(time.Hour).Truncate(time.Second)
+	path := writeFile(t, append(pemCRL(ca.crl(t, next, 10)), pemCRL(other.crl(t, next.Add(time.Hour), 99))...))
+	defer os.Remove(path)
+
+	l := New()
+	if err := l.Load(path, "", []*x509.Certificate{ca.cert, other.cert}); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.NextUpdate(); !got.Equal(next) {
+		t.Errorf("NextUpdate = %v, want %v", got, next)
+	}
+	if err := l.Check(good); err != nil {
+		t.Errorf("Check(good) before the next update = %v", err)
+	}
+
+	// The CRL of CA expires, the one of Other CA does not
+	defer func() { now = time.Now }()
+	now = func() time.Time { return next }
+	err := l.Check(good)
+	if ee, ok := err.(*ExpiredError); !ok || !ee.NextUpdate.Equal(next) || ee.Issuer != "CN=CA" {
+		t.Errorf("Check(good) after the next update = %v, want an expired CRL of CN=CA", err)
+	}
+	if err := l.Check(otherGood); err != nil {
+		t.Errorf("Check of a certificate of another CA = %v", err)
+	}
+}
+
+func TestList_DenyList(t *testing.T) {
+	ca := newTestCA(t, "CA")
+	bySerial := ca.issue(t, 0x0a1b, "by serial")
+	byFingerprint := ca.issue(t, 0x0c, "by fingerprint")
+	good := ca.issue(t, 0x0d, "good")
+
+	sum := sha256.Sum256(byFingerprint.Raw)
+	var colons []string
+	for _, b := range sum {
+		colons = append(colons, strings.ToUpper(hex.EncodeToString([]byte{b})))
+	}
+	deny := strings.Join([]string{
+		"# revoked laptops",
+		"",
+		"serial: 0A:1B",
+		"SHA256:" + strings.Join(colons, ":"),
+		"serial:ff",
+	}, "\n")
+	path := writeFile(t, []byte(deny))
+	defer os.Remove(path)
+
+	l := New()
+	if err := l.Load("", path, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, cert := range []*x509.Certificate{bySerial, byFingerprint} {
+		err := l.Check(cert)
+		if re, ok := err.(*RevokedError); !ok || re.By != "deny list" {
+			t.Errorf("Check(%s) = %v, want revoked by deny list", cert.Subject.CommonName, err)
+		}
+	}
+	if err := l.Check(good); err != nil {
+		t.Errorf("Check(good) = %v", err)
+	}
+
+	// The whole chain but its root is checked
+	if err := l.CheckChains([][]*x509.Certificate{{good, ca.cert}}); err != nil {
+		t.Errorf("CheckChains(good) = %v", err)
+	}
+	if err := l.CheckChains([][]*x509.Certificate{{good, bySerial, ca.cert}}); err == nil {
+		t.Error("CheckChains with a revoked intermediate succeeded")
+	}
+
+	// A failed load keeps the previous lists
+	bad := writeFile(t, []byte("serial:xyz"))
+	defer os.Remove(bad)
+	if err := l.Load("", bad, nil); err == nil {
+		t.Fatal("Load of an invalid deny list succeeded")
+	}
+	if l.Check(bySerial) == nil {
+		t.Error("deny list dropped by a failed load")
+	}
+}
+
+func TestLoadDenyList_Invalid(t *testing.T) {
+	for _, line := range []string{
+		"0a1b",
+		"serial:",
+		"serial:xyz",
+		"sha256:0a1b",
+		"md5:0a1b",
+	} {
+		path := writeFile(t, []byte(line+"\n"))
+		_, _, err := loadDenyList(path)
+		os.Remove(path)
+		if err == nil {
+			t.Errorf("loadDenyList(%q) succeeded", line)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// PAC returns a proxy auto-config script equivalent to the rules. Direct
+// destinations are reached directly, rejected ones through pacBlackhole,
+// which fails every connection, and all others through proxy, a PAC result
+// such as "PROXY host:port".
+func (r *Router) PAC(proxy string) string {
+	var b bytes.Buffer
+	b.WriteString(pacHeader)
+
+	for _, ru := range r.rules {
+		fmt.Fprintf(&b, "\t// %s\n", ru)
+		fmt.Fprintf(&b, "\tif (%s) return %s;\n", ru.condition(), pacResult(ru.action, proxy))
+	}
+	fmt.Fprintf(&b, "\treturn %s;\n}\n", pacResult(r.final, proxy))
+	return b.String()
+}
+
+const pacHeader = `// Generated from the routing rules of tt-client.
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	var ip = /^[0-9.]+$/.test(host) || host.indexOf(":") >= 0;
+	var m = /^[a-z]+:\/\/(?:[^@\/]*@)?(?:\[[^\]]*\]|[^:\/]*)(?::(\d+))?/i.exec(url);
+	var port = m && m[1] ? parseInt(m[1], 10) : (url.substring(0, 6).toLowerCase() == "https:" ? 443 : 80);
+
+`
+
+// pacBlackhole is the PAC result of rejected destinations, a proxy on the
+// discard port, which is not expected to accept connections.
+const pacBlackhole = "PROXY 127.0.0.1:9"
+
+func pacResult(d Decision, proxy string) string {
+	switch d.Action {
+	case Direct:
+		return strconv.Quote("DIRECT")
+	case Reject:
+		return strconv.Quote(pacBlackhole)
+	}
+	return strconv.Quote(proxy)
+}
+
+// condition returns the JavaScript expression matching the rule.
+func (r *rule) condition() string {
+	value := strconv.Quote(r.value)
+	switch r.typ {
+	case domain:
+		return fmt.Sprintf("!ip && host == %s", value)
+	case domainSuffix:
+		return fmt.Sprintf("!ip && (host == %s || dnsDomainIs(host, %s))", value, strconv.Quote("."+r.value))
+	case domainKeyword:
+		return fmt.Sprintf("!ip && host.indexOf(%s) >= 0", value)
+	case domainRegex:
+		return fmt.Sprintf("!ip && new RegExp(%s).test(host)", value)
+	case ipCIDR:
+		if r.network.IP.To4() == nil {
+			// PAC has no IPv6 network test
+			return "false"
+		}
+		return fmt.Sprintf("ip && isInNet(host, %q, %q)", r.network.IP.String(), net.IP(r.network.Mask).String())
+	case dstPort:
+		return fmt.Sprintf("port == %d", r.port)
+	case srcIPCIDR:
+		if r.network.IP.To4() == nil {
+			return "false"
+		}
+		return fmt.Sprintf("isInNet(myIpAddress(), %q, %q)", r.network.IP.String(), net.IP(r.network.Mask).String())
+	}
+	return "false"
+}
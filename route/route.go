@@ -0,0 +1,255 @@
+// Package route decides per destination whether a connection goes through
+// the tunnel, directly to the destination or nowhere, based on rule lists
+// loaded from files.
+//
+// A rule file holds one rule per line in the form TYPE,VALUE,ACTION. Empty
+// lines and lines starting with '#' are ignored. The rule types are
+//
+//	DOMAIN          the destination host name equals VALUE
+//	DOMAIN-SUFFIX   the host name equals VALUE or is a subdomain of it
+//	DOMAIN-KEYWORD  the host name contains VALUE
+//	DOMAIN-REGEX    the host name matches the regular expression VALUE
+//	IP-CIDR         the destination IP address is within the network VALUE
+//	DST-PORT        the destination port equals VALUE
+//	SRC-IP-CIDR     the source IP address is within the network VALUE
+//
+// and the actions are DIRECT, REJECT, TUNNEL, which uses any server, and
+// TUNNEL:host:port, which uses the given server. A line FINAL,ACTION sets
+// the action of destinations no rule matches, TUNNEL by default.
+//
+// Rules are evaluated in order and the first match wins. IP-CIDR rules only
+// match destinations given as IP addresses, host names are never resolved
+// to apply them.
+package route
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Action is what is done with a matching connection.
+type Action int
+
+const (
+	Tunnel Action = iota
+	Direct
+	Reject
+)
+
+func (a Action) String() string {
+	switch a {
+	case Direct:
+		return "DIRECT"
+	case Reject:
+		return "REJECT"
+	}
+	return "TUNNEL"
+}
+
+// Decision is the outcome of routing a connection.
+type Decision struct {
+	Action Action
+	// Server is the host:port of the server a Tunnel decision requires,
+	// any server may be used if it is empty.
+	Server string
+	// Rule is the rule that matched, "" for the final decision.
+	Rule string
+}
+
+// Destination describes the connection being routed.
+type Destination struct {
+	// Host is the destination host, a name or an IP address.
+	Host string
+	Port int
+	// Source is the address of the client, it may be nil.
+	Source net.IP
+}
+
+// NewDestination returns the Destination of a connection to addr from
+// source, both in host:port form. source may be empty.
+func NewDestination(addr, source string) Destination {
+	d := Destination{Host: addr}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		d.Host = host
+		d.Port, _ = strconv.Atoi(port)
+	}
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		d.Source = net.ParseIP(host)
+	}
+	return d
+}
+
+type ruleType string
+
+const (
+	domain        ruleType = "DOMAIN"
+	domainSuffix  ruleType = "DOMAIN-SUFFIX"
+	domainKeyword ruleType = "DOMAIN-KEYWORD"
+	domainRegex   ruleType = "DOMAIN-REGEX"
+	ipCIDR        ruleType = "IP-CIDR"
+	dstPort       ruleType = "DST-PORT"
+	srcIPCIDR     ruleType = "SRC-IP-CIDR"
+	final         ruleType = "FINAL"
+)
+
+type rule struct {
+	typ    ruleType
+	value  string
+	action Decision
+
+	network *net.IPNet
+	regex   *regexp.Regexp
+	port    int
+}
+
+func (r *rule) match(d Destination) bool {
+	host := strings.ToLower(strings.TrimSuffix(d.Host, "."))
+	ip := net.ParseIP(host)
+
+	switch r.typ {
+	case domain:
+		return ip == nil && host == r.value
+	case domainSuffix:
+		return ip == nil && (host == r.value || strings.HasSuffix(host, "."+r.value))
+	case domainKeyword:
+		return ip == nil && strings.Contains(host, r.value)
+	case domainRegex:
+		return ip == nil && r.regex.MatchString(host)
+	case ipCIDR:
+		return ip != nil && r.network.Contains(ip)
+	case dstPort:
+		return d.Port == r.port
+	case srcIPCIDR:
+		return d.Source != nil && r.network.Contains(d.Source)
+	}
+	return false
+}
+
+func (r *rule) String() string {
+	return fmt.Sprintf("%s,%s", r.typ, r.value)
+}
+
+// Router routes destinations by a list of rules.
+type Router struct {
+	rules []*rule
+	final Decision
+}
+
+// Load reads the rule files at paths, in order, into a Router.
+func Load(paths ...string) (*Router, error) {
+	r := &Router{final: Decision{Action: Tunnel}}
+	for _, path := range paths {
+		if err := r.load(path); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *Router) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := r.add(line); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// add parses line and appends the rule it holds.
+func (r *Router) add(line string) error {
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	typ := ruleType(strings.ToUpper(fields[0]))
+	if typ == final {
+		if len(fields) != 2 {
+			return fmt.Errorf("expected FINAL,ACTION")
+		}
+		action, err := parseAction(fields[1])
+		if err != nil {
+			return err
+		}
+		r.final = action
+		return nil
+	}
+
+	if len(fields) != 3 {
+		return fmt.Errorf("expected TYPE,VALUE,ACTION")
+	}
+	action, err := parseAction(fields[2])
+	if err != nil {
+		return err
+	}
+	ru := &rule{typ: typ, value: strings.ToLower(fields[1]), action: action}
+
+	switch typ {
+	case domain, domainSuffix, domainKeyword:
+		ru.value = strings.TrimPrefix(ru.value, ".")
+	case domainRegex:
+		ru.value = fields[1]
+		if ru.regex, err = regexp.Compile(ru.value); err != nil {
+			return err
+		}
+	case ipCIDR, srcIPCIDR:
+		if _, ru.network, err = net.ParseCIDR(ru.value); err != nil {
+			return err
+		}
+	case dstPort:
+		if ru.port, err = strconv.Atoi(ru.value); err != nil || ru.port <= 0 || ru.port > 0xffff {
+			return fmt.Errorf("invalid port %q", ru.value)
+		}
+	default:
+		return fmt.Errorf("unknown rule type %q", fields[0])
+	}
+
+	ru.action.Rule = ru.String()
+	r.rules = append(r.rules, ru)
+	return nil
+}
+
+func parseAction(s string) (Decision, error) {
+	upper := strings.ToUpper(s)
+	switch {
+	case upper == "DIRECT":
+		return Decision{Action: Direct}, nil
+	case upper == "REJECT":
+		return Decision{Action: Reject}, nil
+	case upper == "TUNNEL":
+		return Decision{Action: Tunnel}, nil
+	case strings.HasPrefix(upper, "TUNNEL:"):
+		server := s[len("TUNNEL:"):]
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return Decision{}, fmt.Errorf("invalid server in %q: %v", s, err)
+		}
+		return Decision{Action: Tunnel, Server: server}, nil
+	}
+	return Decision{}, fmt.Errorf("unknown action %q", s)
+}
+
+// Route returns the decision of the first rule matching d.
+func (r *Router) Route(d Destination) Decision {
+	for _, ru := range r.rules {
+		if ru.match(d) {
+			return ru.action
+		}
+	}
+	return r.final
+}
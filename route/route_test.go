@@ -0,0 +1,184 @@
+package route
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newRouter returns a Router holding the rules of lines.
+func newRouter(t *testing.T, lines ...string) *Router {
+	r := &Router{final: Decision{Action: Tunnel}}
+	for _, line := range lines {
+		if err := r.add(line); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+	}
+	return r
+}
+
+func TestRouter_Add(t *testing.T) {
+	tests := []struct {
+		line string
+		err  string
+	}{
+		{line: "DOMAIN,example.com,DIRECT"},
+		{line: "domain-suffix,.example.com,reject"},
+		{line: "IP-CIDR,10.0.0.0/8,TUNNEL:192.0.2.1:8443"},
+		{line: "FINAL,DIRECT"},
+		{line: "DOMAIN,example.com", err: "expected TYPE,VALUE,ACTION"},
+		{line: "FINAL", err: "expected FINAL,ACTION"},
+		{line: "FINAL,DIRECT,x", err: "expected FINAL,ACTION"},
+		{line: "HOST,example.com,DIRECT", err: "unknown rule type"},
+		{line: "DOMAIN,example.com,PROXY", err: "unknown action"},
+		{line: "DOMAIN,example.com,TUNNEL:192.0.2.1", err: "invalid server"},
+		{line: "DOMAIN-REGEX,(,DIRECT", err: "missing closing )"},
+		{line: "IP-CIDR,10.0.0.0,DIRECT", err: "invalid CIDR address"},
+		{line: "SRC-IP-CIDR,10.0.0.0/33,DIRECT", err: "invalid CIDR address"},
+		{line: "DST-PORT,http,DIRECT", err: "invalid port"},
+		{line: "DST-PORT,65536,DIRECT", err: "invalid port"},
+		{line: "DST-PORT,0,DIRECT", err: "invalid port"},
+	}
+	for _, tt := range tests {
+		r := &Router{}
+		err := r.add(tt.line)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%q: %v", tt.line, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%q: error %v, want one containing %q", tt.line, err, tt.err)
+		}
+	}
+}
+
+func TestRouter_Route(t *testing.T) {
+	r := newRouter(t,
+		"DOMAIN,exact.example.com,DIRECT",
+		"DOMAIN-SUFFIX,suffix.example.com,REJECT",
+		"DOMAIN-KEYWORD,keyword,DIRECT",
+		"DOMAIN-REGEX,^ads?\\.,REJECT",
+		"IP-CIDR,10.0.0.0/8,DIRECT",
+		"IP-CIDR,2001:db8::/32,REJECT",
+		"DST-PORT,25,REJECT",
+		"SRC-IP-CIDR,192.168.1.0/24,DIRECT",
+		"DOMAIN-SUFFIX,example.net,TUNNEL:192.0.2.1:8443",
+		"DOMAIN,exact.example.com,REJECT",
+		"FINAL,TUNNEL",
+	)
+
+	tests := []struct {
+		addr, source string
+		action       Action
+		server       string
+		rule         string
+	}{
+		{addr: "exact.example.com:443", action: Direct, rule: "DOMAIN,exact.example.com"},
+		{addr: "EXACT.example.com.:443", action: Direct, rule: "DOMAIN,exact.example.com"},
+		{addr: "sub.exact.example.com:443", action: Tunnel},
+		{addr: "suffix.example.com:443", action: Reject, rule: "DOMAIN-SUFFIX,suffix.example.com"},
+		{addr: "a.b.suffix.example.com:443", action: Reject, rule: "DOMAIN-SUFFIX,suffix.example.com"},
+		{addr: "notsuffix.example.com:443", action: Tunnel},
+		{addr: "a-keyword-b.com:80", action: Direct, rule: "DOMAIN-KEYWORD,keyword"},
+		{addr: "ad.example.org:80", action: Reject, rule: "DOMAIN-REGEX,^ads?\\."},
+		{addr: "ads.example.org:80", action: Reject, rule: "DOMAIN-REGEX,^ads?\\."},
+		{addr: "bad.example.org:80", action: Tunnel},
+		{addr: "10.1.2.3:80", action: Direct, rule: "IP-CIDR,10.0.0.0/8"},
+		{addr: "[2001:db8::1]:80", action: Reject, rule: "IP-CIDR,2001:db8::/32"},
+		// Host names are not resolved for IP-CIDR rules
+		{addr: "localhost:80", action: Tunnel},
+		{addr: "example.org:25", action: Reject, rule: "DST-PORT,25"},
+		// The first match wins
+		{addr: "10.1.2.3:25", action: Direct, rule: "IP-CIDR,10.0.0.0/8"},
+		{addr: "example.org:80", source: "192.168.1.7:50000", action: Direct, rule: "SRC-IP-CIDR,192.168.1.0/24"},
+		{addr: "example.org:80", source: "192.168.2.7:50000", action: Tunnel},
+		{addr: "www.example.net:443", action: Tunnel, server: "192.0.2.1:8443", rule: "DOMAIN-SUFFIX,example.net"},
+		{addr: "example.org:80", action: Tunnel},
+	}
+	for _, tt := range tests {
+		d := r.Route(NewDestination(tt.addr, tt.source))
+		if d.Action != tt.action || d.Server != tt.server || d.Rule != tt.rule {
+			t.Errorf("Route(%s from %q) = %v %q by %q, want %v %q by %q",
+				tt.addr, tt.source, d.Action, d.Server, d.Rule, tt.action, tt.server, tt.rule)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	f, err := ioutil.TempFile("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\n\nDOMAIN,example.com,DIRECT\n  FINAL , REJECT  \n")
+	f.Close()
+
+	r, err := Load(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := r.Route(NewDestination("example.com:80", "")); d.Action != Direct {
+		t.Errorf("example.com routed %v, want DIRECT", d.Action)
+	}
+	if d := r.Route(NewDestination("example.org:80", "")); d.Action != Reject || d.Rule != "" {
+		t.Errorf("example.org routed %v by %q, want the final REJECT", d.Action, d.Rule)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("DOMAIN,example.com,DIRECT\nDOMAIN,example.com\n"), 0600)
+	if _, err := Load(f.Name()); err == nil || !strings.Contains(err.Error(), f.Name()+":2:") {
+		t.Errorf("Load of a bad second line = %v, want an error at line 2", err)
+	}
+}
+
+func TestNewDestination(t *testing.T) {
+	d := NewDestination("example.com:443", "192.0.2.1:50000")
+	if d.Host != "example.com" || d.Port != 443 || !d.Source.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("NewDestination = %+v", d)
+	}
+	d = NewDestination("example.com", "")
+	if d.Host != "example.com" || d.Port != 0 || d.Source != nil {
+		t.Errorf("NewDestination without port or source = %+v", d)
+	}
+}
+
+func TestRouter_PAC(t *testing.T) {
+	r := newRouter(t,
+		"DOMAIN,direct.example.com,DIRECT",
+		"DOMAIN-SUFFIX,reject.example.com,REJECT",
+		"DOMAIN-KEYWORD,tunnel,TUNNEL",
+		"DOMAIN-REGEX,^ads?\\.,REJECT",
+		"IP-CIDR,10.0.0.0/8,DIRECT",
+		"IP-CIDR,2001:db8::/32,DIRECT",
+		"DST-PORT,25,REJECT",
+		"SRC-IP-CIDR,192.168.1.0/24,DIRECT",
+		"DOMAIN,server.example.com,TUNNEL:192.0.2.1:8443",
+		"FINAL,DIRECT",
+	)
+	pac := r.PAC("PROXY 127.0.0.1:8080")
+
+	for _, want := range []string{
+		"function FindProxyForURL(url, host) {",
+		"\t// DOMAIN,direct.example.com\n\tif (!ip && host == \"direct.example.com\") return \"DIRECT\";\n",
+		"\tif (!ip && (host == \"reject.example.com\" || dnsDomainIs(host, \".reject.example.com\"))) return \"PROXY 127.0.0.1:9\";\n",
+		"\tif (!ip && host.indexOf(\"tunnel\") >= 0) return \"PROXY 127.0.0.1:8080\";\n",
+		"\tif (!ip && new RegExp(\"^ads?\\\\.\").test(host)) return \"PROXY 127.0.0.1:9\";\n",
+		"\tif (ip && isInNet(host, \"10.0.0.0\", \"255.0.0.0\")) return \"DIRECT\";\n",
+		// PAC has no IPv6 network test
+		"\t// IP-CIDR,2001:db8::/32\n\tif (false) return \"DIRECT\";\n",
+		"\tif (port == 25) return \"PROXY 127.0.0.1:9\";\n",
+		"\tif (isInNet(myIpAddress(), \"192.168.1.0\", \"255.255.255.0\")) return \"DIRECT\";\n",
+		// The proxy picks the server itself
+		"\tif (!ip && host == \"server.example.com\") return \"PROXY 127.0.0.1:8080\";\n",
+		"\treturn \"DIRECT\";\n}\n",
+	} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("PAC lacks %q:\n%s", want, pac)
+		}
+	}
+
+	// Rules keep their order
+	if i, j := strings.Index(pac, "direct.example.com"), strings.Index(pac, "reject.example.com"); i > j {
+		t.Errorf("PAC reorders the rules:\n%s", pac)
+	}
+}
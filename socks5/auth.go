@@ -0,0 +1,165 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+const (
+	UserPassAuth    = uint8(2)
+	noAcceptable    = uint8(255)
+	userAuthVersion = uint8(1)
+	authSuccess     = uint8(0)
+	authFailure     = uint8(1)
+)
+
+var (
+	UserAuthFailed  = fmt.Errorf("User authentication failed")
+	NoSupportedAuth = fmt.Errorf("No supported authentication mechanism")
+)
+
+// AuthContext is the result of a successful authentication
+type AuthContext struct {
+	// Method is the authentication method used
+	Method uint8
+	// Payload holds method specific values, "Username" for UserPassAuth
+	// and the unauthenticated "UserID" of SOCKS4 requests
+	Payload map[string]string
+}
+
+// Username returns the authenticated user name, if any
+func (a *AuthContext) Username() string {
+	if a == nil {
+		return ""
+	}
+	return a.Payload["Username"]
+}
+
+type authContextKey struct{}
+
+// AuthContextFrom returns the AuthContext of the request ctx belongs to,
+// ctx is the context handed to the Dial function and the server hooks.
+func AuthContextFrom(ctx context.Context) *AuthContext {
+	a, _ := ctx.Value(authContextKey{}).(*AuthContext)
+	return a
+}
+
+// Authenticator implements one authentication method
+type Authenticator interface {
+	Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error)
+	GetCode() uint8
+}
+
+// NoAuthAuthenticator is used to handle the "No Authentication" mode
+type NoAuthAuthenticator struct{}
+
+func (a NoAuthAuthenticator) GetCode() uint8 {
+	return NoAuth
+}
+
+func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	_, err := writer.Write([]byte{Socks5Version, NoAuth})
+	return &AuthContext{NoAuth, nil}, err
+}
+
+// UserPassAuthenticator is used to handle username/password based
+// authentication as described in RFC 1929
+type UserPassAuthenticator struct {
+	Credentials CredentialStore
+}
+
+func (a UserPassAuthenticator) GetCode() uint8 {
+	return UserPassAuth
+}
+
+func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	// Tell the client to use user/pass auth
+	if _, err := writer.Write([]byte{Socks5Version, UserPassAuth}); err != nil {
+		return nil, err
+	}
+
+	// Get the version and username length
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	// Ensure we are compatible
+	if header[0] != userAuthVersion {
+		return nil, fmt.Errorf("Unsupported auth version: %v", header[0])
+	}
+
+	// Get the user name
+	user := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(reader, user); err != nil {
+		return nil, err
+	}
+
+	// Get the password length
+	if _, err := io.ReadFull(reader, header[:1]); err != nil {
+		return nil, err
+	}
+
+	// Get the password
+	pass := make([]byte, int(header[0]))
+	if _, err := io.ReadFull(reader, pass); err != nil {
+		return nil, err
+	}
+
+	if !a.Credentials.Valid(string(user), string(pass)) {
+		if _, err := writer.Write([]byte{userAuthVersion, authFailure}); err != nil {
+			return nil, err
+		}
+		return nil, UserAuthFailed
+	}
+
+	if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
+		return nil, err
+	}
+	return &AuthContext{UserPassAuth, map[string]string{"Username": string(user)}}, nil
+}
+
+// authenticate reads the methods offered by the client and runs the first
+// of the server's methods among them.
+func (s *Server) authenticate(conn io.ReadWriter) (*AuthContext, error) {
+	methods, err := readMethods(conn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get auth methods: %v", err)
+	}
+
+	for _, auth := range s.authMethods() {
+		for _, method := range methods {
+			if auth.GetCode() == method {
+				return auth.Authenticate(conn, conn)
+			}
+		}
+	}
+
+	if _, err := conn.Write([]byte{Socks5Version, noAcceptable}); err != nil {
+		return nil, err
+	}
+	return nil, NoSupportedAuth
+}
+
+func (s *Server) authMethods() []Authenticator {
+	if len(s.AuthMethods) > 0 {
+		return s.AuthMethods
+	}
+	if s.Credentials != nil {
+		return []Authenticator{UserPassAuthenticator{Credentials: s.Credentials}}
+	}
+	return []Authenticator{NoAuthAuthenticator{}}
+}
+
+// readMethods is used to read the number of methods and the methods
+func readMethods(r io.Reader) ([]byte, error) {
+	header := []byte{0}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	methods := make([]byte, int(header[0]))
+	_, err := io.ReadFull(r, methods)
+	return methods, err
+}
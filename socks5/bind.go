@@ -0,0 +1,107 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultBindTimeout is how long a BIND request waits for the incoming
+// connection if Server.BindTimeout is not set.
+const DefaultBindTimeout = 2 * time.Minute
+
+// BindListener accepts the incoming connection of a BIND request. The
+// address returned by Addr is sent to the client in the first reply, the
+// remote address of the accepted connection in the second one. Connections
+// from hosts other than the one named in the request are closed and Accept
+// is called again, a listener that accepts only once has to refuse them
+// itself.
+type BindListener interface {
+	Accept() (net.Conn, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// BindFunc opens the listener for the BIND request req.
+type BindFunc func(ctx context.Context, req *Request) (BindListener, error)
+
+// handleBind waits for a connection from the application server named in
+// req and proxies it to conn.
+func (s *Server) handleBind(ctx context.Context, conn net.Conn, req *Request) error {
+	var listener BindListener
+	var err error
+	if s.Bind != nil {
+		listener, err = s.Bind(ctx, req)
+	} else {
+		// Listen on the address the client reached us on
+		bindIP := net.IPv4zero
+		if local := addrSpecOf(conn.LocalAddr()); local != nil {
+			bindIP = local.IP
+		}
+		listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: bindIP})
+	}
+	if err != nil {
+		if err := req.reply(conn, serverFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Bind for %v failed: %v", req.DestAddr, err)
+	}
+	defer listener.Close()
+
+	if err := req.reply(conn, successReply, addrSpecOf(listener.Addr())); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	timeout := s.BindTimeout
+	if timeout == 0 {
+		timeout = DefaultBindTimeout
+	}
+	timer := time.AfterFunc(timeout, func() { listener.Close() })
+	peer, err := acceptFrom(listener, req.DestAddr)
+	timer.Stop()
+	if err != nil {
+		if err := req.reply(conn, serverFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Bind for %v failed to accept: %v", req.DestAddr, err)
+	}
+	defer peer.Close()
+
+	if err := req.reply(conn, successReply, addrSpecOf(peer.RemoteAddr())); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	errCh := make(chan error, 2)
+	go proxy(peer, conn, errCh)
+	go proxy(conn, peer, errCh)
+
+	for i := 0; i < 2; i++ {
+		e := <-errCh
+		if e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// acceptFrom accepts connections until one arrives from the host of dest.
+// Connections from other hosts are closed, any host is accepted if dest
+// does not name an IP address.
+func acceptFrom(listener BindListener, dest *AddrSpec) (net.Conn, error) {
+	for {
+		peer, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if dest.IP == nil || dest.IP.IsUnspecified() {
+			return peer, nil
+		}
+		if remote := addrSpecOf(peer.RemoteAddr()); remote != nil && remote.IP.Equal(dest.IP) {
+			return peer, nil
+		}
+		peer.Close()
+	}
+}
@@ -0,0 +1,83 @@
+package socks5
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CredentialStore is used to support user/pass authentication
+type CredentialStore interface {
+	Valid(user, password string) bool
+}
+
+// StaticCredentials enables using a map directly as a credential store
+type StaticCredentials map[string]string
+
+func (s StaticCredentials) Valid(user, password string) bool {
+	pass, ok := s[user]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(pass)) == 1
+}
+
+// FileCredentials is a credential store read from an htpasswd style file.
+// Each line holds "user:password", where password is either stored in
+// plain text or as "{SHA}" followed by the base64 encoded SHA-1 of the
+// password, as written by "htpasswd -s". Empty lines and lines starting
+// with '#' are ignored.
+type FileCredentials struct {
+	users map[string]string
+}
+
+// LoadCredentials reads a FileCredentials store from path.
+func LoadCredentials(path string) (*FileCredentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected user:password", path, n)
+		}
+		user, pass := line[:i], line[i+1:]
+		if strings.HasPrefix(pass, "$") {
+			return nil, fmt.Errorf("%s:%d: unsupported password hash for %q", path, n, user)
+		}
+		users[user] = pass
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &FileCredentials{users: users}, nil
+}
+
+func (f *FileCredentials) Valid(user, password string) bool {
+	stored, ok := f.users[user]
+	if !ok {
+		return false
+	}
+
+	given := password
+	if strings.HasPrefix(stored, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		given = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(stored)) == 1
+}
@@ -1,11 +1,13 @@
 package socks5
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
-
+	"os"
 	"strconv"
+	"syscall"
 )
 
 const (
@@ -29,10 +31,33 @@ const (
 	addrTypeNotSupported
 )
 
+// Replies a Dial function may choose with a ReplyError.
+const (
+	ServerFailureReply      = serverFailure
+	RuleFailureReply        = ruleFailure
+	NetworkUnreachableReply = networkUnreachable
+	HostUnreachableReply    = hostUnreachable
+	ConnectionRefusedReply  = connectionRefused
+	TTLExpiredReply         = ttlExpired
+)
+
 var (
 	unrecognizedAddrType = fmt.Errorf("Unrecognized address type")
 )
 
+// ReplyError is returned by a Dial function to choose the reply sent to the
+// client. Dial errors other than local network errors, such as failures
+// reported by the far end of a tunnel, get a general failure reply without
+// it.
+type ReplyError struct {
+	Reply uint8
+	Err   error
+}
+
+func (e *ReplyError) Error() string {
+	return e.Err.Error()
+}
+
 type AddrSpec struct {
 	FQDN string
 	IP   net.IP
@@ -53,8 +78,36 @@ func (a AddrSpec) Address() string {
 	return net.JoinHostPort(a.FQDN, strconv.Itoa(a.Port))
 }
 
+// AddressRewriter is used to transparently rewrite the destination of a
+// request.
+type AddressRewriter interface {
+	Rewrite(ctx context.Context, request *Request) (context.Context, *AddrSpec)
+}
+
 type Request struct {
+	// Version is the SOCKS version of the request, Socks4Version for
+	// SOCKS4 and SOCKS4a requests
+	Version uint8
+	// Command is the requested command
+	Command uint8
+	// AuthContext is the result of the authentication of the client
+	AuthContext *AuthContext
+	// RemoteAddr is the address of the client
+	RemoteAddr *AddrSpec
+	// DestAddr is the destination asked for by the client
 	DestAddr *AddrSpec
+	// realDestAddr is the destination actually connected to, it differs
+	// from DestAddr when an AddressRewriter is in use
+	realDestAddr *AddrSpec
+}
+
+type requestKey struct{}
+
+// RequestFrom returns the Request ctx belongs to, ctx is the context handed
+// to the Dial function and the server hooks.
+func RequestFrom(ctx context.Context) *Request {
+	r, _ := ctx.Value(requestKey{}).(*Request)
+	return r
 }
 
 func NewRequest(conn io.ReadWriter) (*Request, error) {
@@ -67,13 +120,6 @@ func NewRequest(conn io.ReadWriter) (*Request, error) {
 		return nil, fmt.Errorf("Unsupported command version: %d", header[0])
 	}
 
-	if header[1] != ConnectCommand {
-		if err := sendReply(conn, commandNotSupported, nil); err != nil {
-			return nil, fmt.Errorf("Failed to send reply: %s", err)
-		}
-		return nil, fmt.Errorf("Unsupported command: %d", header[1])
-	}
-
 	// Read in the destination address
 	dest, err := readAddrSpec(conn)
 	if err != nil {
@@ -81,23 +127,43 @@ func NewRequest(conn io.ReadWriter) (*Request, error) {
 	}
 
 	request := &Request{
+		Version:  Socks5Version,
+		Command:  header[1],
 		DestAddr: dest,
 	}
 
-	if err := sendReply(conn, successReply, dest); err != nil {
-		return nil, fmt.Errorf("Failed to send reply: %s", err)
-	}
-
 	return request, nil
 }
 
+// HandleConnect connects to the destination of req with a net.Dialer and
+// proxies conn to it. The reply is sent once the outcome of the dial is
+// known, NewRequest no longer sends it.
+//
+// Deprecated: Serve requests with a Server, which applies its Dial
+// function, rules and rewriter.
 func (req *Request) HandleConnect(conn io.ReadWriter) error {
-	forwardConn, err := net.Dial("tcp", req.DestAddr.Address())
+	if req.realDestAddr == nil {
+		req.realDestAddr = req.DestAddr
+	}
+	return (&Server{}).handleConnect(context.Background(), conn, req)
+}
+
+// handleConnect connects to the destination and proxies conn to it. The
+// reply is sent once the outcome of the dial is known.
+func (s *Server) handleConnect(ctx context.Context, conn io.ReadWriter, req *Request) error {
+	forwardConn, err := s.dial(ctx, "tcp", req.realDestAddr.Address())
 	if err != nil {
+		if err := req.reply(conn, replyCode(err), nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %s", err)
+		}
 		return fmt.Errorf("Connect to %v failed: %v", req.DestAddr, err)
 	}
 	defer forwardConn.Close()
 
+	if err := req.reply(conn, successReply, addrSpecOf(forwardConn.LocalAddr())); err != nil {
+		return fmt.Errorf("Failed to send reply: %s", err)
+	}
+
 	errCh := make(chan error, 2)
 	go proxy(forwardConn, conn, errCh)
 	go proxy(conn, forwardConn, errCh)
@@ -112,6 +178,91 @@ func (req *Request) HandleConnect(conn io.ReadWriter) error {
 	return nil
 }
 
+// errnoReplies maps the errors of a failed connect to reply codes.
+var errnoReplies = []struct {
+	errno syscall.Errno
+	code  uint8
+}{
+	{syscall.ECONNREFUSED, connectionRefused},
+	{syscall.ENETUNREACH, networkUnreachable},
+	{syscall.EHOSTUNREACH, hostUnreachable},
+	{syscall.EHOSTDOWN, hostUnreachable},
+	{syscall.ETIMEDOUT, ttlExpired},
+}
+
+// replyCode returns the reply code describing the dial error err.
+func replyCode(err error) uint8 {
+	if re, ok := err.(*ReplyError); ok {
+		return re.Reply
+	}
+	if err == context.DeadlineExceeded {
+		return ttlExpired
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ttlExpired
+	}
+
+	cause := err
+	for {
+		switch e := cause.(type) {
+		case *net.OpError:
+			cause = e.Err
+			continue
+		case *os.SyscallError:
+			cause = e.Err
+			continue
+		case *net.DNSError:
+			return hostUnreachable
+		}
+		break
+	}
+	if errno, ok := cause.(syscall.Errno); ok {
+		for _, r := range errnoReplies {
+			if errno == r.errno {
+				return r.code
+			}
+		}
+	}
+	return serverFailure
+}
+
+// ParseAddrSpec parses an address in host:port form, host is either an IP
+// address or a domain name.
+func ParseAddrSpec(hostport string) (*AddrSpec, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("Invalid port in address: %v", hostport)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return &AddrSpec{IP: ip, Port: port}, nil
+	}
+	return &AddrSpec{FQDN: host, Port: port}, nil
+}
+
+// addrSpecOf converts a net.Addr holding an IP address and port to an
+// AddrSpec. It returns nil if addr cannot be represented.
+func addrSpecOf(addr net.Addr) *AddrSpec {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return &AddrSpec{IP: a.IP, Port: a.Port}
+	case *net.UDPAddr:
+		return &AddrSpec{IP: a.IP, Port: a.Port}
+	}
+
+	spec, err := ParseAddrSpec(addr.String())
+	if err != nil || spec.IP == nil {
+		return nil
+	}
+	return spec
+}
+
 func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 	d := &AddrSpec{}
 
@@ -160,8 +311,10 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 	return d, nil
 }
 
-func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
-	// Format the address
+// formatAddrSpec encodes addr as address type, address and port the way
+// it appears in replies and UDP datagrams. A nil addr is encoded as the
+// IPv4 any address.
+func formatAddrSpec(addr *AddrSpec) ([]byte, error) {
 	var addrType uint8
 	var addrBody []byte
 	var addrPort uint16
@@ -187,22 +340,37 @@ func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
 		addrPort = uint16(addr.Port)
 
 	default:
-		return fmt.Errorf("Failed to format address: %v", addr)
+		return nil, fmt.Errorf("Failed to format address: %v", addr)
 	}
 
-	msg := make([]byte, 6+len(addrBody))
-	msg[0] = Socks5Version
-	msg[1] = resp
-	msg[2] = 0
-	msg[3] = addrType
-	copy(msg[4:], addrBody)
-	msg[4+len(addrBody)] = byte(addrPort >> 8)
-	msg[4+len(addrBody)+1] = byte(addrPort & 0xff)
+	msg := make([]byte, 3+len(addrBody))
+	msg[0] = addrType
+	copy(msg[1:], addrBody)
+	msg[1+len(addrBody)] = byte(addrPort >> 8)
+	msg[1+len(addrBody)+1] = byte(addrPort & 0xff)
+	return msg, nil
+}
 
-	_, err := w.Write(msg)
+func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	// Format the address
+	addrBody, err := formatAddrSpec(addr)
+	if err != nil {
+		return err
+	}
+
+	msg := append([]byte{Socks5Version, resp, 0}, addrBody...)
+	_, err = w.Write(msg)
 	return err
 }
 
+// reply sends a reply to req in the format of its SOCKS version.
+func (req *Request) reply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	if req.Version == Socks4Version {
+		return sendSocks4Reply(w, resp, addr)
+	}
+	return sendReply(w, resp, addr)
+}
+
 type closeWriter interface {
 	CloseWrite() error
 }
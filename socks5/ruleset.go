@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// RuleSet is used to provide custom rules to allow or prohibit actions
+type RuleSet interface {
+	Allow(ctx context.Context, req *Request) (context.Context, bool)
+}
+
+// RuleFunc adapts a function to the RuleSet interface
+type RuleFunc func(ctx context.Context, req *Request) (context.Context, bool)
+
+func (f RuleFunc) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return f(ctx, req)
+}
+
+// PermitAll returns a RuleSet which allows all types of connections
+func PermitAll() RuleSet {
+	return &PermitCommand{true, true, true}
+}
+
+// PermitNone returns a RuleSet which disallows all types of connections
+func PermitNone() RuleSet {
+	return &PermitCommand{false, false, false}
+}
+
+// PermitCommand is an implementation of the RuleSet which
+// enables filtering supported commands
+type PermitCommand struct {
+	EnableConnect   bool
+	EnableBind      bool
+	EnableAssociate bool
+}
+
+func (p *PermitCommand) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	switch req.Command {
+	case ConnectCommand:
+		return ctx, p.EnableConnect
+	case BindCommand:
+		return ctx, p.EnableBind
+	case AssociateCommand:
+		return ctx, p.EnableAssociate
+	}
+
+	return ctx, false
+}
+
+// PermitDestination is a RuleSet matching the destination of a request
+// against a list of networks and domains. A domain also matches all of its
+// subdomains. Matching requests are allowed and all others denied, Deny
+// reverses that decision.
+type PermitDestination struct {
+	Networks []*net.IPNet
+	Domains  []string
+	Deny     bool
+}
+
+func (p *PermitDestination) match(dest *AddrSpec) bool {
+	if dest.IP != nil {
+		for _, n := range p.Networks {
+			if n.Contains(dest.IP) {
+				return true
+			}
+		}
+	}
+
+	fqdn := strings.ToLower(strings.TrimSuffix(dest.FQDN, "."))
+	if fqdn == "" {
+		return false
+	}
+	for _, d := range p.Domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if fqdn == d || strings.HasSuffix(fqdn, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PermitDestination) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	dest := req.realDestAddr
+	if dest == nil {
+		dest = req.DestAddr
+	}
+	return ctx, p.match(dest) != p.Deny
+}
+
+// AllRules combines rule sets, a request is only allowed if every one of
+// them allows it.
+func AllRules(rules ...RuleSet) RuleSet {
+	return RuleFunc(func(ctx context.Context, req *Request) (context.Context, bool) {
+		for _, r := range rules {
+			var ok bool
+			if ctx, ok = r.Allow(ctx, req); !ok {
+				return ctx, false
+			}
+		}
+		return ctx, true
+	})
+}
@@ -0,0 +1,138 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	Socks4Version = uint8(4)
+
+	// socks4ReplyVersion is the version byte of SOCKS4 replies
+	socks4ReplyVersion = uint8(0)
+
+	// maxSocks4Field bounds the length of the USERID and hostname fields
+	maxSocks4Field = 255
+)
+
+const (
+	socks4Granted  = uint8(90)
+	socks4Rejected = uint8(91)
+)
+
+// newSocks4Request reads a SOCKS4 or SOCKS4a request from r, the version
+// byte has already been consumed. The request is
+// CD(1) DSTPORT(2) DSTIP(4) USERID NUL, followed by HOSTNAME NUL for SOCKS4a
+// requests, which carry an address of the form 0.0.0.x with x non zero.
+func newSocks4Request(r io.Reader) (*Request, string, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, "", fmt.Errorf("Failed to get SOCKS4 request: %v", err)
+	}
+
+	userID, err := readNulString(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to get SOCKS4 user ID: %v", err)
+	}
+
+	dest := &AddrSpec{
+		IP:   net.IPv4(header[3], header[4], header[5], header[6]),
+		Port: (int(header[1]) << 8) | int(header[2]),
+	}
+	if header[3] == 0 && header[4] == 0 && header[5] == 0 && header[6] != 0 {
+		host, err := readNulString(r)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to get SOCKS4a hostname: %v", err)
+		}
+		dest.IP = nil
+		dest.FQDN = host
+	}
+
+	request := &Request{
+		Version:  Socks4Version,
+		Command:  header[0],
+		DestAddr: dest,
+	}
+	return request, userID, nil
+}
+
+// readNulString reads a NUL terminated string of at most maxSocks4Field
+// bytes. It reads one byte at a time so that nothing past the terminator
+// is consumed.
+func readNulString(r io.Reader) (string, error) {
+	var b []byte
+	c := []byte{0}
+	for {
+		if _, err := io.ReadFull(r, c); err != nil {
+			return "", err
+		}
+		if c[0] == 0 {
+			return string(b), nil
+		}
+		if len(b) == maxSocks4Field {
+			return "", fmt.Errorf("Field longer than %d bytes", maxSocks4Field)
+		}
+		b = append(b, c[0])
+	}
+}
+
+// serveSocks4 serves a SOCKS4 or SOCKS4a connection. SOCKS4 has no means
+// of authentication, so it is only served when the server accepts clients
+// without authentication. The USERID of the request is made available as
+// the "UserID" payload of the AuthContext.
+func (s *Server) serveSocks4(conn net.Conn) error {
+	request, userID, err := newSocks4Request(conn)
+	if err != nil {
+		return err
+	}
+	request.AuthContext = &AuthContext{NoAuth, map[string]string{"UserID": userID}}
+	request.RemoteAddr = addrSpecOf(conn.RemoteAddr())
+
+	if !s.allowsNoAuth() {
+		if err := request.reply(conn, ruleFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("SOCKS4 request from %v rejected, authentication is required", conn.RemoteAddr())
+	}
+
+	if request.Command != ConnectCommand && request.Command != BindCommand {
+		if err := request.reply(conn, commandNotSupported, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Unsupported SOCKS4 command: %v", request.Command)
+	}
+
+	return s.handleRequest(request, conn)
+}
+
+// allowsNoAuth reports whether clients may connect without authenticating.
+func (s *Server) allowsNoAuth() bool {
+	for _, auth := range s.authMethods() {
+		if auth.GetCode() == NoAuth {
+			return true
+		}
+	}
+	return false
+}
+
+// sendSocks4Reply writes a SOCKS4 reply. SOCKS4 only distinguishes between
+// granted and rejected requests, and can only carry IPv4 addresses; other
+// addresses are sent as 0.0.0.0:0.
+func sendSocks4Reply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	code := socks4Rejected
+	if resp == successReply {
+		code = socks4Granted
+	}
+
+	msg := make([]byte, 8)
+	msg[0] = socks4ReplyVersion
+	msg[1] = code
+	if addr != nil && addr.IP.To4() != nil {
+		msg[2] = byte(addr.Port >> 8)
+		msg[3] = byte(addr.Port & 0xff)
+		copy(msg[4:], addr.IP.To4())
+	}
+	_, err := w.Write(msg)
+	return err
+}
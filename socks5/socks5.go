@@ -1,9 +1,11 @@
 package socks5
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
+	"time"
 )
 
 const (
@@ -11,7 +13,49 @@ const (
 	NoAuth        = uint8(0)
 )
 
+// DialFunc connects to addr on the named network.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
 type Server struct {
+	// AuthMethods are the authentication methods offered to clients in
+	// order of preference. If it is empty, user/pass authentication is
+	// used when Credentials is set and no authentication otherwise.
+	AuthMethods []Authenticator
+
+	// Credentials validates users for the default user/pass method.
+	Credentials CredentialStore
+
+	// Dial is used to connect to the destination of CONNECT requests,
+	// net.Dialer is used if it is nil.
+	Dial DialFunc
+
+	// Forwarder opens the socket used to relay the datagrams of UDP
+	// associations, ListenPacket is used if it is nil.
+	Forwarder PacketForwarder
+
+	// Bind opens the listener for BIND requests, by default the server
+	// listens on the address the client connected to.
+	Bind BindFunc
+
+	// BindTimeout bounds the wait for the incoming connection of a BIND
+	// request, DefaultBindTimeout is used if it is zero.
+	BindTimeout time.Duration
+
+	// Resolver resolves FQDN destinations before they are dialed. If it is
+	// nil the name is handed to Dial unresolved, so that it can be
+	// resolved on the far side of a tunnel.
+	Resolver NameResolver
+
+	// Rules decides which requests are served, all requests are allowed
+	// if it is nil.
+	Rules RuleSet
+
+	// Rewriter may change the destination of a request transparently.
+	Rewriter AddressRewriter
+
+	// Logger receives error messages, the standard logger is used if it
+	// is nil.
+	Logger *log.Logger
 }
 
 // ListenAndServe is used to create a listener and serve on it
@@ -32,7 +76,6 @@ func (s *Server) Serve(l net.Listener) error {
 		}
 		go s.ServeConn(conn)
 	}
-	return nil
 }
 
 func (s *Server) ServeConn(conn net.Conn) error {
@@ -40,27 +83,115 @@ func (s *Server) ServeConn(conn net.Conn) error {
 
 	version := []byte{0}
 	if _, err := conn.Read(version); err != nil {
-		log.Printf(fmt.Sprintf("[ERR]: %v \n", err))
+		s.logf("[ERR] socks: Failed to get version byte: %v", err)
 		return err
 	}
 
+	if version[0] == Socks4Version {
+		if err := s.serveSocks4(conn); err != nil {
+			s.logf("[ERR] socks: %v", err)
+			return err
+		}
+		return nil
+	}
+
 	if version[0] != Socks5Version {
 		err := fmt.Errorf("Unsupported SOCKS version: %v", version)
-		log.Printf("[ERR]: %s \n", err)
+		s.logf("[ERR] socks: %v", err)
 		return err
 	}
 
-	// NoAuth
-	_, err := conn.Write([]byte{Socks5Version, NoAuth})
+	authContext, err := s.authenticate(conn)
 	if err != nil {
-		log.Println(err)
+		err = fmt.Errorf("Failed to authenticate %v: %v", conn.RemoteAddr(), err)
+		s.logf("[ERR] socks: %v", err)
 		return err
 	}
 
 	request, err := NewRequest(conn)
 	if err != nil {
+		if err == unrecognizedAddrType {
+			if err := sendReply(conn, addrTypeNotSupported, nil); err != nil {
+				err = fmt.Errorf("Failed to send reply: %v", err)
+				s.logf("[ERR] socks: %v", err)
+				return err
+			}
+		}
+		s.logf("[ERR] socks: %v", err)
 		return err
 	}
+	request.AuthContext = authContext
+	request.RemoteAddr = addrSpecOf(conn.RemoteAddr())
 
-	return request.HandleConnect(conn)
+	if err := s.handleRequest(request, conn); err != nil {
+		s.logf("[ERR] socks: %v", err)
+		return err
+	}
+	return nil
+}
+
+// handleRequest applies the resolver, rules and rewriter to req and then
+// serves it.
+func (s *Server) handleRequest(req *Request, conn net.Conn) error {
+	ctx := context.WithValue(context.Background(), authContextKey{}, req.AuthContext)
+	ctx = context.WithValue(ctx, requestKey{}, req)
+
+	dest := req.DestAddr
+	if dest.FQDN != "" && s.Resolver != nil {
+		var addr net.IP
+		var err error
+		ctx, addr, err = s.Resolver.Resolve(ctx, dest.FQDN)
+		if err != nil {
+			if err := req.reply(conn, hostUnreachable, nil); err != nil {
+				return fmt.Errorf("Failed to send reply: %v", err)
+			}
+			return fmt.Errorf("Failed to resolve destination '%v': %v", dest.FQDN, err)
+		}
+		dest.IP = addr
+	}
+
+	req.realDestAddr = req.DestAddr
+	if s.Rewriter != nil {
+		ctx, req.realDestAddr = s.Rewriter.Rewrite(ctx, req)
+	}
+
+	if s.Rules != nil {
+		var ok bool
+		if ctx, ok = s.Rules.Allow(ctx, req); !ok {
+			if err := req.reply(conn, ruleFailure, nil); err != nil {
+				return fmt.Errorf("Failed to send reply: %v", err)
+			}
+			return fmt.Errorf("Request from %q to %v blocked by rules", req.AuthContext.Username(), req.DestAddr)
+		}
+	}
+
+	switch req.Command {
+	case ConnectCommand:
+		return s.handleConnect(ctx, conn, req)
+	case BindCommand:
+		return s.handleBind(ctx, conn, req)
+	case AssociateCommand:
+		return s.handleAssociate(ctx, conn, req)
+	default:
+		if err := req.reply(conn, commandNotSupported, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Unsupported command: %v", req.Command)
+	}
+}
+
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if s.Dial != nil {
+		return s.Dial(ctx, network, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
 }
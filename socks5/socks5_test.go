@@ -1,10 +1,517 @@
 package socks5
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestSOCKS5_Connect(t *testing.T) {
 	server := &Server{}
 	server.ListenAndServe("::3980")
 }
+
+// boundConn is an in-memory connection with a TCP local address.
+type boundConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c *boundConn) LocalAddr() net.Addr { return c.local }
+
+func dialError(errno syscall.Errno) error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+}
+
+func TestSOCKS5_Replies(t *testing.T) {
+	bound := &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 4567}
+	connectIPv4 := []byte{Socks5Version, ConnectCommand, 0, ipv4Address, 192, 0, 2, 1, 0, 80}
+
+	tests := []struct {
+		name    string
+		request []byte
+		dialErr error
+		rules   RuleSet
+		code    uint8
+		addr    []byte
+	}{
+		{name: "success", request: connectIPv4, code: successReply,
+			addr: []byte{ipv4Address, 10, 1, 2, 3, 0x11, 0xd7}},
+		{name: "general failure", request: connectIPv4, dialErr: errors.New("transport is closing"), code: serverFailure},
+		{name: "rules", request: connectIPv4, rules: PermitNone(), code: ruleFailure},
+		{name: "network unreachable", request: connectIPv4, dialErr: dialError(syscall.ENETUNREACH), code: networkUnreachable},
+		{name: "host unreachable", request: connectIPv4, dialErr: dialError(syscall.EHOSTUNREACH), code: hostUnreachable},
+		{name: "unknown host", request: connectIPv4, dialErr: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.invalid"}}, code: hostUnreachable},
+		{name: "connection refused", request: connectIPv4, dialErr: dialError(syscall.ECONNREFUSED), code: connectionRefused},
+		{name: "refused through tunnel", request: connectIPv4,
+			dialErr: &ReplyError{Reply: ConnectionRefusedReply, Err: errors.New("rpc error: code = Unavailable desc = dial tcp 192.0.2.1:80: connect: connection refused")}, code: connectionRefused},
+		{name: "error text is not interpreted", request: connectIPv4,
+			dialErr: errors.New("rpc error: code = Unavailable desc = dial tcp 192.0.2.1:80: connect: connection refused"), code: serverFailure},
+		{name: "denied by server policy", request: connectIPv4,
+			dialErr: &ReplyError{Reply: RuleFailureReply, Err: errors.New("rpc error: code = PermissionDenied desc = denied by policy: 192.0.2.1:80: PRIVATE")}, code: ruleFailure},
+		{name: "timeout", request: connectIPv4, dialErr: context.DeadlineExceeded, code: ttlExpired},
+		{name: "command not supported", request: []byte{Socks5Version, 9, 0, ipv4Address, 192, 0, 2, 1, 0, 80}, code: commandNotSupported},
+		{name: "address type not supported", request: []byte{Socks5Version, ConnectCommand, 0, 9, 192, 0, 2, 1, 0, 80}, code: addrTypeNotSupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &Server{
+				Rules:  tt.rules,
+				Logger: log.New(ioutil.Discard, "", 0),
+				Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					if tt.dialErr != nil {
+						return nil, tt.dialErr
+					}
+					local, remote := net.Pipe()
+					go remote.Close()
+					return &boundConn{Conn: local, local: bound}, nil
+				},
+			}
+
+			client, conn := net.Pipe()
+			defer client.Close()
+			go server.ServeConn(conn)
+
+			if _, err := client.Write([]byte{Socks5Version, 1, NoAuth}); err != nil {
+				t.Fatal(err)
+			}
+			method := make([]byte, 2)
+			if _, err := io.ReadFull(client, method); err != nil {
+				t.Fatal(err)
+			}
+			// The server may reply before it has read the whole request
+			go client.Write(tt.request)
+
+			reply := make([]byte, 10)
+			if _, err := io.ReadFull(client, reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply[1] != tt.code {
+				t.Errorf("reply code = %d, want %d", reply[1], tt.code)
+			}
+
+			addr := tt.addr
+			if addr == nil {
+				addr = []byte{ipv4Address, 0, 0, 0, 0, 0, 0}
+			}
+			if !bytes.Equal(reply[3:], addr) {
+				t.Errorf("reply address = %v, want %v", reply[3:], addr)
+			}
+		})
+	}
+}
+
+// newTestServer returns a server whose Dial connects to an in-memory
+// connection bound to bound, or fails with dialErr. The address and
+// context of every dial are sent to dials.
+func newTestServer(bound net.Addr, dialErr error, dials chan<- dialed) *Server {
+	return &Server{
+		Logger: log.New(ioutil.Discard, "", 0),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if dials != nil {
+				dials <- dialed{ctx, addr}
+			}
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			local, remote := net.Pipe()
+			go remote.Close()
+			return &boundConn{Conn: local, local: bound}, nil
+		},
+	}
+}
+
+type dialed struct {
+	ctx  context.Context
+	addr string
+}
+
+// exchange writes req to conn and reads a reply of n bytes.
+func exchange(t *testing.T, conn net.Conn, req []byte, n int) []byte {
+	t.Helper()
+	// The server may reply before it has read the whole request
+	go conn.Write(req)
+	reply := make([]byte, n)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("reading reply to %v: %v", req, err)
+	}
+	return reply
+}
+
+// expectClosed checks that the server closed conn without writing.
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read %d bytes, %v from connection, want it closed", n, err)
+	}
+}
+
+func TestSOCKS5_Auth(t *testing.T) {
+	userPass := func(user, pass string) []byte {
+		b := append([]byte{userAuthVersion, byte(len(user))}, user...)
+		return append(append(b, byte(len(pass))), pass...)
+	}
+	connect := []byte{Socks5Version, ConnectCommand, 0, ipv4Address, 192, 0, 2, 1, 0, 80}
+
+	tests := []struct {
+		name        string
+		credentials CredentialStore
+		methods     []byte
+		method      uint8
+		auth        []byte
+		status      []byte
+		user        string
+	}{
+		{name: "no authentication", methods: []byte{NoAuth}, method: NoAuth},
+		{name: "no authentication among others", methods: []byte{UserPassAuth, NoAuth}, method: NoAuth},
+		{name: "no acceptable method", methods: []byte{UserPassAuth}, method: noAcceptable},
+		{name: "no method offered", methods: []byte{}, method: noAcceptable},
+		{name: "authentication required", credentials: StaticCredentials{"alice": "secret"},
+			methods: []byte{NoAuth}, method: noAcceptable},
+		{name: "valid password", credentials: StaticCredentials{"alice": "secret"},
+			methods: []byte{NoAuth, UserPassAuth}, method: UserPassAuth,
+			auth: userPass("alice", "secret"), status: []byte{userAuthVersion, authSuccess}, user: "alice"},
+		{name: "wrong password", credentials: StaticCredentials{"alice": "secret"},
+			methods: []byte{UserPassAuth}, method: UserPassAuth,
+			auth: userPass("alice", "guess"), status: []byte{userAuthVersion, authFailure}},
+		{name: "unknown user", credentials: StaticCredentials{"alice": "secret"},
+			methods: []byte{UserPassAuth}, method: UserPassAuth,
+			auth: userPass("bob", "secret"), status: []byte{userAuthVersion, authFailure}},
+		{name: "unsupported auth version", credentials: StaticCredentials{"alice": "secret"},
+			methods: []byte{UserPassAuth}, method: UserPassAuth, auth: []byte{5, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dials := make(chan dialed, 1)
+			server := newTestServer(&net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 4567}, nil, dials)
+			server.Credentials = tt.credentials
+
+			client, conn := net.Pipe()
+			defer client.Close()
+			go server.ServeConn(conn)
+
+			greeting := append([]byte{Socks5Version, byte(len(tt.methods))}, tt.methods...)
+			if reply := exchange(t, client, greeting, 2); reply[0] != Socks5Version || reply[1] != tt.method {
+				t.Fatalf("method reply = %v, want method %d", reply, tt.method)
+			}
+			if tt.method == noAcceptable {
+				expectClosed(t, client)
+				return
+			}
+
+			if tt.auth != nil {
+				if tt.status == nil {
+					go client.Write(tt.auth)
+					expectClosed(t, client)
+					return
+				}
+				if status := exchange(t, client, tt.auth, 2); !bytes.Equal(status, tt.status) {
+					t.Fatalf("auth status = %v, want %v", status, tt.status)
+				}
+				if tt.status[1] != authSuccess {
+					expectClosed(t, client)
+					return
+				}
+			}
+
+			if reply := exchange(t, client, connect, 10); reply[1] != successReply {
+				t.Fatalf("reply code = %d, want success", reply[1])
+			}
+			d := <-dials
+			if got := AuthContextFrom(d.ctx).Username(); got != tt.user {
+				t.Errorf("user of the request = %q, want %q", got, tt.user)
+			}
+		})
+	}
+}
+
+func TestSOCKS4(t *testing.T) {
+	bound := &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 4567}
+
+	tests := []struct {
+		name        string
+		request     []byte
+		credentials CredentialStore
+		dialErr     error
+		code        uint8
+		addr        string
+		userID      string
+	}{
+		{name: "connect", request: []byte{Socks4Version, ConnectCommand, 0, 80, 192, 0, 2, 1, 'b', 'o', 'b', 0},
+			code: socks4Granted, addr: "192.0.2.1:80", userID: "bob"},
+		{name: "socks4a", request: []byte{Socks4Version, ConnectCommand, 0x1f, 0x90, 0, 0, 0, 1, 0, 'e', 'x', '.', 'c', 'o', 'm', 0},
+			code: socks4Granted, addr: "ex.com:8080"},
+		{name: "address 0.0.0.0 is not socks4a", request: []byte{Socks4Version, ConnectCommand, 0, 80, 0, 0, 0, 0, 0},
+			code: socks4Granted, addr: "0.0.0.0:80"},
+		{name: "dial failure", request: []byte{Socks4Version, ConnectCommand, 0, 80, 192, 0, 2, 1, 0},
+			dialErr: dialError(syscall.ECONNREFUSED), code: socks4Rejected, addr: "192.0.2.1:80"},
+		{name: "authentication required", request: []byte{Socks4Version, ConnectCommand, 0, 80, 192, 0, 2, 1, 0},
+			credentials: StaticCredentials{"alice": "secret"}, code: socks4Rejected},
+		{name: "command not supported", request: []byte{Socks4Version, AssociateCommand, 0, 80, 192, 0, 2, 1, 0},
+			code: socks4Rejected},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dials := make(chan dialed, 1)
+			server := newTestServer(bound, tt.dialErr, dials)
+			server.Credentials = tt.credentials
+
+			client, conn := net.Pipe()
+			defer client.Close()
+			go server.ServeConn(conn)
+
+			reply := exchange(t, client, tt.request, 8)
+			if reply[0] != socks4ReplyVersion || reply[1] != tt.code {
+				t.Errorf("reply = %v, want code %d", reply, tt.code)
+			}
+			if tt.code == socks4Granted && !bytes.Equal(reply[2:], []byte{0x11, 0xd7, 10, 1, 2, 3}) {
+				t.Errorf("reply address = %v, want 10.1.2.3:4567", reply[2:])
+			}
+
+			var d dialed
+			select {
+			case d = <-dials:
+			default:
+			}
+			if d.addr != tt.addr {
+				t.Errorf("dialed %q, want %q", d.addr, tt.addr)
+			}
+			if d.ctx != nil {
+				if got := AuthContextFrom(d.ctx).Payload["UserID"]; got != tt.userID {
+					t.Errorf("user ID = %q, want %q", got, tt.userID)
+				}
+			}
+		})
+	}
+}
+
+func TestDatagram(t *testing.T) {
+	tests := []struct {
+		src  *AddrSpec
+		want []byte
+	}{
+		{src: &AddrSpec{IP: net.IPv4(192, 0, 2, 1), Port: 53},
+			want: []byte{0, 0, 0, ipv4Address, 192, 0, 2, 1, 0, 53, 'h', 'i'}},
+		{src: &AddrSpec{IP: net.ParseIP("2001:db8::1"), Port: 53},
+			want: []byte{0, 0, 0, ipv6Address, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53, 'h', 'i'}},
+		{src: &AddrSpec{FQDN: "ex.com", Port: 53},
+			want: []byte{0, 0, 0, fqdnAddress, 6, 'e', 'x', '.', 'c', 'o', 'm', 0, 53, 'h', 'i'}},
+	}
+	for _, tt := range tests {
+		b, err := buildDatagram(tt.src, []byte("hi"))
+		if err != nil {
+			t.Errorf("buildDatagram from %v: %v", tt.src, err)
+			continue
+		}
+		if !bytes.Equal(b, tt.want) {
+			t.Errorf("buildDatagram from %v = %v, want %v", tt.src, b, tt.want)
+		}
+
+		frag, dest, data, err := parseDatagram(b)
+		if err != nil || frag != 0 || dest.Address() != tt.src.Address() || string(data) != "hi" {
+			t.Errorf("parseDatagram(%v) = %d, %v, %q, %v", b, frag, dest, data, err)
+		}
+	}
+
+	frag, _, _, err := parseDatagram([]byte{0, 0, 1, ipv4Address, 192, 0, 2, 1, 0, 53})
+	if err != nil || frag != 1 {
+		t.Errorf("parseDatagram of a fragment = %d, %v, want fragment 1", frag, err)
+	}
+	for _, b := range [][]byte{
+		{0, 0, 0},
+		{0, 0, 0, ipv4Address, 192, 0, 2},
+		{0, 0, 0, 9, 192, 0, 2, 1, 0, 53},
+	} {
+		if _, _, _, err := parseDatagram(b); err == nil {
+			t.Errorf("parseDatagram(%v) succeeded", b)
+		}
+	}
+}
+
+func TestAssociation_Accept(t *testing.T) {
+	udp := func(ip string, port int) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+	}
+
+	tests := []struct {
+		name   string
+		client *net.UDPAddr
+		from   []*net.UDPAddr
+		want   []bool
+	}{
+		{name: "announced address", client: udp("192.0.2.1", 5000),
+			from: []*net.UDPAddr{udp("192.0.2.1", 5000), udp("192.0.2.1", 5001), udp("192.0.2.2", 5000)},
+			want: []bool{true, false, false}},
+		{name: "port learned from the first datagram", client: udp("192.0.2.1", 0),
+			from: []*net.UDPAddr{udp("192.0.2.2", 5000), udp("192.0.2.1", 5000), udp("192.0.2.1", 5001), udp("192.0.2.1", 5000)},
+			want: []bool{false, true, false, true}},
+		{name: "unspecified address", client: udp("0.0.0.0", 0),
+			from: []*net.UDPAddr{udp("192.0.2.2", 5000), udp("192.0.2.1", 5000)},
+			want: []bool{true, false}},
+		{name: "unknown client", client: nil,
+			from: []*net.UDPAddr{udp("192.0.2.1", 5000), udp("192.0.2.1", 5000), udp("192.0.2.2", 5000)},
+			want: []bool{true, true, false}},
+	}
+	for _, tt := range tests {
+		a := &association{client: tt.client}
+		for i, from := range tt.from {
+			if got := a.accept(from); got != tt.want[i] {
+				t.Errorf("%s: datagram %d from %v accepted %v, want %v", tt.name, i, from, got, tt.want[i])
+			}
+		}
+	}
+}
+
+// chanListener is a BindListener accepting the connections sent to conns.
+type chanListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newChanListener() *chanListener {
+	return &chanListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 9), Port: 5000}
+}
+
+// remoteConn is an in-memory connection with a TCP remote address.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+// peerConn returns a connection from addr for l to accept and the end of
+// the peer.
+func peerConn(addr string) (net.Conn, net.Conn) {
+	local, peer := net.Pipe()
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+	return &remoteConn{Conn: local, remote: tcpAddr}, peer
+}
+
+func TestSOCKS5_Bind(t *testing.T) {
+	bind := []byte{Socks5Version, BindCommand, 0, ipv4Address, 192, 0, 2, 1, 0, 80}
+
+	t.Run("relay", func(t *testing.T) {
+		l := newChanListener()
+		server := &Server{
+			Logger: log.New(ioutil.Discard, "", 0),
+			Bind:   func(context.Context, *Request) (BindListener, error) { return l, nil },
+		}
+		client, conn := net.Pipe()
+		defer client.Close()
+		go server.ServeConn(conn)
+
+		exchange(t, client, []byte{Socks5Version, 1, NoAuth}, 2)
+		first := exchange(t, client, bind, 10)
+		if want := []byte{Socks5Version, successReply, 0, ipv4Address, 192, 0, 2, 9, 0x13, 0x88}; !bytes.Equal(first, want) {
+			t.Fatalf("first reply = %v, want %v", first, want)
+		}
+
+		// Connections from other hosts are refused
+		stranger, strangerPeer := peerConn("198.51.100.1:4000")
+		l.conns <- stranger
+		expectClosed(t, strangerPeer)
+
+		accepted, peer := peerConn("192.0.2.1:4000")
+		defer peer.Close()
+		l.conns <- accepted
+		second := make([]byte, 10)
+		if _, err := io.ReadFull(client, second); err != nil {
+			t.Fatal(err)
+		}
+		if want := []byte{Socks5Version, successReply, 0, ipv4Address, 192, 0, 2, 1, 0x0f, 0xa0}; !bytes.Equal(second, want) {
+			t.Fatalf("second reply = %v, want %v", second, want)
+		}
+
+		go peer.Write([]byte("ping"))
+		if b := make([]byte, 4); readFull(t, client, b) != "ping" {
+			t.Errorf("client read %q, want ping", b)
+		}
+		go client.Write([]byte("pong"))
+		if b := make([]byte, 4); readFull(t, peer, b) != "pong" {
+			t.Errorf("peer read %q, want pong", b)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		l := newChanListener()
+		server := &Server{
+			Logger:      log.New(ioutil.Discard, "", 0),
+			Bind:        func(context.Context, *Request) (BindListener, error) { return l, nil },
+			BindTimeout: 10 * time.Millisecond,
+		}
+		client, conn := net.Pipe()
+		defer client.Close()
+		go server.ServeConn(conn)
+
+		exchange(t, client, []byte{Socks5Version, 1, NoAuth}, 2)
+		if first := exchange(t, client, bind, 10); first[1] != successReply {
+			t.Fatalf("first reply code = %d, want success", first[1])
+		}
+		second := make([]byte, 10)
+		if _, err := io.ReadFull(client, second); err != nil {
+			t.Fatal(err)
+		}
+		if second[1] != serverFailure {
+			t.Errorf("second reply code after the timeout = %d, want %d", second[1], serverFailure)
+		}
+		expectClosed(t, client)
+	})
+
+	t.Run("listen failure", func(t *testing.T) {
+		server := &Server{
+			Logger: log.New(ioutil.Discard, "", 0),
+			Bind: func(context.Context, *Request) (BindListener, error) {
+				return nil, errors.New("no listener")
+			},
+		}
+		client, conn := net.Pipe()
+		defer client.Close()
+		go server.ServeConn(conn)
+
+		exchange(t, client, []byte{Socks5Version, 1, NoAuth}, 2)
+		if first := exchange(t, client, bind, 10); first[1] != serverFailure {
+			t.Errorf("reply code = %d, want %d", first[1], serverFailure)
+		}
+		expectClosed(t, client)
+	})
+}
+
+func readFull(t *testing.T, r io.Reader, b []byte) string {
+	t.Helper()
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,232 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// maxDatagramSize is the largest UDP datagram relayed for a client.
+const maxDatagramSize = 65535
+
+// PacketConn sends and receives the datagrams of one UDP association.
+type PacketConn interface {
+	// ReadFrom reads a datagram and returns the address it came from.
+	ReadFrom(b []byte) (int, *AddrSpec, error)
+	// WriteTo sends a datagram to addr.
+	WriteTo(b []byte, addr *AddrSpec) (int, error)
+	Close() error
+}
+
+// PacketForwarder opens the PacketConn used to relay the datagrams of the
+// UDP association requested by req.
+type PacketForwarder func(ctx context.Context, req *Request) (PacketConn, error)
+
+// directPacketConn relays datagrams through a local UDP socket.
+type directPacketConn struct {
+	conn *net.UDPConn
+}
+
+// ListenPacket is the default PacketForwarder, it relays datagrams from an
+// unconnected local UDP socket.
+func ListenPacket(ctx context.Context, req *Request) (PacketConn, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &directPacketConn{conn: conn}, nil
+}
+
+func (d *directPacketConn) ReadFrom(b []byte) (int, *AddrSpec, error) {
+	n, addr, err := d.conn.ReadFromUDP(b)
+	if err != nil {
+		return n, nil, err
+	}
+	return n, &AddrSpec{IP: addr.IP, Port: addr.Port}, nil
+}
+
+func (d *directPacketConn) WriteTo(b []byte, addr *AddrSpec) (int, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr.Address())
+	if err != nil {
+		return 0, err
+	}
+	return d.conn.WriteToUDP(b, udpAddr)
+}
+
+func (d *directPacketConn) Close() error {
+	return d.conn.Close()
+}
+
+// parseDatagram splits a client datagram into its header fields and data.
+// The header is RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT.
+func parseDatagram(b []byte) (frag uint8, dest *AddrSpec, data []byte, err error) {
+	if len(b) < 4 {
+		return 0, nil, nil, fmt.Errorf("Short UDP datagram: %d bytes", len(b))
+	}
+
+	r := bytes.NewReader(b[3:])
+	dest, err = readAddrSpec(r)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return b[2], dest, b[len(b)-r.Len():], nil
+}
+
+// buildDatagram prefixes data with the UDP header for a datagram from src.
+func buildDatagram(src *AddrSpec, data []byte) ([]byte, error) {
+	addr, err := formatAddrSpec(src)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, 0, 3+len(addr)+len(data))
+	msg = append(msg, 0, 0, 0)
+	msg = append(msg, addr...)
+	return append(msg, data...), nil
+}
+
+// handleAssociate relays datagrams between the client and the destinations
+// it addresses until the control connection is closed.
+func (s *Server) handleAssociate(ctx context.Context, conn net.Conn, req *Request) error {
+	// Listen on the address the client reached us on
+	bindIP := net.IPv4zero
+	if local := addrSpecOf(conn.LocalAddr()); local != nil {
+		bindIP = local.IP
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: bindIP})
+	if err != nil {
+		if err := sendReply(conn, serverFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Failed to open UDP relay: %v", err)
+	}
+	defer relay.Close()
+
+	forward := s.Forwarder
+	if forward == nil {
+		forward = ListenPacket
+	}
+	target, err := forward(ctx, req)
+	if err != nil {
+		if err := sendReply(conn, serverFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Failed to open UDP forwarder: %v", err)
+	}
+	defer target.Close()
+
+	if err := sendReply(conn, successReply, addrSpecOf(relay.LocalAddr())); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	a := &association{
+		server: s,
+		relay:  relay,
+		target: target,
+	}
+	// Only datagrams from the client's host are relayed, and from the port
+	// it announced if it did.
+	if req.RemoteAddr != nil {
+		a.client = &net.UDPAddr{IP: req.RemoteAddr.IP, Port: req.DestAddr.Port}
+	}
+
+	go a.clientToTarget()
+	go a.targetToClient()
+
+	// The association lives as long as the control connection
+	_, err = io.Copy(ioutil.Discard, conn)
+	return err
+}
+
+type association struct {
+	server *Server
+	relay  *net.UDPConn
+	target PacketConn
+
+	mu     sync.Mutex
+	client *net.UDPAddr
+}
+
+// accept reports whether a datagram from addr belongs to the client and
+// learns the client's host and port from its first datagram if they are
+// not known.
+func (a *association) accept(addr *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.client == nil {
+		a.client = &net.UDPAddr{}
+	}
+	if a.client.IP == nil || a.client.IP.IsUnspecified() {
+		a.client.IP = addr.IP
+	}
+	if !a.client.IP.Equal(addr.IP) {
+		return false
+	}
+	if a.client.Port == 0 {
+		a.client.Port = addr.Port
+	}
+	return a.client.Port == addr.Port
+}
+
+func (a *association) clientAddr() *net.UDPAddr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client == nil || a.client.Port == 0 {
+		return nil
+	}
+	return a.client
+}
+
+func (a *association) clientToTarget() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !a.accept(from) {
+			continue
+		}
+
+		frag, dest, data, err := parseDatagram(buf[:n])
+		if err != nil {
+			a.server.logf("[ERR] socks: Dropping UDP datagram: %v", err)
+			continue
+		}
+		// Fragmentation is not supported, fragments are dropped
+		if frag != 0 {
+			continue
+		}
+
+		if _, err := a.target.WriteTo(data, dest); err != nil {
+			a.server.logf("[ERR] socks: Failed to relay UDP datagram to %v: %v", dest, err)
+		}
+	}
+}
+
+func (a *association) targetToClient() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, src, err := a.target.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		client := a.clientAddr()
+		if client == nil {
+			continue
+		}
+		msg, err := buildDatagram(src, buf[:n])
+		if err != nil {
+			continue
+		}
+		if _, err := a.relay.WriteToUDP(msg, client); err != nil {
+			return
+		}
+	}
+}
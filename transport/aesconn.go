@@ -94,18 +94,29 @@ type Listener struct {
 }
 
 func (l *Listener) Accept() (net.Conn, error) {
-	conn, err := l.listener.Accept()
-	if err != nil {
-		return nil, err
-	}
-	err = conn.SetReadDeadline(time.Now().Add(constants.ConnTimeout))
-	if err != nil {
-		return nil, err
-	}
-
+	var conn net.Conn
 	ivVector := make([]byte, constants.IVLength)
-	if _, err := io.ReadFull(conn, ivVector); err != nil {
-		log.Fatal(err)
+	for {
+		var err error
+		conn, err = l.listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		err = conn.SetReadDeadline(time.Now().Add(constants.ConnTimeout))
+		if err != nil {
+			return nil, err
+		}
+
+		// Connections closed before sending anything, such as health
+		// checks, are dropped silently.
+		if _, err := io.ReadFull(conn, ivVector); err != nil {
+			if err != io.EOF {
+				log.Printf("transport: handshake with %v failed: %v", conn.RemoteAddr(), err)
+			}
+			conn.Close()
+			continue
+		}
+		break
 	}
 
 	password := sha256.Sum256([]byte(l.key))
@@ -135,12 +146,16 @@ func Listen(listenAddress string, key string) (*Listener, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewListener(listen, key), nil
+}
 
-	l := &Listener{
+// NewListener returns a Listener accepting connections from listen, such as
+// a listener inherited from another process.
+func NewListener(listen net.Listener, key string) *Listener {
+	return &Listener{
 		listener: listen,
 		key:      key,
 	}
-	return l, nil
 }
 
 func Dial(address string, key string, timeout time.Duration) (net.Conn, error) {
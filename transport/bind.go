@@ -0,0 +1,170 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/Randomsock5/tcptunnel/limit"
+	pb "github.com/Randomsock5/tcptunnel/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// streamBind listens for a single incoming connection on behalf of the
+// client, from the host in the peer host key if the client sent one. The
+// listening address is sent in the stream header, the address of the
+// accepted peer in a Peer payload, after which the stream carries the
+// accepted connection. The client bounds the wait by closing the stream.
+func (s *proxyService) streamBind(stream pb.ProxyService_StreamServer, lim *limit.Stream) error {
+	if !s.egress {
+		return status.Error(codes.PermissionDenied, "client chosen destinations are not allowed")
+	}
+	var peerHost net.IP
+	if v := incomingValue(stream.Context(), peerHostKey); v != "" {
+		if peerHost = net.ParseIP(v); peerHost == nil {
+			return status.Errorf(codes.InvalidArgument, "invalid peer host %q", v)
+		}
+	}
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Println(err)
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer listener.Close()
+
+	header := metadata.Pairs(boundAddrKey, listener.Addr().String())
+	if err := stream.SendHeader(header); err != nil {
+		return err
+	}
+
+	go func() {
+		<-stream.Context().Done()
+		listener.Close()
+	}()
+
+	peerConn, err := acceptFrom(listener, peerHost)
+	if err != nil {
+		if stream.Context().Err() != nil {
+			return stream.Context().Err()
+		}
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer peerConn.Close()
+	listener.Close()
+
+	var payload pb.Payload
+	payload.Data = []byte(peerConn.RemoteAddr().String())
+	payload.Flag = pb.Payload_Peer
+
+	sender := &syncSender{stream: stream}
+	if err := sender.Send(&payload); err != nil {
+		return err
+	}
+	return s.pipe(stream, sender, peerConn, "bind "+peerConn.RemoteAddr().String(), lim)
+}
+
+// acceptFrom accepts connections on listener until one comes from host,
+// closing the others. The first connection is returned if host is nil.
+func acceptFrom(listener net.Listener, host net.IP) (net.Conn, error) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); host == nil || ok && addr.IP.Equal(host) {
+			return conn, nil
+		}
+		log.Printf("bind: refused connection from %v, waiting for %v", conn.RemoteAddr(), host)
+		conn.Close()
+	}
+}
+
+// TunnelListener accepts one connection on the server on behalf of the
+// client, see ListenTunnel.
+type TunnelListener struct {
+	stream pb.ProxyService_StreamClient
+	sender *syncSender
+	cancel context.CancelFunc
+	addr   net.Addr
+
+	mu       sync.Mutex
+	accepted bool
+	conn     net.Conn
+}
+
+var errListenerDone = errors.New("tunnel listener already accepted a connection")
+
+// ListenTunnel asks the server behind client to listen for a connection
+// from peerHost, an IP address, or from any host if peerHost is nil. The
+// server closes connections from other hosts, so that they do not use up
+// the single Accept. ctx only bounds the time to set up the listener, Addr
+// returns the address the server listens on.
+func ListenTunnel(ctx context.Context, client pb.ProxyServiceClient, peerHost net.IP) (*TunnelListener, error) {
+	kv := []string{networkKey, "bind"}
+	if peerHost != nil {
+		kv = append(kv, peerHostKey, peerHost.String())
+	}
+	stream, header, cancel, err := openStream(ctx, client, kv...)
+	if err != nil {
+		return nil, err
+	}
+	return &TunnelListener{
+		stream: stream,
+		sender: &syncSender{stream: stream},
+		cancel: cancel,
+		addr:   boundAddr(header),
+	}, nil
+}
+
+// Accept waits for the connection the server accepted. It can be called
+// only once, Close unblocks it.
+func (l *TunnelListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.accepted {
+		l.mu.Unlock()
+		return nil, errListenerDone
+	}
+	l.accepted = true
+	l.mu.Unlock()
+
+	for {
+		payload, err := l.stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if payload.GetFlag() == pb.Payload_Peer {
+			conn := &streamConn{
+				stream: l.stream,
+				sender: l.sender,
+				cancel: l.cancel,
+				local:  l.addr,
+				remote: tunnelAddr(payload.GetData()),
+			}
+
+			l.mu.Lock()
+			l.conn = conn
+			l.mu.Unlock()
+			return conn, nil
+		}
+	}
+}
+
+// Close stops listening. Once Accept has returned a connection the stream
+// belongs to that connection and Close has no effect.
+func (l *TunnelListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		l.cancel()
+	}
+	return nil
+}
+
+func (l *TunnelListener) Addr() net.Addr {
+	return l.addr
+}
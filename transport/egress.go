@@ -0,0 +1,163 @@
+package transport
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/Randomsock5/tcptunnel/acl"
+	"github.com/Randomsock5/tcptunnel/constants"
+	pb "github.com/Randomsock5/tcptunnel/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WithPolicy checks the destinations clients choose against p. Without it
+// the rules of acl.New apply, so private addresses are not reachable.
+func WithPolicy(p *acl.Policy) ServerOption {
+	return func(s *proxyService) {
+		s.policy = p
+	}
+}
+
+// policyDenied is the status of a stream to a destination the policy
+// denies.
+func policyDenied(target string, d acl.Decision) error {
+	return status.Errorf(codes.PermissionDenied, "denied by policy: %s: %s", target, d.Rule)
+}
+
+// dialFailed is the status of a stream whose destination could not be
+// connected to. It carries the reason as a pb.DialError detail, so that
+// clients need not interpret the message.
+func dialFailed(err error) error {
+	s := status.New(codes.Unavailable, err.Error())
+	if d, derr := s.WithDetails(&pb.DialError{Reason: dialReason(err)}); derr == nil {
+		s = d
+	}
+	return s.Err()
+}
+
+// dialReasons map the errors of a failed connect to the reasons reported to
+// clients.
+var dialReasons = []struct {
+	errno  syscall.Errno
+	reason pb.DialError_Reason
+}{
+	{syscall.ECONNREFUSED, pb.DialError_REFUSED},
+	{syscall.ENETUNREACH, pb.DialError_NETWORK_UNREACHABLE},
+	{syscall.EHOSTUNREACH, pb.DialError_HOST_UNREACHABLE},
+	{syscall.EHOSTDOWN, pb.DialError_HOST_UNREACHABLE},
+	{syscall.ETIMEDOUT, pb.DialError_TIMEOUT},
+}
+
+func dialReason(err error) pb.DialError_Reason {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return pb.DialError_TIMEOUT
+	}
+
+	cause := err
+	for {
+		switch e := cause.(type) {
+		case *net.OpError:
+			cause = e.Err
+			continue
+		case *os.SyscallError:
+			cause = e.Err
+			continue
+		case *net.DNSError:
+			return pb.DialError_UNKNOWN_HOST
+		}
+		break
+	}
+	if errno, ok := cause.(syscall.Errno); ok {
+		for _, r := range dialReasons {
+			if errno == r.errno {
+				return r.reason
+			}
+		}
+	}
+	return pb.DialError_UNKNOWN
+}
+
+// DialReason returns the reason the server gave for failing to connect a
+// stream to its destination, pb.DialError_UNKNOWN if it gave none.
+func DialReason(err error) pb.DialError_Reason {
+	for _, d := range status.Convert(err).Details() {
+		if de, ok := d.(*pb.DialError); ok {
+			return de.Reason
+		}
+	}
+	return pb.DialError_UNKNOWN
+}
+
+// checkEgress resolves target and returns the addresses the client on ctx
+// may connect to. The decision is logged, the error is a PermissionDenied
+// status if no address is allowed.
+func (s *proxyService) checkEgress(ctx context.Context, network, target string) ([]net.IP, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid port in %s", target)
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, dialFailed(err)
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	addr, id := peerInfo(ctx)
+	var allowed []net.IP
+	var decision acl.Decision
+	for i, ip := range ips {
+		d := s.policy.Check(acl.Destination{Host: host, IP: ip, Port: port, User: id.Name, Groups: id.Groups})
+		// The first allowing decision is reported, else the first one
+		if i == 0 || d.Allow && len(allowed) == 0 {
+			decision = d
+		}
+		if d.Allow {
+			allowed = append(allowed, ip)
+		}
+	}
+	log.Printf("acl: %s %s id=%q -> %s: %v", network, addr, id.Name, target, decision)
+
+	if len(allowed) == 0 {
+		return nil, policyDenied(target, decision)
+	}
+	return allowed, nil
+}
+
+// dialEgress connects to target, a destination chosen by the client on
+// ctx, if the policy allows it. Host names are resolved once and the
+// checked addresses dialed, so that a name cannot resolve to a denied
+// address between the check and the connection.
+func (s *proxyService) dialEgress(ctx context.Context, target string) (net.Conn, error) {
+	ips, err := s.checkEgress(ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	_, port, _ := net.SplitHostPort(target)
+
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", net.JoinHostPort(ip.String(), port), constants.ConnTimeout)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	log.Println(err)
+	return nil, dialFailed(err)
+}
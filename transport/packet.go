@@ -0,0 +1,259 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/Randomsock5/tcptunnel/limit"
+	pb "github.com/Randomsock5/tcptunnel/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// maxDatagramSize is the largest UDP datagram relayed through a stream.
+const maxDatagramSize = 65535
+
+var errShortDatagram = errors.New("short datagram payload")
+
+// packDatagram frames a datagram for a udp stream. The payload starts with
+// the length of the peer address, followed by the address in host:port form
+// and the datagram itself.
+func packDatagram(addr string, data []byte) ([]byte, error) {
+	if len(addr) > 255 {
+		return nil, fmt.Errorf("address too long: %s", addr)
+	}
+
+	b := make([]byte, 0, 1+len(addr)+len(data))
+	b = append(b, byte(len(addr)))
+	b = append(b, addr...)
+	return append(b, data...), nil
+}
+
+func unpackDatagram(b []byte) (addr string, data []byte, err error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", nil, errShortDatagram
+	}
+	n := 1 + int(b[0])
+	return string(b[1:n]), b[n:], nil
+}
+
+// streamPacket relays the datagrams of a udp stream through an unconnected
+// UDP socket at the rates lim allows. Every datagram carries its own
+// destination.
+func (s *proxyService) streamPacket(stream pb.ProxyService_StreamServer, lim *limit.Stream) error {
+	if !s.egress {
+		return status.Error(codes.PermissionDenied, "client chosen destinations are not allowed")
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Println(err)
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer conn.Close()
+
+	header := metadata.Pairs(boundAddrKey, conn.LocalAddr().String())
+	if err := stream.SendHeader(header); err != nil {
+		return err
+	}
+
+	session, ctx := s.sessions.open(stream.Context(), "udp")
+	defer s.sessions.close(session)
+	sender := &syncSender{stream: stream}
+	peers := make(map[string]datagramPeer)
+	errCh := make(chan error, 2)
+
+	go func() {
+		defer recoverHandle()
+
+		buf := make([]byte, maxDatagramSize)
+		for {
+			i, addr, err := conn.ReadFromUDP(buf)
+			handleErr(err, errCh)
+			handleErr(lim.Down(ctx, i), errCh)
+
+			var payload pb.Payload
+			payload.Data, err = packDatagram(addr.String(), buf[:i])
+			payload.Flag = pb.Payload_Load
+			handleErr(err, errCh)
+
+			err = sender.Send(&payload)
+			handleErr(err, errCh)
+			session.addDown(i)
+		}
+	}()
+
+	go func() {
+		defer recoverHandle()
+
+		for {
+			payload, err := stream.Recv()
+			handleErr(err, errCh)
+
+			if payload.GetFlag() == pb.Payload_Load {
+				// A bad or denied datagram is dropped, it does not end
+				// the stream
+				addr, data, err := unpackDatagram(payload.GetData())
+				sent := false
+				if err == nil {
+					sent, err = s.sendDatagram(stream.Context(), conn, peers, addr, data)
+				}
+				if err != nil {
+					log.Println(err)
+				} else if sent {
+					session.addUp(len(data))
+					handleErr(lim.Up(ctx, len(data)), errCh)
+				}
+
+				err = sendACK(sender)
+				handleErr(err, errCh)
+			}
+		}
+	}()
+
+	return waitSession(stream.Context(), ctx, session, errCh)
+}
+
+const (
+	// maxPeers bounds the destinations a udp stream remembers the policy
+	// decision of.
+	maxPeers = 1024
+
+	// peerLookupTimeout bounds the name lookup of a datagram destination,
+	// which holds up the other datagrams of the stream.
+	peerLookupTimeout = 2 * time.Second
+	// peerRetryInterval is how long datagrams to a destination whose
+	// lookup failed are dropped before it is looked up again.
+	peerRetryInterval = 30 * time.Second
+)
+
+// datagramPeer is the policy decision remembered for a destination of a udp
+// stream.
+type datagramPeer struct {
+	// addr is nil for a denied destination and one that did not resolve.
+	addr *net.UDPAddr
+	// retry is when a failed lookup is retried, zero for decisions.
+	retry time.Time
+}
+
+// sendDatagram sends data to addr if the policy allows it. The decision for
+// each destination is made once per stream and remembered in peers, a
+// failed lookup for peerRetryInterval. It reports whether the datagram was
+// sent.
+func (s *proxyService) sendDatagram(ctx context.Context, conn *net.UDPConn, peers map[string]datagramPeer, addr string, data []byte) (bool, error) {
+	p, ok := peers[addr]
+	if !ok || !p.retry.IsZero() && time.Now().After(p.retry) {
+		if !ok && len(peers) >= maxPeers {
+			// Forget any one destination, it is decided again if it is
+			// still in use
+			for k := range peers {
+				delete(peers, k)
+				break
+			}
+		}
+
+		lookupCtx, cancel := context.WithTimeout(ctx, peerLookupTimeout)
+		ips, err := s.checkEgress(lookupCtx, "udp", addr)
+		cancel()
+		switch status.Code(err) {
+		case codes.OK:
+			_, port, _ := net.SplitHostPort(addr)
+			udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ips[0].String(), port))
+			if err != nil {
+				return false, err
+			}
+			p = datagramPeer{addr: udpAddr}
+		case codes.PermissionDenied:
+			p = datagramPeer{}
+		default:
+			peers[addr] = datagramPeer{retry: time.Now().Add(peerRetryInterval)}
+			return false, err
+		}
+		peers[addr] = p
+	}
+	if p.addr == nil {
+		return false, nil
+	}
+	_, err := conn.WriteToUDP(data, p.addr)
+	return err == nil, err
+}
+
+// PacketTunnel relays UDP datagrams through a tunnel stream. The server
+// sends each datagram to the address it is written to and returns replies
+// together with the address they came from.
+type PacketTunnel struct {
+	stream pb.ProxyService_StreamClient
+	sender *syncSender
+	cancel context.CancelFunc
+	local  net.Addr
+}
+
+// DialPacketTunnel opens a udp stream through client. ctx only bounds the
+// time to establish the stream.
+func DialPacketTunnel(ctx context.Context, client pb.ProxyServiceClient) (*PacketTunnel, error) {
+	stream, header, cancel, err := openStream(ctx, client, networkKey, "udp")
+	if err != nil {
+		return nil, err
+	}
+	return &PacketTunnel{
+		stream: stream,
+		sender: &syncSender{stream: stream},
+		cancel: cancel,
+		local:  boundAddr(header),
+	}, nil
+}
+
+// ReadFrom reads the next datagram into b and returns the address it came
+// from. Datagrams larger than b are truncated.
+func (p *PacketTunnel) ReadFrom(b []byte) (int, string, error) {
+	for {
+		payload, err := p.stream.Recv()
+		if err != nil {
+			return 0, "", err
+		}
+		if payload.GetFlag() != pb.Payload_Load {
+			continue
+		}
+		sendACK(p.sender)
+
+		addr, data, err := unpackDatagram(payload.GetData())
+		if err != nil {
+			continue
+		}
+		return copy(b, data), addr, nil
+	}
+}
+
+// WriteTo sends b as one datagram to addr, given in host:port form.
+func (p *PacketTunnel) WriteTo(b []byte, addr string) (int, error) {
+	var payload pb.Payload
+	data, err := packDatagram(addr, b)
+	if err != nil {
+		return 0, err
+	}
+	payload.Data = data
+	payload.Flag = pb.Payload_Load
+
+	if err := p.sender.Send(&payload); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// LocalAddr returns the address of the server's UDP socket.
+func (p *PacketTunnel) LocalAddr() net.Addr {
+	return p.local
+}
+
+func (p *PacketTunnel) Close() error {
+	p.sender.mu.Lock()
+	err := p.stream.CloseSend()
+	p.sender.mu.Unlock()
+	p.cancel()
+	return err
+}
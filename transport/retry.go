@@ -0,0 +1,84 @@
+package transport
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+
+	pb "github.com/Randomsock5/tcptunnel/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// maxRetries bounds how often openStream retries a refused stream.
+const maxRetries = 4
+
+// RetryError is the error of a stream the server refused for lack of
+// resources, together with its hint when to try again.
+type RetryError struct {
+	Err   error
+	After time.Duration
+}
+
+func (e *RetryError) Error() string {
+	return e.Err.Error()
+}
+
+// GRPCStatus returns the status of the refused stream, so that
+// status.Code works on a RetryError.
+func (e *RetryError) GRPCStatus() *status.Status {
+	return status.Convert(e.Err)
+}
+
+// retryError returns err as a *RetryError if it is a RESOURCE_EXHAUSTED
+// status and trailer carries a retry hint, else err itself.
+func retryError(err error, trailer metadata.MD) error {
+	if status.Code(err) != codes.ResourceExhausted {
+		return err
+	}
+	v := trailer.Get(retryAfterKey)
+	if len(v) == 0 {
+		return err
+	}
+	after, perr := time.ParseDuration(v[0])
+	if perr != nil || after <= 0 {
+		return err
+	}
+	return &RetryError{Err: err, After: after}
+}
+
+// openStream is tryOpenStream retried while the server refuses the stream
+// with a retry hint. The wait before each attempt is the hint, at least
+// twice the previous wait, plus some jitter so that refused clients do not
+// come back all at once. It gives up with the server's error once the wait
+// would pass the deadline of ctx.
+func openStream(ctx context.Context, client pb.ProxyServiceClient, kv ...string) (pb.ProxyService_StreamClient, metadata.MD, context.CancelFunc, error) {
+	var wait time.Duration
+	for attempt := 0; ; attempt++ {
+		stream, header, cancel, err := tryOpenStream(ctx, client, kv...)
+		re, ok := err.(*RetryError)
+		if !ok || attempt == maxRetries {
+			return stream, header, cancel, err
+		}
+
+		wait *= 2
+		if re.After > wait {
+			wait = re.After
+		}
+		wait += time.Duration(rand.Int63n(int64(wait)/5 + 1))
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return nil, nil, nil, err
+		}
+		log.Printf("stream refused, retrying in %v: %v", wait, err)
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, nil, nil, err
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package transport
+
+import (
+	"context"
+	"crypto/x509"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Randomsock5/tcptunnel/identity"
+	pb "github.com/Randomsock5/tcptunnel/proto"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// Session describes one proxied stream handled by the server.
+type Session struct {
+	// up and down are accessed atomically and must stay 64-bit aligned.
+	up   int64
+	down int64
+
+	ID         uint64
+	Peer       string
+	CommonName string
+	// Identity and Groups are those of the client, see package identity.
+	Identity string
+	Groups   []string
+	// Certificate is the verified certificate of the client, nil without.
+	Certificate *x509.Certificate
+	// Chains are the verified chains of Certificate, from it to a root
+	// CA.
+	Chains [][]*x509.Certificate
+	Target string
+	Start  time.Time
+
+	cancel     context.CancelFunc
+	killOnce   sync.Once
+	killReason string
+}
+
+// BytesUp returns the number of bytes sent from the client to the target.
+func (s *Session) BytesUp() int64 {
+	return atomic.LoadInt64(&s.up)
+}
+
+// BytesDown returns the number of bytes sent from the target to the client.
+func (s *Session) BytesDown() int64 {
+	return atomic.LoadInt64(&s.down)
+}
+
+// Age returns how long the session has been running.
+func (s *Session) Age() time.Duration {
+	return time.Since(s.Start)
+}
+
+func (s *Session) addUp(n int) {
+	atomic.AddInt64(&s.up, int64(n))
+}
+
+func (s *Session) addDown(n int) {
+	atomic.AddInt64(&s.down, int64(n))
+}
+
+// Registry keeps track of the active sessions of a proxy server.
+type Registry struct {
+	mu       sync.Mutex
+	lastID   uint64
+	sessions map[uint64]*Session
+
+	drainOnce sync.Once
+	drain     chan struct{}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		sessions: make(map[uint64]*Session),
+		drain:    make(chan struct{}),
+	}
+}
+
+// open registers a new session for the stream context ctx. The returned
+// context is cancelled when the session is killed.
+func (r *Registry) open(ctx context.Context, target string) (*Session, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	addr, id := peerInfo(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastID++
+	s := &Session{
+		ID:          r.lastID,
+		Peer:        addr,
+		CommonName:  id.Lookup("cn:"),
+		Identity:    id.Name,
+		Groups:      id.Groups,
+		Certificate: peerCertificate(ctx),
+		Chains:      peerChains(ctx),
+		Target:      target,
+		Start:       time.Now(),
+		cancel:      cancel,
+	}
+	r.sessions[s.ID] = s
+	return s, ctx
+}
+
+func (r *Registry) close(s *Session) {
+	r.mu.Lock()
+	delete(r.sessions, s.ID)
+	r.mu.Unlock()
+	s.cancel()
+}
+
+// Sessions returns a snapshot of the active sessions ordered by ID.
+func (r *Registry) Sessions() []*Session {
+	r.mu.Lock()
+	list := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		list = append(list, s)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Len returns the number of active sessions.
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// Kill terminates the session with the given ID. It reports whether such a
+// session was found.
+func (r *Registry) Kill(id uint64) bool {
+	return r.Terminate(id, "session terminated by administrator")
+}
+
+// Terminate is Kill telling the client reason.
+func (r *Registry) Terminate(id uint64, reason string) bool {
+	r.mu.Lock()
+	s, ok := r.sessions[id]
+	r.mu.Unlock()
+
+	if ok {
+		s.killOnce.Do(func() { s.killReason = reason })
+		s.cancel()
+	}
+	return ok
+}
+
+// Drain stops the server from accepting new sessions. Active sessions are
+// left running.
+func (r *Registry) Drain() {
+	r.drainOnce.Do(func() { close(r.drain) })
+}
+
+// Draining reports whether Drain has been called.
+func (r *Registry) Draining() bool {
+	select {
+	case <-r.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// DrainNotify returns a channel that is closed when Drain is called.
+func (r *Registry) DrainNotify() <-chan struct{} {
+	return r.drain
+}
+
+// identityKey carries the Identity of the client of a stream in its
+// context.
+type identityKey struct{}
+
+// identifiedStream is a stream whose context carries the identity of its
+// client.
+type identifiedStream struct {
+	pb.ProxyService_StreamServer
+	ctx context.Context
+}
+
+func (s identifiedStream) Context() context.Context {
+	return s.ctx
+}
+
+// identify returns stream with the identity of its client, named by its
+// certificate and grouped by s.identities, attached to its context.
+func (s *proxyService) identify(stream pb.ProxyService_StreamServer) pb.ProxyService_StreamServer {
+	var id identity.Identity
+	if cert := peerCertificate(stream.Context()); cert != nil {
+		id = identity.FromCertificate(cert)
+	}
+	if s.identities != nil {
+		id.Groups = s.identities.Groups(id)
+	}
+	return identifiedStream{stream, context.WithValue(stream.Context(), identityKey{}, id)}
+}
+
+// peerInfo returns the address and the identity of the client on ctx.
+func peerInfo(ctx context.Context) (addr string, id identity.Identity) {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		addr = p.Addr.String()
+	}
+	if v, ok := ctx.Value(identityKey{}).(identity.Identity); ok {
+		id = v
+	} else if cert := peerCertificate(ctx); cert != nil {
+		id = identity.FromCertificate(cert)
+	}
+	return addr, id
+}
+
+// peerCertificate returns the verified certificate of the client on ctx,
+// nil if there is none.
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return nil
+	}
+	return tlsInfo.State.PeerCertificates[0]
+}
+
+// peerChains returns the verified chains of the certificate of the client
+// on ctx, nil if there is none.
+func peerChains(ctx context.Context) [][]*x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+		return tlsInfo.State.VerifiedChains
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRegistry_Kill(t *testing.T) {
+	r := NewRegistry()
+	s1, ctx1 := r.open(context.Background(), "192.0.2.1:80")
+	s2, ctx2 := r.open(context.Background(), "192.0.2.2:80")
+	if s1.ID == s2.ID {
+		t.Fatalf("sessions share ID %d", s1.ID)
+	}
+	if n := r.Len(); n != 2 {
+		t.Fatalf("Len = %d, want 2", n)
+	}
+
+	if !r.Kill(s1.ID) {
+		t.Fatal("Kill of an active session reported it missing")
+	}
+	select {
+	case <-ctx1.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context of a killed session not cancelled")
+	}
+	if ctx2.Err() != nil {
+		t.Error("context of another session cancelled by Kill")
+	}
+	if s1.killReason != "session terminated by administrator" {
+		t.Errorf("kill reason = %q", s1.killReason)
+	}
+
+	// The first reason given is kept
+	r.Terminate(s1.ID, "certificate revoked")
+	if s1.killReason != "session terminated by administrator" {
+		t.Errorf("kill reason replaced by %q", s1.killReason)
+	}
+
+	r.close(s1)
+	if r.Kill(s1.ID) {
+		t.Error("Kill of a closed session reported it found")
+	}
+	if list := r.Sessions(); len(list) != 1 || list[0] != s2 {
+		t.Errorf("Sessions = %v, want only session %d", list, s2.ID)
+	}
+	r.close(s2)
+	if n := r.Len(); n != 0 {
+		t.Errorf("Len after closing all = %d, want 0", n)
+	}
+}
+
+func TestRegistry_Drain(t *testing.T) {
+	r := NewRegistry()
+	s, ctx := r.open(context.Background(), "192.0.2.1:80")
+
+	if r.Draining() {
+		t.Fatal("new registry draining")
+	}
+	select {
+	case <-r.DrainNotify():
+		t.Fatal("DrainNotify closed before Drain")
+	default:
+	}
+
+	r.Drain()
+	r.Drain()
+	if !r.Draining() {
+		t.Error("not draining after Drain")
+	}
+	select {
+	case <-r.DrainNotify():
+	default:
+		t.Error("DrainNotify not closed after Drain")
+	}
+
+	// Active sessions are left running
+	if ctx.Err() != nil || r.Len() != 1 {
+		t.Errorf("session %d stopped by Drain", s.ID)
+	}
+}
@@ -7,9 +7,17 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"time"
 
+	"github.com/Randomsock5/tcptunnel/acl"
 	"github.com/Randomsock5/tcptunnel/constants"
+	"github.com/Randomsock5/tcptunnel/identity"
+	"github.com/Randomsock5/tcptunnel/limit"
 	pb "github.com/Randomsock5/tcptunnel/proto"
+	"github.com/Randomsock5/tcptunnel/revocation"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 const buffSize = 4096
@@ -21,17 +29,69 @@ func handleErr(err error, errCh chan error) {
 	}
 }
 
+func logErr(err error) {
+	if err != nil && err != io.EOF && status.Code(err) != codes.Canceled {
+		log.Println(err)
+	}
+}
+
 func recoverHandle() {
 	if rec := recover(); rec != nil {
-		err := rec.(error)
-		if err != io.EOF {
-			log.Println(err)
-		}
+		logErr(rec.(error))
 	}
 }
 
 type proxyService struct {
-	forward string
+	forward    string
+	egress     bool
+	policy     *acl.Policy
+	limiter    *limit.Limiter
+	identities *identity.Map
+	revoked    *revocation.List
+	sessions   *Registry
+}
+
+// ServerOption configures the proxy service returned by NewServer.
+type ServerOption func(*proxyService)
+
+// WithRegistry makes the proxy service record its sessions in r.
+func WithRegistry(r *Registry) ServerOption {
+	return func(s *proxyService) {
+		s.sessions = r
+	}
+}
+
+// WithLimiter throttles the streams of each client and rejects new ones
+// once the client has used up its quota.
+func WithLimiter(l *limit.Limiter) ServerOption {
+	return func(s *proxyService) {
+		s.limiter = l
+	}
+}
+
+// WithIdentities assigns the clients of streams to the groups of m.
+func WithIdentities(m *identity.Map) ServerOption {
+	return func(s *proxyService) {
+		s.identities = m
+	}
+}
+
+// WithRevocation refuses streams of clients whose certificate, or the
+// certificate of an intermediate CA of its chain, l revokes. Certificates
+// are checked when a connection is established as well, this catches those
+// revoked while connected.
+func WithRevocation(l *revocation.List) ServerOption {
+	return func(s *proxyService) {
+		s.revoked = l
+	}
+}
+
+// WithEgress lets clients choose the destination of a stream instead of
+// always connecting to the forward address.
+func WithEgress() ServerOption {
+	return func(s *proxyService) {
+		s.egress = true
+	}
 }
 
 type sendInterface interface {
@@ -51,77 +111,68 @@ func sendACK(stream sendInterface) error {
 }
 
 func (s *proxyService) Stream(stream pb.ProxyService_StreamServer) error {
-	forwardConn, err := net.DialTimeout("tcp", s.forward, constants.ConnTimeout)
+	if s.sessions.Draining() {
+		return status.Error(codes.Unavailable, "server is draining")
+	}
+	if s.revoked != nil {
+		if err := s.revoked.CheckChains(peerChains(stream.Context())); err != nil {
+			log.Println(err)
+			return status.Error(codes.Unauthenticated, err.Error())
+		}
+	}
+
+	stream = s.identify(stream)
+	_, id := peerInfo(stream.Context())
+	lim, err := s.limiter.Open(id.Name)
 	if err != nil {
 		log.Println(err)
-		return err
+		if after := limit.RetryAfter(err); after > 0 {
+			stream.SetTrailer(metadata.Pairs(retryAfterKey, after.Round(time.Millisecond).String()))
+		}
+		return status.Error(codes.ResourceExhausted, err.Error())
 	}
-	defer forwardConn.Close()
-	errCh := make(chan error, 2)
-
-	go func() {
-		defer recoverHandle()
-
-		for {
-			buf := make([]byte, buffSize)
-			i, err := forwardConn.Read(buf)
-			handleErr(err, errCh)
+	defer lim.Close()
 
-			var payload pb.Payload
-			payload.Data = buf[:i]
-			payload.Flag = pb.Payload_Load
+	switch incomingValue(stream.Context(), networkKey) {
+	case "udp":
+		return s.streamPacket(stream, lim)
+	case "bind":
+		return s.streamBind(stream, lim)
+	}
 
-			err = stream.Send(&payload)
-			handleErr(err, errCh)
+	target := s.forward
+	var forwardConn net.Conn
+	if t := incomingValue(stream.Context(), targetKey); t != "" {
+		if !s.egress {
+			return status.Error(codes.PermissionDenied, "client chosen destinations are not allowed")
 		}
-	}()
-
-	go func() {
-		defer recoverHandle()
-
-		for {
-			payload, err := stream.Recv()
-			handleErr(err, errCh)
-
-			if payload.GetFlag() == pb.Payload_Load {
-				data := payload.GetData()
-				buf := bytes.NewBuffer(data)
-				_, err = io.CopyN(forwardConn, buf, int64(len(data)))
-				handleErr(err, errCh)
-
-				err = sendACK(stream)
-				handleErr(err, errCh)
-			}
+		target = t
+		forwardConn, err = s.dialEgress(stream.Context(), target)
+		if err != nil {
+			return err
 		}
-	}()
-
-	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			return e
+	} else {
+		forwardConn, err = net.DialTimeout("tcp", target, constants.ConnTimeout)
+		if err != nil {
+			log.Println(err)
+			return dialFailed(err)
 		}
 	}
+	defer forwardConn.Close()
 
-	return nil
-}
+	header := metadata.Pairs(boundAddrKey, forwardConn.LocalAddr().String())
+	if err := stream.SendHeader(header); err != nil {
+		return err
+	}
 
-func NewServer(forward string) pb.ProxyServiceServer {
-	s := &proxyService{forward: forward}
-	return s
+	return s.pipe(stream, &syncSender{stream: stream}, forwardConn, target, lim)
 }
 
-func ClientProxyService(conn net.Conn, client pb.ProxyServiceClient) {
-	defer conn.Close()
-
-	ctx, cancel := context.WithTimeout(context.Background(), constants.ConnTimeout)
-	defer cancel()
-
-	stream, err := client.Stream(ctx)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	defer stream.CloseSend()
+// pipe relays data between stream and forwardConn at the rates lim allows
+// until either side fails or the session is killed.
+func (s *proxyService) pipe(stream pb.ProxyService_StreamServer, sender *syncSender, forwardConn net.Conn, target string, lim *limit.Stream) error {
+	session, ctx := s.sessions.open(stream.Context(), target)
+	defer s.sessions.close(session)
 	errCh := make(chan error, 2)
 
 	go func() {
@@ -129,15 +180,17 @@ func ClientProxyService(conn net.Conn, client pb.ProxyServiceClient) {
 
 		for {
 			buf := make([]byte, buffSize)
-			i, err := conn.Read(buf)
+			i, err := forwardConn.Read(buf)
 			handleErr(err, errCh)
+			handleErr(lim.Down(ctx, i), errCh)
 
 			var payload pb.Payload
 			payload.Data = buf[:i]
 			payload.Flag = pb.Payload_Load
 
-			err = stream.Send(&payload)
+			err = sender.Send(&payload)
 			handleErr(err, errCh)
+			session.addDown(i)
 		}
 	}()
 
@@ -150,23 +203,48 @@ func ClientProxyService(conn net.Conn, client pb.ProxyServiceClient) {
 
 			if payload.GetFlag() == pb.Payload_Load {
 				data := payload.GetData()
+				handleErr(lim.Up(ctx, len(data)), errCh)
 				buf := bytes.NewBuffer(data)
-
-				_, err = io.CopyN(conn, buf, int64(len(data)))
+				_, err = io.CopyN(forwardConn, buf, int64(len(data)))
 				handleErr(err, errCh)
+				session.addUp(len(data))
 
-				err = sendACK(stream)
+				err = sendACK(sender)
 				handleErr(err, errCh)
 			}
 		}
 	}()
 
-	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			return
+	return waitSession(stream.Context(), ctx, session, errCh)
+}
+
+// waitSession waits until one of the pumps of session fails or the
+// session is killed and returns the status of the stream.
+func waitSession(streamCtx, sessionCtx context.Context, session *Session, errCh chan error) error {
+	select {
+	case e := <-errCh:
+		if e == io.EOF {
+			return nil
 		}
+		return e
+	case <-sessionCtx.Done():
+		if streamCtx.Err() != nil {
+			return streamCtx.Err()
+		}
+		return status.Error(codes.Aborted, session.killReason)
 	}
+}
 
-	return
+func NewServer(forward string, opts ...ServerOption) pb.ProxyServiceServer {
+	s := &proxyService{forward: forward}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.sessions == nil {
+		s.sessions = NewRegistry()
+	}
+	if s.policy == nil {
+		s.policy = acl.New()
+	}
+	return s
 }
@@ -0,0 +1,308 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/Randomsock5/tcptunnel/proto"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// targetKey carries the destination a client wants the server to
+	// connect to. Streams without it go to the server's forward address.
+	targetKey = "tt-target"
+
+	// networkKey selects the kind of stream, "udp" for a datagram stream,
+	// "bind" for a byte stream accepted on a server side listener and "tcp"
+	// or nothing for a byte stream.
+	networkKey = "tt-network"
+
+	// peerHostKey may be sent with a "bind" stream and carries the IP
+	// address the accepted connection has to come from. Connections from
+	// other hosts are closed and the listener keeps waiting.
+	peerHostKey = "tt-peer-host"
+
+	// boundAddrKey is sent back in the stream header once the server has
+	// connected to the destination and carries the server side local
+	// address of that connection.
+	boundAddrKey = "tt-bound-addr"
+
+	// retryAfterKey is sent in the trailer of a stream refused for lack of
+	// resources and carries how long the client should wait before
+	// opening another, as a duration such as "1.5s".
+	retryAfterKey = "tt-retry-after"
+)
+
+// syncSender serializes Send calls, a gRPC stream must not be written to
+// from several goroutines at once.
+type syncSender struct {
+	mu     sync.Mutex
+	stream sendInterface
+}
+
+func (s *syncSender) Send(payload *pb.Payload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stream.Send(payload)
+}
+
+func incomingValue(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// tunnelAddr is the address of one end of a tunnel stream.
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tunnel" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// streamConn adapts a client tunnel stream to net.Conn.
+type streamConn struct {
+	stream pb.ProxyService_StreamClient
+	sender *syncSender
+	cancel context.CancelFunc
+
+	local  net.Addr
+	remote net.Addr
+
+	pending []byte
+
+	// expired is set atomically once a deadline has ended the stream.
+	expired    int32
+	timerMu    sync.Mutex
+	readTimer  *time.Timer
+	writeTimer *time.Timer
+}
+
+// detachedContext carries the values of a context but not its deadline and
+// cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// tryOpenStream starts a stream through client carrying the metadata key/value
+// pairs kv and waits, bounded by ctx, until the server has answered with its
+// header. The stream outlives ctx but sees its values. The returned cancel
+// function ends the stream.
+func tryOpenStream(ctx context.Context, client pb.ProxyServiceClient, kv ...string) (pb.ProxyService_StreamClient, metadata.MD, context.CancelFunc, error) {
+	streamCtx, cancel := context.WithCancel(detachedContext{ctx})
+	if len(kv) > 0 {
+		streamCtx = metadata.AppendToOutgoingContext(streamCtx, kv...)
+	}
+
+	stream, err := client.Stream(streamCtx)
+	if err != nil {
+		cancel()
+		return nil, nil, nil, err
+	}
+
+	type result struct {
+		md  metadata.MD
+		err error
+	}
+	headerCh := make(chan result, 1)
+	go func() {
+		md, err := stream.Header()
+		headerCh <- result{md, err}
+	}()
+
+	var header metadata.MD
+	select {
+	case r := <-headerCh:
+		if r.err != nil {
+			cancel()
+			return nil, nil, nil, retryError(r.err, stream.Trailer())
+		}
+		header = r.md
+	case <-ctx.Done():
+		cancel()
+		return nil, nil, nil, ctx.Err()
+	}
+
+	// A stream that ends before carrying any header failed on the server,
+	// its status is only available through Recv.
+	if header == nil {
+		_, err := stream.Recv()
+		cancel()
+		if err == nil || err == io.EOF {
+			err = errors.New("tunnel stream closed by server")
+		}
+		return nil, nil, nil, retryError(err, stream.Trailer())
+	}
+	return stream, header, cancel, nil
+}
+
+func boundAddr(header metadata.MD) net.Addr {
+	if v := header.Get(boundAddrKey); len(v) > 0 {
+		return tunnelAddr(v[0])
+	}
+	return tunnelAddr("")
+}
+
+// DialTunnel opens a stream through client to target and returns it as a
+// net.Conn. An empty target connects to the server's forward address. ctx
+// only bounds the time to establish the stream; DialTunnel returns once the
+// server has connected to target or failed to do so.
+func DialTunnel(ctx context.Context, client pb.ProxyServiceClient, target string) (net.Conn, error) {
+	var kv []string
+	if target != "" {
+		kv = append(kv, targetKey, target)
+	}
+
+	stream, header, cancel, err := openStream(ctx, client, kv...)
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{
+		stream: stream,
+		sender: &syncSender{stream: stream},
+		cancel: cancel,
+		local:  boundAddr(header),
+		remote: tunnelAddr(target),
+	}, nil
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		payload, err := c.stream.Recv()
+		if err != nil {
+			return 0, c.deadlineErr(err)
+		}
+		if payload.GetFlag() != pb.Payload_Load {
+			continue
+		}
+		c.pending = payload.GetData()
+
+		// A failed ACK means the stream is gone, which the next Recv
+		// reports together with the server's status.
+		sendACK(c.sender)
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > buffSize {
+			n = buffSize
+		}
+
+		var payload pb.Payload
+		payload.Data = append([]byte(nil), b[:n]...)
+		payload.Flag = pb.Payload_Load
+
+		if err := c.sender.Send(&payload); err != nil {
+			return written, c.deadlineErr(err)
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *streamConn) Close() error {
+	c.sender.mu.Lock()
+	err := c.stream.CloseSend()
+	c.sender.mu.Unlock()
+	c.cancel()
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+// errDeadline is returned by the reads and writes of a stream a deadline
+// has ended.
+var errDeadline error = deadlineError{}
+
+type deadlineError struct{}
+
+func (deadlineError) Error() string   { return "tunnel stream deadline exceeded" }
+func (deadlineError) Timeout() bool   { return true }
+func (deadlineError) Temporary() bool { return true }
+
+// A gRPC stream cannot be interrupted and resumed, so a deadline that
+// passes ends the stream: pending and later reads and writes fail with a
+// timeout error. Deadlines may be extended or cleared until then.
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.setTimer(&c.readTimer, t)
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	c.setTimer(&c.writeTimer, t)
+	return nil
+}
+
+// setTimer arms *timer to end the stream at t, a zero t disarms it.
+func (c *streamConn) setTimer(timer **time.Timer, t time.Time) {
+	c.timerMu.Lock()
+	defer c.timerMu.Unlock()
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), c.expire)
+	}
+}
+
+func (c *streamConn) expire() {
+	atomic.StoreInt32(&c.expired, 1)
+	c.cancel()
+}
+
+// deadlineErr returns errDeadline in place of err if a deadline ended the
+// stream.
+func (c *streamConn) deadlineErr(err error) error {
+	if atomic.LoadInt32(&c.expired) != 0 {
+		return errDeadline
+	}
+	return err
+}
+
+// Relay copies data between conn and tunnel in both directions until either
+// side fails, then closes both.
+func Relay(conn, tunnel net.Conn) error {
+	defer conn.Close()
+	defer tunnel.Close()
+
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(tunnel, conn)
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, tunnel)
+		errCh <- err
+	}()
+
+	err := <-errCh
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Randomsock5/tcptunnel/config"
+	pb "github.com/Randomsock5/tcptunnel/proto"
+)
+
+// clientConfig is the layout of the -config file, see package config.
+type clientConfig struct {
+	Server   *string `toml:"server" flag:"server"`
+	Port     *int    `toml:"port" flag:"port"`
+	Password *string `toml:"password" flag:"password"`
+
+	// Servers replaces -servers.
+	Servers []serverEntry `toml:"servers"`
+
+	Listen struct {
+		Local        *string `toml:"local" flag:"local"`
+		LocalPort    *int    `toml:"local_port" flag:"localPort"`
+		SOCKS5       *string `toml:"socks5" flag:"socks5"`
+		SOCKS5Users  *string `toml:"socks5_users" flag:"socks5_users"`
+		HTTP         *string `toml:"http" flag:"http"`
+		Redir        *string `toml:"redir" flag:"redir"`
+		TProxy       *string `toml:"tproxy" flag:"tproxy"`
+		DNS          *string `toml:"dns" flag:"dns"`
+		Control      *string `toml:"control" flag:"control"`
+		ControlToken *string `toml:"control_token" flag:"control_token"`
+		Debug        *string `toml:"debug" flag:"debug"`
+	} `toml:"listen"`
+
+	TLS struct {
+		CertFile *string `toml:"cert_file" flag:"cert_file"`
+		KeyFile  *string `toml:"key_file" flag:"key_file"`
+		CAFile   *string `toml:"ca_file" flag:"ca_file"`
+	} `toml:"tls"`
+
+	Transport struct {
+		Policy         *string `toml:"policy" flag:"policy"`
+		HealthInterval *string `toml:"health_interval" flag:"health_interval"`
+		Conns          *int    `toml:"conns" flag:"conns"`
+		MaxConns       *int    `toml:"max_conns" flag:"max_conns"`
+		ConnStreams    *int    `toml:"conn_streams" flag:"conn_streams"`
+		Placement      *string `toml:"placement" flag:"placement"`
+		DrainTimeout   *string `toml:"drain_timeout" flag:"drain_timeout"`
+	} `toml:"transport"`
+
+	PAC struct {
+		File   *string  `toml:"file" flag:"pac"`
+		Host   *string  `toml:"host" flag:"pac_host"`
+		Direct []string `toml:"direct" flag:"pac_direct"`
+	} `toml:"pac"`
+
+	Routing struct {
+		Rules []string `toml:"rules" flag:"rules"`
+	} `toml:"routing"`
+
+	DNS struct {
+		Upstream *string `toml:"upstream" flag:"dns_upstream"`
+		Cache    *int    `toml:"cache" flag:"dns_cache"`
+		FakeIP   *string `toml:"fake_ip" flag:"fake_ip"`
+		// Domains replaces -dns_domains.
+		Domains map[string]string `toml:"domains"`
+	} `toml:"dns"`
+
+	// Forwards replaces -forwards.
+	Forwards []forwardEntry `toml:"forwards"`
+}
+
+type serverEntry struct {
+	Addr       string `toml:"addr"`
+	Weight     int    `toml:"weight"`
+	Password   string `toml:"password"`
+	CertFile   string `toml:"cert_file"`
+	KeyFile    string `toml:"key_file"`
+	CAFile     string `toml:"ca_file"`
+	ServerName string `toml:"server_name"`
+}
+
+type forwardEntry struct {
+	Local  string `toml:"local"`
+	Target string `toml:"target"`
+}
+
+// reloadable are the flags whose changes are applied on SIGHUP, changes of
+// the others need a restart.
+var reloadable = []string{"rules", "socks5_users", "forwards", "pac", "pac_direct"}
+
+var configFile = config.NewFile(flag.CommandLine, readConfig, reloadable...)
+
+// readConfig returns the flag values set by the -config file at path.
+func readConfig(path string) (map[string]string, error) {
+	var c clientConfig
+	if err := config.Load(path, &c); err != nil {
+		return nil, err
+	}
+
+	values := config.Flags(&c)
+	if c.Servers != nil {
+		list := make([]string, len(c.Servers))
+		for i, s := range c.Servers {
+			params := url.Values{}
+			set := func(key, value string) {
+				if value != "" {
+					params.Set(key, value)
+				}
+			}
+			if s.Weight != 0 {
+				set("weight", strconv.Itoa(s.Weight))
+			}
+			set("password", s.Password)
+			set("cert_file", s.CertFile)
+			set("key_file", s.KeyFile)
+			set("ca_file", s.CAFile)
+			set("server_name", s.ServerName)
+
+			list[i] = s.Addr
+			if len(params) > 0 {
+				list[i] += "?" + params.Encode()
+			}
+		}
+		values["servers"] = strings.Join(list, ",")
+	}
+	if c.DNS.Domains != nil {
+		var list []string
+		for domain, upstream := range c.DNS.Domains {
+			list = append(list, domain+"="+upstream)
+		}
+		sort.Strings(list)
+		values["dns_domains"] = strings.Join(list, ",")
+	}
+	if c.Forwards != nil {
+		list := make([]string, len(c.Forwards))
+		for i, f := range c.Forwards {
+			list[i] = f.Local + "=" + f.Target
+		}
+		values["forwards"] = strings.Join(list, ",")
+	}
+	return values, nil
+}
+
+// reloadConfig rereads the -config file and applies changes of the
+// routing rules, the SOCKS5 users, the forwards and the PAC. Established
+// connections are not affected.
+func reloadConfig(client pb.ProxyServiceClient) {
+	if configFile.Path() == "" {
+		log.Println("reload: no configuration file")
+		return
+	}
+	if err := configFile.Reload(); err != nil {
+		log.Printf("reload: %v", err)
+		return
+	}
+
+	if err := loadRouter(); err != nil {
+		log.Printf("reload: %v", err)
+	}
+	if err := reloadUsers(); err != nil {
+		log.Printf("reload: %v", err)
+	}
+	if err := reloadForwards(client); err != nil {
+		log.Printf("reload: %v", err)
+	}
+	if err := pacSrv.load(); err != nil {
+		log.Printf("reload: %v", err)
+	}
+	log.Println("configuration reloaded")
+}
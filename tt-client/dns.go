@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/Randomsock5/tcptunnel/dns"
+	pb "github.com/Randomsock5/tcptunnel/proto"
+)
+
+// fakeIP maps the fake addresses handed out by the DNS server back to
+// names, it is nil if fake addresses are disabled.
+var fakeIP *dns.FakeIP
+
+func loadFakeIP() error {
+	if *fakeIPNet == "" {
+		return nil
+	}
+	if *dnsAddr == "" {
+		return fmt.Errorf("-fake_ip requires -dns")
+	}
+
+	f, err := dns.NewFakeIP(*fakeIPNet)
+	if err != nil {
+		return err
+	}
+	fakeIP = f
+	return nil
+}
+
+// unfake replaces a fake address in target by the name it is mapped to.
+func unfake(target string) string {
+	if fakeIP == nil {
+		return target
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return target
+	}
+	if name, ok := fakeIP.Lookup(net.ParseIP(host)); ok {
+		return net.JoinHostPort(name, port)
+	}
+	return target
+}
+
+// parseDNSDomains parses the -dns_domains list of domain=host:port pairs.
+func parseDNSDomains(list string) (map[string]string, error) {
+	domains := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("dns domain %q: missing upstream", entry)
+		}
+		domain := strings.ToLower(strings.Trim(entry[:i], "."))
+		domains[domain] = entry[i+1:]
+	}
+	return domains, nil
+}
+
+func serveDNS(client pb.ProxyServiceClient) {
+	domains, err := parseDNSDomains(*dnsDomains)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	s := &dns.Server{
+		Upstream: *dnsUpstream,
+		Domains:  domains,
+		Dial: func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialRoute(ctx, client, addr, "")
+		},
+		FakeIP: fakeIP,
+	}
+	if *dnsCache > 0 {
+		s.Cache = dns.NewCache(*dnsCache)
+	}
+
+	pc, err := net.ListenPacket("udp", *dnsAddr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	l, err := net.Listen("tcp", *dnsAddr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	closeOnShutdown(pc)
+	closeOnShutdown(l)
+
+	log.Printf("dns listening on %s", *dnsAddr)
+	go func() {
+		if err := s.ServeUDP(pc); !stopping() {
+			log.Fatalln(err)
+		}
+	}()
+	if err := s.ServeTCP(l); !stopping() {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	pb "github.com/Randomsock5/tcptunnel/proto"
+	"github.com/Randomsock5/tcptunnel/transport"
+)
+
+// forward is a static port forward relaying the connections accepted on a
+// local address to a fixed target, like ssh -L. The target is dialed by
+// the server, which must allow it with -egress.
+type forward struct {
+	// conns, active, up and down are accessed atomically and must stay
+	// 64-bit aligned.
+	conns  int64
+	active int64
+	up     int64
+	down   int64
+
+	Local string
+
+	mu       sync.Mutex
+	target   string
+	listener net.Listener
+}
+
+// forwardStats is the JSON form of a forward reported by the control
+// server.
+type forwardStats struct {
+	Local       string `json:"local"`
+	Target      string `json:"target"`
+	Enabled     bool   `json:"enabled"`
+	Connections int64  `json:"connections"`
+	Active      int64  `json:"active"`
+	BytesUp     int64  `json:"bytes_up"`
+	BytesDown   int64  `json:"bytes_down"`
+}
+
+var (
+	// forwards holds the forwards given with -forwards.
+	forwards   []*forward
+	forwardsMu sync.Mutex
+)
+
+// parseForwards parses the -forwards list of local=target pairs, both in
+// host:port form.
+func parseForwards(list string) ([]*forward, error) {
+	var fs []*forward
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("forward %q: missing target", entry)
+		}
+		local, target := entry[:i], entry[i+1:]
+		if _, _, err := net.SplitHostPort(local); err != nil {
+			return nil, fmt.Errorf("forward %q: %v", entry, err)
+		}
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return nil, fmt.Errorf("forward %q: %v", entry, err)
+		}
+		fs = append(fs, &forward{Local: local, target: target})
+	}
+	return fs, nil
+}
+
+func loadForwards() error {
+	fs, err := parseForwards(*forwardList)
+	if err != nil {
+		return err
+	}
+	forwards = fs
+	return nil
+}
+
+func startForwards(client pb.ProxyServiceClient) {
+	onShutdown(func() {
+		for _, f := range allForwards() {
+			f.disable()
+		}
+	})
+	for _, f := range allForwards() {
+		if err := f.enable(client); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// reloadForwards applies a changed -forwards list. New forwards are
+// enabled, removed ones disabled and the others get their new target for
+// subsequent connections while keeping their state and stats.
+func reloadForwards(client pb.ProxyServiceClient) error {
+	fs, err := parseForwards(*forwardList)
+	if err != nil {
+		return err
+	}
+
+	forwardsMu.Lock()
+	defer forwardsMu.Unlock()
+
+	old := make(map[string]*forward)
+	for _, f := range forwards {
+		old[f.Local] = f
+	}
+	var next []*forward
+	for _, nf := range fs {
+		if f, ok := old[nf.Local]; ok {
+			f.setTarget(nf.targetAddr())
+			delete(old, f.Local)
+			next = append(next, f)
+			continue
+		}
+		// A forward failing to listen is kept, disabled, so that it can be
+		// enabled through the control API later on
+		if err := nf.enable(client); err != nil {
+			log.Printf("reload: %v", err)
+		}
+		next = append(next, nf)
+	}
+	for _, f := range old {
+		f.disable()
+		log.Printf("forward %s removed", f.Local)
+	}
+	forwards = next
+	return nil
+}
+
+func allForwards() []*forward {
+	forwardsMu.Lock()
+	defer forwardsMu.Unlock()
+	return append([]*forward(nil), forwards...)
+}
+
+func (f *forward) targetAddr() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.target
+}
+
+func (f *forward) setTarget(target string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.target != target {
+		log.Printf("forward %s now to %s", f.Local, target)
+		f.target = target
+	}
+}
+
+// enable starts accepting connections, it does nothing if f is enabled.
+func (f *forward) enable(client pb.ProxyServiceClient) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.listener != nil {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", f.Local)
+	if err != nil {
+		return fmt.Errorf("forward %s: %v", f.Local, err)
+	}
+	f.listener = l
+	log.Printf("forwarding %s to %s", f.Local, f.target)
+	go f.serve(l, client)
+	return nil
+}
+
+// disable stops accepting connections. Relayed connections are left
+// running.
+func (f *forward) disable() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.listener != nil {
+		f.listener.Close()
+		f.listener = nil
+		log.Printf("forward %s disabled", f.Local)
+	}
+}
+
+func (f *forward) enabled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.listener != nil
+}
+
+func (f *forward) serve(l net.Listener, client pb.ProxyServiceClient) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go f.relay(conn, client)
+	}
+}
+
+func (f *forward) relay(conn net.Conn, client pb.ProxyServiceClient) {
+	conn = trackConn(conn)
+	atomic.AddInt64(&f.conns, 1)
+	atomic.AddInt64(&f.active, 1)
+	defer atomic.AddInt64(&f.active, -1)
+
+	target := f.targetAddr()
+	tunnel, err := dialRoute(context.Background(), client, target, conn.RemoteAddr().String())
+	if err != nil {
+		conn.Close()
+		log.Printf("forward %s: connect to %q: %v", f.Local, target, err)
+		return
+	}
+	if err := transport.Relay(&countingConn{Conn: conn, f: f}, tunnel); err != nil {
+		log.Println(err)
+	}
+}
+
+func (f *forward) stats() forwardStats {
+	return forwardStats{
+		Local:       f.Local,
+		Target:      f.targetAddr(),
+		Enabled:     f.enabled(),
+		Connections: atomic.LoadInt64(&f.conns),
+		Active:      atomic.LoadInt64(&f.active),
+		BytesUp:     atomic.LoadInt64(&f.up),
+		BytesDown:   atomic.LoadInt64(&f.down),
+	}
+}
+
+// countingConn counts the bytes read from and written to the local side of
+// a forward.
+type countingConn struct {
+	net.Conn
+	f *forward
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.f.up, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.f.down, int64(n))
+	return n, err
+}
+
+// serveControl serves the control API:
+//
+//	GET  /forwards                        stats of all forwards
+//	POST /forwards/enable?local=ADDR      start accepting on a forward
+//	POST /forwards/disable?local=ADDR     stop accepting on a forward
+//
+// Every request must carry the control token as a bearer token. An address
+// without a host listens on loopback only.
+func serveControl(client pb.ProxyServiceClient) {
+	if *controlToken == "" {
+		log.Fatalln("control API requires -control_token")
+	}
+	addr := *controlAddr
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/forwards", func(w http.ResponseWriter, r *http.Request) {
+		fs := allForwards()
+		stats := make([]forwardStats, 0, len(fs))
+		for _, f := range fs {
+			stats = append(stats, f.stats())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+	toggle := func(enable bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			f := findForward(r.URL.Query().Get("local"))
+			if f == nil {
+				http.Error(w, "forward not found", http.StatusNotFound)
+				return
+			}
+			if !enable {
+				f.disable()
+			} else if err := f.enable(client); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(f.stats())
+		}
+	}
+	mux.HandleFunc("/forwards/enable", toggle(true))
+	mux.HandleFunc("/forwards/disable", toggle(false))
+
+	log.Printf("control listening on %s", addr)
+	log.Fatalln(http.ListenAndServe(addr, tokenAuth(*controlToken, mux)))
+}
+
+// tokenAuth rejects requests to h not carrying token as a bearer token.
+func tokenAuth(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.Header.Get("Authorization")
+		if !strings.HasPrefix(v, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(v[len("Bearer "):]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid control token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func findForward(local string) *forward {
+	for _, f := range allForwards() {
+		if f.Local == local {
+			return f
+		}
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/Randomsock5/tcptunnel/proto"
+	"github.com/Randomsock5/tcptunnel/route"
+	"github.com/Randomsock5/tcptunnel/transport"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// hopHeaders are the hop-by-hop headers, they apply to a single connection
+// and are not forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// httpProxy is an HTTP forward proxy that reaches every destination through
+// the tunnel. CONNECT requests are relayed as byte streams, requests with an
+// absolute URI are forwarded over connections kept alive by transports.
+type httpProxy struct {
+	client pb.ProxyServiceClient
+
+	mu sync.Mutex
+	// transports holds a transport per routing decision, so that a
+	// connection kept alive only carries requests routed the same way
+	// as the one it was dialed for, whichever client they come from.
+	transports map[route.Decision]*http.Transport
+}
+
+func serveHTTPProxy(client pb.ProxyServiceClient) {
+	p := &httpProxy{client: client, transports: make(map[route.Decision]*http.Transport)}
+
+	l, err := net.Listen("tcp", *httpAddr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	srv := &http.Server{Handler: p}
+	// Shutdown closes the listener and the idle connections, the active
+	// ones are waited for as tracked connections
+	onShutdown(func() { go srv.Shutdown(context.Background()) })
+
+	log.Printf("http proxy listening on %s", *httpAddr)
+	if err := srv.Serve(trackedListener{l}); !stopping() {
+		log.Fatalln(err)
+	}
+}
+
+// transport returns the transport of requests routed by d.
+func (p *httpProxy) transport(d route.Decision) *http.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.transports[d]
+	if !ok {
+		t = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				source, _ := ctx.Value(sourceKey{}).(string)
+				return dialDecision(ctx, p.client, unfake(addr), source, d)
+			},
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		}
+		p.transports[d] = t
+	}
+	return t
+}
+
+// sourceKey carries the client address of a request to dial.
+type sourceKey struct{}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.serveConnect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "this is a proxy, requests must use an absolute URI", http.StatusBadRequest)
+		return
+	}
+	d := routeOf(unfake(hostPort(r.URL)), r.RemoteAddr)
+	if d.Action == route.Reject {
+		http.Error(w, errRejected.Error(), http.StatusForbidden)
+		return
+	}
+
+	out := r.WithContext(context.WithValue(r.Context(), sourceKey{}, r.RemoteAddr))
+	out.RequestURI = ""
+	out.Header = cloneHeader(r.Header)
+	removeHopHeaders(out.Header)
+	if r.ContentLength == 0 {
+		out.Body = nil
+	}
+
+	resp, err := p.transport(d).RoundTrip(out)
+	if err != nil {
+		log.Printf("http proxy: %s %s: %v", r.Method, r.URL, err)
+		http.Error(w, err.Error(), gatewayStatus(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(flushWriter{w}, resp.Body); err != nil {
+		log.Printf("http proxy: %s %s: %v", r.Method, r.URL, err)
+	}
+}
+
+// serveConnect relays the client connection to the host named by a CONNECT
+// request.
+func (p *httpProxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	target := r.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "443")
+	}
+
+	if routeOf(target, r.RemoteAddr).Action == route.Reject {
+		http.Error(w, errRejected.Error(), http.StatusForbidden)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be hijacked", http.StatusInternalServerError)
+		return
+	}
+
+	tunnel, err := dialRoute(r.Context(), p.client, target, r.RemoteAddr)
+	if err != nil {
+		log.Printf("http proxy: CONNECT %s: %v", target, err)
+		http.Error(w, err.Error(), gatewayStatus(err))
+		return
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		tunnel.Close()
+		log.Printf("http proxy: CONNECT %s: %v", target, err)
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		conn.Close()
+		tunnel.Close()
+		return
+	}
+
+	if err := transport.Relay(&bufferedConn{conn, buf.Reader}, tunnel); err != nil {
+		log.Printf("http proxy: CONNECT %s: %v", target, err)
+	}
+}
+
+// hostPort returns the host and port a request for u connects to.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// gatewayStatus returns the status reported to the client when the
+// destination could not be reached.
+func gatewayStatus(err error) int {
+	switch status.Code(err) {
+	case codes.PermissionDenied:
+		// The server's policy does not allow the destination
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		// The server refused the stream even after backing off
+		return http.StatusTooManyRequests
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	if transport.DialReason(err) == pb.DialError_TIMEOUT {
+		return http.StatusGatewayTimeout
+	}
+	if err == context.DeadlineExceeded {
+		return http.StatusGatewayTimeout
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, vv := range h {
+		c[k] = append([]string(nil), vv...)
+	}
+	return c
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h, including those
+// named in its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, name := range strings.Split(f, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// flushWriter flushes every write so that streamed responses reach the
+// client without delay.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// bufferedConn reads from the buffer of a hijacked connection, which may
+// already hold data the client sent after its CONNECT request.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -1,141 +1,185 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
-	"os"
-	"strconv"
-	"strings"
 	"time"
 
+	"github.com/Randomsock5/tcptunnel/cluster"
+	"github.com/Randomsock5/tcptunnel/config"
 	"github.com/Randomsock5/tcptunnel/constants"
 	pb "github.com/Randomsock5/tcptunnel/proto"
 	"github.com/Randomsock5/tcptunnel/transport"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
 
 	_ "net/http/pprof"
 )
 
 var (
-	server    = flag.String("server", "127.0.0.1", "Set server address")
-	port      = flag.Int("port", 8443, "Set server port")
-	localAddr = flag.String("local", "", "Set local address")
-	localPort = flag.Int("localPort", 8088, "Set local port")
-	pac       = flag.String("pac", "./pac.txt", "Set pac path")
-	password  = flag.String("password", "password", "password")
+	server     = flag.String("server", "127.0.0.1", "Set server address")
+	port       = flag.Int("port", 8443, "Set server port")
+	serverList = flag.String("servers", "", "Set comma separated list of servers as host:port[?weight=N&password=..&cert_file=..&key_file=..&ca_file=..&server_name=..], overrides -server and -port")
+	policy     = flag.String("policy", "failover", "Set balancing policy across servers: failover, round_robin, least_streams or lowest_rtt")
+	localAddr  = flag.String("local", "", "Set local address")
+	localPort  = flag.Int("localPort", 8088, "Set local port")
+	pac        = flag.String("pac", "./pac.txt", "Set PAC template path, a built-in default is served if it does not exist")
+	password   = flag.String("password", "password", "password")
+	socksAddr  = flag.String("socks5", "", "Set SOCKS5 listen address, empty to disable")
+	socksUsers = flag.String("socks5_users", "", "Set SOCKS5 htpasswd style user file, empty to disable authentication")
+	httpAddr   = flag.String("http", "", "Set HTTP proxy listen address, empty to disable")
+	redirAddr  = flag.String("redir", "", "Set listen address for connections redirected by iptables REDIRECT, empty to disable")
+	tproxyAddr = flag.String("tproxy", "", "Set TCP and UDP listen address for iptables TPROXY, empty to disable")
+	rulesFiles = flag.String("rules", "", "Set comma separated list of routing rule files for TCP connections and SOCKS5 UDP datagrams, the PAC is generated from them when set")
+
+	pacDirect = flag.String("pac_direct", "", "Set comma separated list of domains and IPv4 networks the default PAC sends direct")
+	pacHost   = flag.String("pac_host", "", "Set host the PAC advertises the proxies at, defaults to -local or the address the PAC is requested on")
+	debugAddr = flag.String("debug", "", "Set listen address of the pprof debug handlers, empty to disable")
+
+	forwardList  = flag.String("forwards", "", "Set comma separated list of localAddr:port=host:port static port forwards, the server must allow -egress")
+	controlAddr  = flag.String("control", "", "Set listen address of the HTTP control API for listing and toggling forwards, a port alone listens on loopback, empty to disable")
+	controlToken = flag.String("control_token", "", "The bearer token required by the HTTP control API")
+
+	dnsAddr     = flag.String("dns", "", "Set UDP and TCP listen address of the DNS server forwarding queries through the tunnel, empty to disable")
+	dnsUpstream = flag.String("dns_upstream", "8.8.8.8:53", "Set upstream DNS server reached through the tunnel")
+	dnsDomains  = flag.String("dns_domains", "", "Set comma separated list of domain=host:port upstream overrides for domains and their subdomains")
+	dnsCache    = flag.Int("dns_cache", 4096, "Set number of cached DNS responses, 0 to disable caching")
+	fakeIPNet   = flag.String("fake_ip", "", "Set IPv4 network the DNS server answers A queries from with fake addresses mapped back to names by TCP connections, empty to disable")
 
 	certFile = flag.String("cert_file", "client2server.crt", "The TLS cert file")
 	keyFile  = flag.String("key_file", "client.key", "The TLS key file")
 	caFile   = flag.String("ca_file", "ca.crt", "The TLS ca file")
+
+	healthInterval = flag.Duration("health_interval", 10*time.Second, "Set interval of server health checks")
+	drainTimeout   = flag.Duration("drain_timeout", 30*time.Second, "Set how long shutdown waits for active connections before closing them")
+
+	poolSize        = flag.Int("conns", 1, "Set number of connections opened to every server")
+	maxPoolSize     = flag.Int("max_conns", 4, "Set maximum number of connections to every server")
+	streamThreshold = flag.Int("conn_streams", 64, "Set number of streams per connection before another connection is opened")
+	placement       = flag.String("placement", "least_load", "Set placement of streams on the connections to a server: least_load or hash")
 )
 
 func main() {
 	flag.Parse()
+	if err := configFile.Load(); err != nil {
+		log.Fatalln(err)
+	}
 
-	go func() {
-		pacPort := *localPort + 1
-
-		if exist(*pac) {
-			b, err := ioutil.ReadFile(*pac)
-			if err != nil {
-				log.Println("Can not read file: " + *pac)
-			}
-
-			s := string(b[:])
-			if *localAddr != "" {
-				s = strings.Replace(s, "__PROXY_IP_ADDRESS__", "PROXY "+*localAddr+":"+strconv.Itoa(*localPort)+";", 1)
-				log.Printf("pac uri: %s:%d/pac\n", *localAddr, pacPort)
-			}
-
-			http.HandleFunc("/pac", func(w http.ResponseWriter, r *http.Request) {
-				io.WriteString(w, s)
-			})
-		} else {
-			log.Println("Can not find file: " + *pac)
-		}
+	if err := loadRouter(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := loadFakeIP(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := loadForwards(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := loadUsers(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := pacSrv.load(); err != nil {
+		log.Fatalln(err)
+	}
 
-		log.Println(http.ListenAndServe(fmt.Sprintf("%s:%d", *localAddr, pacPort), nil))
-	}()
+	go servePAC()
+	if *debugAddr != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*debugAddr, nil))
+		}()
+	}
 
 	localServer, err := net.Listen("tcp", fmt.Sprintf("%s:%d", *localAddr, *localPort))
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer localServer.Close()
+	closeOnShutdown(localServer)
 
-	caCert, err := ioutil.ReadFile(*caFile)
+	servers, err := parseServers(*serverList)
 	if err != nil {
-		log.Fatalf("read ca cert file error:%v", err)
-		return
+		log.Fatalln(err)
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-
-	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	balancePolicy, err := cluster.ParsePolicy(*policy)
 	if err != nil {
-		log.Fatalf("load peer cert/key error:%v", err)
-		return
+		log.Fatalln(err)
 	}
-
-	sessionCache := tls.NewLRUClientSessionCache(64)
-	ta := credentials.NewTLS(&tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      caCertPool,
-		ServerName:   "Unknown",
-		MinVersion:   tls.VersionTLS12,
-		CurvePreferences: []tls.CurveID{
-			tls.CurveP521,
-			tls.CurveP384,
-			tls.CurveP256,
-		},
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-		},
-		PreferServerCipherSuites:    true,
-		ClientSessionCache:          sessionCache,
-		DynamicRecordSizingDisabled: false,
+	streamPlacement, err := cluster.ParsePlacement(*placement)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	c, err := cluster.New(servers, cluster.Options{
+		Policy:          balancePolicy,
+		HealthInterval:  *healthInterval,
+		PoolSize:        *poolSize,
+		MaxPoolSize:     *maxPoolSize,
+		StreamThreshold: *streamThreshold,
+		Placement:       streamPlacement,
 	})
-
-	var opts []grpc.DialOption
-	opts = []grpc.DialOption{
-		grpc.WithTransportCredentials(ta),
-		grpc.WithDialer(func(addr string, duration time.Duration) (net.Conn, error) {
-			aesConn, err := transport.Dial(addr, *password, duration)
-			return aesConn, err
-		}),
-		grpc.WithBackoffMaxDelay(constants.ConnTimeout / 2),
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	conn, err := grpc.Dial(
-		fmt.Sprintf("%s:%d", *server, *port),
-		opts...)
+	conn, err := c.Dial(grpc.WithBackoffMaxDelay(constants.ConnTimeout / 2))
 	if err != nil {
 		log.Fatalln(err)
 	}
 	client := pb.NewProxyServiceClient(conn)
 
+	if *socksAddr != "" {
+		go serveSOCKS5(client)
+	}
+	if *httpAddr != "" {
+		go serveHTTPProxy(client)
+	}
+	if *redirAddr != "" {
+		go serveRedirect(client)
+	}
+	if *tproxyAddr != "" {
+		go serveTProxy(client)
+	}
+	if *dnsAddr != "" {
+		go serveDNS(client)
+	}
+	startForwards(client)
+	if *controlAddr != "" {
+		go serveControl(client)
+	}
+	config.OnHangup(func() { reloadConfig(client) })
+
+	go serveLocal(localServer, client)
+	waitForShutdown(conn)
+}
+
+// serveLocal relays the connections accepted on the local port through the
+// tunnel to the server's forward address.
+func serveLocal(l net.Listener, client pb.ProxyServiceClient) {
 	for {
-		sources, err := localServer.Accept()
+		sources, err := l.Accept()
 		if err != nil {
+			if stopping() {
+				return
+			}
 			log.Println(err)
 			continue
 		}
 
-		go transport.ClientProxyService(sources, client)
+		go relayConn(sources, client, "")
 	}
 }
 
-func exist(filePath string) bool {
-	_, err := os.Stat(filePath)
-	return err == nil || os.IsExist(err)
+// relayConn relays conn to target as routed by the rules, or through the
+// tunnel to the server's forward address if target is empty.
+func relayConn(conn net.Conn, client pb.ProxyServiceClient, target string) {
+	conn = trackConn(conn)
+	tunnel, err := dialRoute(context.Background(), client, target, conn.RemoteAddr().String())
+	if err != nil {
+		conn.Close()
+		log.Printf("connect to %q: %v", target, err)
+		return
+	}
+	if err := transport.Relay(conn, tunnel); err != nil {
+		log.Println(err)
+	}
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// pacContentType is the MIME type browsers expect proxy auto-config
+// scripts to be served with.
+const pacContentType = "application/x-ns-proxy-autoconfig"
+
+// legacyPlaceholder is replaced by "{{.Proxy}};" in PAC files, which
+// predate templates.
+const legacyPlaceholder = "__PROXY_IP_ADDRESS__"
+
+// defaultPAC is the PAC template used when the -pac file does not exist and
+// no routing rules are set. It sends everything but local and -pac_direct
+// destinations to the proxy.
+const defaultPAC = `function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || host == "localhost" ||
+		isInNet(host, "127.0.0.0", "255.0.0.0") ||
+		isInNet(host, "10.0.0.0", "255.0.0.0") ||
+		isInNet(host, "172.16.0.0", "255.240.0.0") ||
+		isInNet(host, "192.168.0.0", "255.255.0.0")) {
+		return "DIRECT";
+	}
+{{- range .DirectDomains}}
+	if (host == "{{js .}}" || dnsDomainIs(host, ".{{js .}}")) return "DIRECT";
+{{- end}}
+{{- range .DirectNetworks}}
+	if (isInNet(host, "{{.IP}}", "{{.Mask}}")) return "DIRECT";
+{{- end}}
+	return "{{.Proxy}}";
+}
+`
+
+// pacData is what PAC templates are executed with.
+type pacData struct {
+	// Proxy is the result for proxied destinations, the HTTP proxy, the
+	// SOCKS5 server or the local port, whichever is first enabled.
+	Proxy string
+	// HTTP is the result for the HTTP proxy, empty if disabled.
+	HTTP string
+	// SOCKS5 is the result for the SOCKS5 server, empty if disabled.
+	SOCKS5 string
+	// Host is the address the proxies are advertised at.
+	Host string
+	// DirectDomains and DirectNetworks are the -pac_direct destinations.
+	DirectDomains  []string
+	DirectNetworks []pacNetwork
+}
+
+type pacNetwork struct {
+	IP, Mask string
+}
+
+// pacServer serves the proxy auto-config script at /pac and at /wpad.dat
+// for Web Proxy Auto-Discovery. The script is generated from the routing
+// rules if they are set, and otherwise executed from the -pac template, or
+// a built-in default if that file does not exist. The file is reloaded
+// when it changes.
+type pacServer struct {
+	mu       sync.Mutex
+	path     string
+	modTime  time.Time
+	tmpl     *template.Template
+	domains  []string
+	networks []pacNetwork
+}
+
+var pacSrv = &pacServer{}
+
+func servePAC() {
+	go pacSrv.watch(5 * time.Second)
+
+	mux := http.NewServeMux()
+	mux.Handle("/pac", pacSrv)
+	mux.Handle("/wpad.dat", pacSrv)
+
+	addr := net.JoinHostPort(*localAddr, strconv.Itoa(*localPort+1))
+	log.Printf("pac uri: http://%s/pac", addr)
+	log.Println(http.ListenAndServe(addr, mux))
+}
+
+// load reads the -pac template and the -pac_direct list.
+func (p *pacServer) load() error {
+	domains, networks, err := parsePACDirect(*pacDirect)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.path = *pac
+	p.domains, p.networks = domains, networks
+	return p.loadFile()
+}
+
+// loadFile reads the template at p.path, or falls back to the default if
+// it does not exist. It keeps the current template on errors, until the
+// file changes again.
+func (p *pacServer) loadFile() error {
+	info, err := os.Stat(p.path)
+	if os.IsNotExist(err) {
+		if p.tmpl == nil || !p.modTime.IsZero() {
+			p.tmpl = template.Must(template.New("default").Parse(defaultPAC))
+			p.modTime = time.Time{}
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	p.modTime = info.ModTime()
+	b, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	text := strings.Replace(string(b), legacyPlaceholder, "{{.Proxy}};", -1)
+	tmpl, err := template.New(p.path).Parse(text)
+	if err != nil {
+		return err
+	}
+	p.tmpl = tmpl
+	return nil
+}
+
+// watch reloads the template file when its modification time changes.
+func (p *pacServer) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		p.mu.Lock()
+		var modTime time.Time
+		if info, err := os.Stat(p.path); err == nil {
+			modTime = info.ModTime()
+		}
+		if !modTime.Equal(p.modTime) {
+			if err := p.loadFile(); err != nil {
+				log.Printf("pac: %v", err)
+			} else {
+				log.Printf("pac: reloaded %s", p.path)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *pacServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := *localAddr
+	if *pacHost != "" {
+		host = *pacHost
+	} else if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		// Advertise the address the browser reached us at
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			host, _, _ = net.SplitHostPort(addr.String())
+		}
+	}
+
+	script, err := p.render(host)
+	if err != nil {
+		log.Printf("pac: %v", err)
+		http.Error(w, "pac template failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", pacContentType)
+	w.Write(script)
+}
+
+// render returns the script advertising the proxies at host.
+func (p *pacServer) render(host string) ([]byte, error) {
+	data := pacData{Host: host}
+	if *httpAddr != "" {
+		data.HTTP = "PROXY " + advertised(*httpAddr, host)
+	}
+	if *socksAddr != "" {
+		addr := advertised(*socksAddr, host)
+		data.SOCKS5 = "SOCKS5 " + addr + "; SOCKS " + addr
+	}
+	switch {
+	case data.HTTP != "":
+		data.Proxy = data.HTTP
+	case data.SOCKS5 != "":
+		data.Proxy = data.SOCKS5
+	default:
+		// The local port forwards to the server's forward address, an
+		// HTTP proxy such as squid
+		data.Proxy = "PROXY " + net.JoinHostPort(host, strconv.Itoa(*localPort))
+	}
+
+	if r := currentRouter(); r != nil {
+		return []byte(r.PAC(data.Proxy)), nil
+	}
+
+	p.mu.Lock()
+	tmpl := p.tmpl
+	data.DirectDomains, data.DirectNetworks = p.domains, p.networks
+	p.mu.Unlock()
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// advertised returns the listen address addr with host in place of an
+// unspecified IP.
+func advertised(addr, host string) string {
+	h, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(h); h == "" || ip != nil && ip.IsUnspecified() {
+		h = host
+	}
+	return net.JoinHostPort(h, port)
+}
+
+// parsePACDirect parses the -pac_direct list of domains and IPv4 networks.
+func parsePACDirect(list string) ([]string, []pacNetwork, error) {
+	var domains []string
+	var networks []pacNetwork
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") && net.ParseIP(entry) == nil {
+			domains = append(domains, strings.ToLower(strings.Trim(entry, ".")))
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			entry += "/32"
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		if network.IP.To4() == nil {
+			return nil, nil, fmt.Errorf("pac direct %s: PAC has no IPv6 network test", entry)
+		}
+		networks = append(networks, pacNetwork{network.IP.String(), net.IP(network.Mask).String()})
+	}
+	return domains, networks, nil
+}
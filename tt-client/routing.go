@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Randomsock5/tcptunnel/cluster"
+	"github.com/Randomsock5/tcptunnel/constants"
+	pb "github.com/Randomsock5/tcptunnel/proto"
+	"github.com/Randomsock5/tcptunnel/route"
+	"github.com/Randomsock5/tcptunnel/transport"
+)
+
+// router holds the *route.Router of the routing rules, which is replaced
+// on reload. All connections go through the tunnel if it is nil.
+var router atomic.Value
+
+var errRejected = errors.New("connection rejected by routing rules")
+
+func loadRouter() error {
+	if *rulesFiles == "" {
+		router.Store((*route.Router)(nil))
+		return nil
+	}
+
+	var paths []string
+	for _, path := range strings.Split(*rulesFiles, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	r, err := route.Load(paths...)
+	if err != nil {
+		return err
+	}
+	router.Store(r)
+	return nil
+}
+
+func currentRouter() *route.Router {
+	r, _ := router.Load().(*route.Router)
+	return r
+}
+
+// routeOf returns the routing decision for a connection from source to
+// target, both in host:port form.
+func routeOf(target, source string) route.Decision {
+	r := currentRouter()
+	if r == nil || target == "" {
+		return route.Decision{Action: route.Tunnel}
+	}
+	return r.Route(route.NewDestination(target, source))
+}
+
+// dialRoute connects to target the way the routing rules decide for a
+// connection from source. An empty target connects to the server's
+// forward address. A fake address in target is replaced by its name first.
+func dialRoute(ctx context.Context, client pb.ProxyServiceClient, target, source string) (net.Conn, error) {
+	target = unfake(target)
+	return dialDecision(ctx, client, target, source, routeOf(target, source))
+}
+
+// dialDecision connects to target from source the way d decides.
+func dialDecision(ctx context.Context, client pb.ProxyServiceClient, target, source string, d route.Decision) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, constants.ConnTimeout)
+	defer cancel()
+
+	switch d.Action {
+	case route.Reject:
+		return nil, errRejected
+	case route.Direct:
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", target)
+	}
+
+	if d.Server != "" {
+		ctx = cluster.WithServer(ctx, d.Server)
+	}
+	if source != "" {
+		// Streams of one client host share a connection, whatever
+		// port each of its connections comes from
+		if host, _, err := net.SplitHostPort(source); err == nil {
+			source = host
+		}
+		ctx = cluster.WithKey(ctx, source)
+	}
+	return transport.DialTunnel(ctx, client, target)
+}
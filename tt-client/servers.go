@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Randomsock5/tcptunnel/cluster"
+)
+
+// parseServers parses the -servers list. Servers are separated by commas
+// and written as host:port, optionally followed by query parameters
+// overriding the defaults taken from the other flags:
+//
+//	a.example.com:8443?weight=2,b.example.com:443?password=secret&ca_file=b.crt
+//
+// The parameters are weight, password, cert_file, key_file, ca_file and
+// server_name. An empty list stands for the single server given by -server
+// and -port.
+func parseServers(list string) ([]cluster.Server, error) {
+	if strings.TrimSpace(list) == "" {
+		list = net.JoinHostPort(*server, strconv.Itoa(*port))
+	}
+
+	var servers []cluster.Server
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		addr, query := entry, ""
+		if i := strings.Index(entry, "?"); i >= 0 {
+			addr, query = entry[:i], entry[i+1:]
+		}
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("server %q: %v", entry, err)
+		}
+
+		s := cluster.Server{
+			Addr:     addr,
+			Weight:   1,
+			Password: *password,
+		}
+		if w := params.Get("weight"); w != "" {
+			if s.Weight, err = strconv.Atoi(w); err != nil || s.Weight <= 0 {
+				return nil, fmt.Errorf("server %q: invalid weight %q", entry, w)
+			}
+		}
+		if p, ok := params["password"]; ok {
+			s.Password = p[0]
+		}
+
+		s.TLS, err = clientTLSConfig(
+			paramOr(params, "cert_file", *certFile),
+			paramOr(params, "key_file", *keyFile),
+			paramOr(params, "ca_file", *caFile),
+			paramOr(params, "server_name", "Unknown"))
+		if err != nil {
+			return nil, fmt.Errorf("server %q: %v", entry, err)
+		}
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
+
+func paramOr(params url.Values, key, def string) string {
+	if v := params.Get(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// clientTLSConfig loads the client certificate and the CA used to verify a
+// server.
+func clientTLSConfig(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	caCert, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ca cert file error:%v", err)
+	}
+	caCertPool := x509.NewCertPool()
+	caCertPool.AppendCertsFromPEM(caCert)
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load peer cert/key error:%v", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      caCertPool,
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{
+			tls.CurveP521,
+			tls.CurveP384,
+			tls.CurveP256,
+		},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		},
+		PreferServerCipherSuites:    true,
+		ClientSessionCache:          tls.NewLRUClientSessionCache(64),
+		DynamicRecordSizingDisabled: false,
+	}, nil
+}
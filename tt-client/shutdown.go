@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+var (
+	stopCh = make(chan struct{})
+
+	closersMu sync.Mutex
+	closers   []func()
+
+	// activeConns counts the tracked client connections, it is accessed
+	// atomically.
+	activeConns int64
+)
+
+// stopping reports whether the client is shutting down. Listeners fail
+// once it is, which is then not an error.
+func stopping() bool {
+	select {
+	case <-stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// onShutdown registers fn to be called when shutting down, before waiting
+// for connections to finish. It is meant to stop accepting connections.
+func onShutdown(fn func()) {
+	closersMu.Lock()
+	defer closersMu.Unlock()
+	closers = append(closers, fn)
+}
+
+// closeOnShutdown closes c when shutting down.
+func closeOnShutdown(c io.Closer) {
+	onShutdown(func() { c.Close() })
+}
+
+// trackListener returns l closed when shutting down and accepting tracked
+// connections.
+func trackListener(l net.Listener) net.Listener {
+	closeOnShutdown(l)
+	return trackedListener{l}
+}
+
+type trackedListener struct {
+	net.Listener
+}
+
+func (l trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return trackConn(conn), nil
+}
+
+// trackConn returns conn counted as active until it is closed. Shutdown
+// waits for active connections to finish.
+func trackConn(conn net.Conn) net.Conn {
+	atomic.AddInt64(&activeConns, 1)
+	return &trackedConn{Conn: conn}
+}
+
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { atomic.AddInt64(&activeConns, -1) })
+	return err
+}
+
+// CloseWrite half-closes the connection if it supports it, as the SOCKS5
+// server does once the destination is done sending.
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// waitForShutdown blocks until SIGTERM or SIGINT, then stops accepting
+// connections, waits up to -drain_timeout for the active ones to finish
+// and closes the connection to the servers, which ends the others. A second
+// signal skips the wait.
+func waitForShutdown(conn *grpc.ClientConn) {
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, syscall.SIGTERM, os.Interrupt)
+	sig := <-sigc
+
+	log.Printf("%v: shutting down, draining %d connections", sig, atomic.LoadInt64(&activeConns))
+	close(stopCh)
+	closersMu.Lock()
+	for _, fn := range closers {
+		fn()
+	}
+	closersMu.Unlock()
+
+	deadline := time.NewTimer(*drainTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+wait:
+	for atomic.LoadInt64(&activeConns) > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			break wait
+		case <-sigc:
+			break wait
+		}
+	}
+
+	if n := atomic.LoadInt64(&activeConns); n > 0 {
+		log.Printf("closing %d connections", n)
+	}
+	conn.Close()
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Randomsock5/tcptunnel/cluster"
+	"github.com/Randomsock5/tcptunnel/constants"
+	pb "github.com/Randomsock5/tcptunnel/proto"
+	"github.com/Randomsock5/tcptunnel/route"
+	"github.com/Randomsock5/tcptunnel/socks5"
+	"github.com/Randomsock5/tcptunnel/transport"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func serveSOCKS5(client pb.ProxyServiceClient) {
+	s := &socks5.Server{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialRoute(ctx, client, addr, socksSource(ctx))
+			if err != nil {
+				return nil, socksError(err)
+			}
+			return conn, nil
+		},
+		Rules: socks5.RuleFunc(func(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+			// The datagrams of UDP associations are routed one by one
+			// by routedPacketConn
+			if req.Command != socks5.ConnectCommand {
+				return ctx, true
+			}
+			source := ""
+			if req.RemoteAddr != nil {
+				source = req.RemoteAddr.Address()
+			}
+			return ctx, routeOf(req.DestAddr.Address(), source).Action != route.Reject
+		}),
+		Forwarder: func(ctx context.Context, req *socks5.Request) (socks5.PacketConn, error) {
+			ctx, cancel := context.WithTimeout(ctx, constants.ConnTimeout)
+			defer cancel()
+			tunnel, err := transport.DialPacketTunnel(ctx, client)
+			if err != nil {
+				return nil, err
+			}
+			return newRoutedPacketConn(tunnelPacketConn{tunnel}, socksSource(ctx)), nil
+		},
+		Bind: func(ctx context.Context, req *socks5.Request) (socks5.BindListener, error) {
+			ctx, cancel := context.WithTimeout(ctx, constants.ConnTimeout)
+			defer cancel()
+			ctx, picked := cluster.WithTracker(ctx)
+			var peerHost net.IP
+			if ip := req.DestAddr.IP; ip != nil && !ip.IsUnspecified() {
+				peerHost = ip
+			}
+			listener, err := transport.ListenTunnel(ctx, client, peerHost)
+			if err != nil {
+				return nil, err
+			}
+			return &tunnelBindListener{listener, publicAddr(listener.Addr(), picked.Addr())}, nil
+		},
+	}
+
+	if socksUserStore != nil {
+		s.Credentials = socksUserStore
+	}
+
+	l, err := net.Listen("tcp", *socksAddr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("socks5 listening on %s", *socksAddr)
+	if err := s.Serve(trackListener(l)); !stopping() {
+		log.Fatalln(err)
+	}
+}
+
+// dialReplies are the SOCKS replies to the reasons a server gives for
+// failing to connect.
+var dialReplies = map[pb.DialError_Reason]uint8{
+	pb.DialError_REFUSED:             socks5.ConnectionRefusedReply,
+	pb.DialError_NETWORK_UNREACHABLE: socks5.NetworkUnreachableReply,
+	pb.DialError_HOST_UNREACHABLE:    socks5.HostUnreachableReply,
+	pb.DialError_UNKNOWN_HOST:        socks5.HostUnreachableReply,
+	pb.DialError_TIMEOUT:             socks5.TTLExpiredReply,
+}
+
+// socksError returns the error of a dial through the tunnel as a
+// *socks5.ReplyError choosing the SOCKS reply by the status of the stream.
+// Other errors, those of direct connections, are returned unchanged.
+func socksError(err error) error {
+	reply := socks5.ServerFailureReply
+	switch status.Code(err) {
+	case codes.DeadlineExceeded:
+		reply = socks5.TTLExpiredReply
+	case codes.PermissionDenied:
+		// The policy of the server refused the destination
+		reply = socks5.RuleFailureReply
+	case codes.ResourceExhausted:
+		// A limit of the server refused the stream
+	case codes.Unavailable:
+		if r, ok := dialReplies[transport.DialReason(err)]; ok {
+			reply = r
+		}
+	default:
+		if err == errRejected {
+			reply = socks5.RuleFailureReply
+			break
+		}
+		return err
+	}
+	return &socks5.ReplyError{Reply: reply, Err: err}
+}
+
+// socksUserStore holds the SOCKS5 users so that they can be replaced while
+// serving, it is nil if SOCKS5 authentication is disabled.
+var socksUserStore *userStore
+
+type userStore struct {
+	creds atomic.Value // *socks5.FileCredentials
+}
+
+func (u *userStore) Valid(user, password string) bool {
+	return u.creds.Load().(*socks5.FileCredentials).Valid(user, password)
+}
+
+func (u *userStore) load(path string) error {
+	creds, err := socks5.LoadCredentials(path)
+	if err != nil {
+		return err
+	}
+	u.creds.Store(creds)
+	return nil
+}
+
+func loadUsers() error {
+	if *socksAddr == "" || *socksUsers == "" {
+		return nil
+	}
+	store := &userStore{}
+	if err := store.load(*socksUsers); err != nil {
+		return err
+	}
+	socksUserStore = store
+	return nil
+}
+
+func reloadUsers() error {
+	switch {
+	case *socksAddr == "":
+		return nil
+	case socksUserStore == nil && *socksUsers != "":
+		return fmt.Errorf("enabling SOCKS5 authentication needs a restart")
+	case socksUserStore != nil && *socksUsers == "":
+		return fmt.Errorf("disabling SOCKS5 authentication needs a restart")
+	case socksUserStore == nil:
+		return nil
+	}
+	return socksUserStore.load(*socksUsers)
+}
+
+// socksSource returns the client address of the SOCKS request ctx belongs
+// to.
+func socksSource(ctx context.Context) string {
+	if req := socks5.RequestFrom(ctx); req != nil && req.RemoteAddr != nil {
+		return req.RemoteAddr.Address()
+	}
+	return ""
+}
+
+// tunnelPacketConn relays the datagrams of a SOCKS5 UDP association
+// through a packet tunnel.
+type tunnelPacketConn struct {
+	*transport.PacketTunnel
+}
+
+func (t tunnelPacketConn) ReadFrom(b []byte) (int, *socks5.AddrSpec, error) {
+	for {
+		n, addr, err := t.PacketTunnel.ReadFrom(b)
+		if err != nil {
+			return n, nil, err
+		}
+		if spec, err := socks5.ParseAddrSpec(addr); err == nil {
+			return n, spec, nil
+		}
+	}
+}
+
+func (t tunnelPacketConn) WriteTo(b []byte, addr *socks5.AddrSpec) (int, error) {
+	return t.PacketTunnel.WriteTo(b, addr.Address())
+}
+
+// errPacketConnClosed is returned by the reads of a closed
+// routedPacketConn.
+var errPacketConnClosed = errors.New("packet connection closed")
+
+// routedPacketConn relays the datagrams of a SOCKS5 UDP association the way
+// the routing rules decide for each destination: through the tunnel, from
+// a local socket opened for the first DIRECT datagram, or not at all. A
+// fake destination is replaced by its name first. Rules naming a server
+// are not honored, an association has one tunnel.
+type routedPacketConn struct {
+	tunnel tunnelPacketConn
+	source string
+
+	received chan datagram
+	done     chan struct{}
+
+	mu     sync.Mutex
+	direct socks5.PacketConn
+	closed bool
+	err    error
+}
+
+// datagram is a datagram received for a routedPacketConn.
+type datagram struct {
+	data []byte
+	addr *socks5.AddrSpec
+}
+
+func newRoutedPacketConn(tunnel tunnelPacketConn, source string) *routedPacketConn {
+	c := &routedPacketConn{
+		tunnel:   tunnel,
+		source:   source,
+		received: make(chan datagram, 16),
+		done:     make(chan struct{}),
+	}
+	go c.receive(tunnel)
+	return c
+}
+
+// receive hands the datagrams read from conn to ReadFrom. The first
+// failing conn closes c.
+func (c *routedPacketConn) receive(conn socks5.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			c.close(err)
+			return
+		}
+		select {
+		case c.received <- datagram{append([]byte(nil), buf[:n]...), addr}:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *routedPacketConn) ReadFrom(b []byte) (int, *socks5.AddrSpec, error) {
+	select {
+	case d := <-c.received:
+		return copy(b, d.data), d.addr, nil
+	case <-c.done:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return 0, nil, c.err
+	}
+}
+
+func (c *routedPacketConn) WriteTo(b []byte, addr *socks5.AddrSpec) (int, error) {
+	if target := unfake(addr.Address()); target != addr.Address() {
+		spec, err := socks5.ParseAddrSpec(target)
+		if err != nil {
+			return 0, err
+		}
+		addr = spec
+	}
+	switch routeOf(addr.Address(), c.source).Action {
+	case route.Reject:
+		return 0, errRejected
+	case route.Direct:
+		direct, err := c.directConn()
+		if err != nil {
+			return 0, err
+		}
+		return direct.WriteTo(b, addr)
+	}
+	return c.tunnel.WriteTo(b, addr)
+}
+
+// directConn returns the local socket of c, opening it on first use.
+func (c *routedPacketConn) directConn() (socks5.PacketConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errPacketConnClosed
+	}
+	if c.direct == nil {
+		conn, err := socks5.ListenPacket(context.Background(), nil)
+		if err != nil {
+			return nil, err
+		}
+		c.direct = conn
+		go c.receive(conn)
+	}
+	return c.direct, nil
+}
+
+func (c *routedPacketConn) Close() error {
+	return c.close(errPacketConnClosed)
+}
+
+// close closes the tunnel and the local socket, later reads fail with err.
+func (c *routedPacketConn) close(err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.err = err
+	close(c.done)
+	if c.direct != nil {
+		c.direct.Close()
+	}
+	return c.tunnel.Close()
+}
+
+// tunnelBindListener serves SOCKS5 BIND requests from a listener on the
+// tunnel server.
+type tunnelBindListener struct {
+	*transport.TunnelListener
+	addr net.Addr
+}
+
+func (t *tunnelBindListener) Addr() net.Addr {
+	return t.addr
+}
+
+// publicAddr replaces the unspecified IP of the server side listening
+// address addr with the address of the server at serverAddr, which is where
+// peers have to connect to.
+func publicAddr(addr net.Addr, serverAddr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		return addr
+	}
+
+	serverHost, _, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		return addr
+	}
+	ips, err := net.LookupIP(serverHost)
+	if err != nil || len(ips) == 0 {
+		return addr
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: ips[0], Port: p}
+}
@@ -0,0 +1,412 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/Randomsock5/tcptunnel/constants"
+	pb "github.com/Randomsock5/tcptunnel/proto"
+	"github.com/Randomsock5/tcptunnel/socks5"
+	"github.com/Randomsock5/tcptunnel/transport"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h,
+	// IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h has the
+	// same value.
+	soOriginalDst = 80
+
+	// udpSessionTimeout is how long the tunnel of a TPROXY UDP client is
+	// kept open without any datagram in either direction.
+	udpSessionTimeout = 2 * time.Minute
+
+	// tproxyQueueLen is how many datagrams of a TPROXY UDP client are
+	// queued while its tunnel is dialed or busy.
+	tproxyQueueLen = 64
+)
+
+// serveRedirect accepts connections redirected to redirAddr by an iptables
+// REDIRECT target and forwards them to their original destination.
+func serveRedirect(client pb.ProxyServiceClient) {
+	l, err := net.Listen("tcp", *redirAddr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	closeOnShutdown(l)
+	log.Printf("redirect listening on %s", *redirAddr)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if stopping() {
+				return
+			}
+			log.Println(err)
+			continue
+		}
+
+		go func() {
+			dst, err := originalDst(conn.(*net.TCPConn))
+			if err != nil {
+				conn.Close()
+				log.Printf("redirect: original destination of %v: %v", conn.RemoteAddr(), err)
+				return
+			}
+			relayConn(conn, client, dst.String())
+		}()
+	}
+}
+
+// originalDst returns the destination of conn before it was redirected.
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+			// The option returns a sockaddr_in6, which fits the
+			// address of an IPv6MTUInfo.
+			info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			addr = &net.TCPAddr{
+				IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+				Port: int(port[0])<<8 | int(port[1]),
+			}
+			return
+		}
+
+		// The option returns a sockaddr_in, which fits an IPv6Mreq.
+		mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		b := mreq.Multiaddr
+		addr = &net.TCPAddr{
+			IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+			Port: int(b[2])<<8 | int(b[3]),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
+
+// serveTProxy accepts TCP connections and UDP datagrams sent to tproxyAddr
+// by an iptables TPROXY target and forwards them to their destination.
+func serveTProxy(client pb.ProxyServiceClient) {
+	lc := net.ListenConfig{Control: transparentControl}
+	l, err := lc.Listen(context.Background(), "tcp", *tproxyAddr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", *tproxyAddr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	closeOnShutdown(l)
+	closeOnShutdown(pc)
+	log.Printf("tproxy listening on %s", *tproxyAddr)
+
+	go serveTProxyUDP(client, pc.(*net.UDPConn))
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if stopping() {
+				return
+			}
+			log.Println(err)
+			continue
+		}
+
+		// The local address of a TPROXY connection is its destination
+		go relayConn(conn, client, conn.LocalAddr().String())
+	}
+}
+
+// transparentControl marks a socket as transparent, so that it may accept
+// traffic for and send traffic from foreign addresses, and asks for the
+// original destination of the datagrams it receives.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		ipv6 := strings.HasSuffix(network, "6")
+		opts := [][2]int{{unix.SOL_IP, unix.IP_TRANSPARENT}}
+		if ipv6 {
+			opts = append(opts, [2]int{unix.SOL_IPV6, unix.IPV6_TRANSPARENT})
+		}
+		if strings.HasPrefix(network, "udp") {
+			opts = append(opts, [2]int{unix.SOL_IP, unix.IP_RECVORIGDSTADDR})
+			if ipv6 {
+				opts = append(opts, [2]int{unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR})
+			}
+		}
+
+		for _, opt := range opts {
+			if err := unix.SetsockoptInt(int(fd), opt[0], opt[1], 1); err != nil {
+				sockErr = fmt.Errorf("setsockopt %d/%d: %v", opt[0], opt[1], err)
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// replyControl prepares a socket that sends replies from the address of
+// the remote host.
+func replyControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockErr != nil {
+			return
+		}
+		if network == "udp6" {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+			return
+		}
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// origDstAddr returns the destination of a datagram from the control
+// messages oob it was received with.
+func origDstAddr(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR && len(m.Data) >= 8:
+			// sockaddr_in
+			return &net.UDPAddr{
+				IP:   net.IPv4(m.Data[4], m.Data[5], m.Data[6], m.Data[7]),
+				Port: int(m.Data[2])<<8 | int(m.Data[3]),
+			}, nil
+		case m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR && len(m.Data) >= 24:
+			// sockaddr_in6
+			return &net.UDPAddr{
+				IP:   append(net.IP(nil), m.Data[8:24]...),
+				Port: int(m.Data[2])<<8 | int(m.Data[3]),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("no original destination address")
+}
+
+// tproxySession relays the datagrams of one UDP client the way the routing
+// rules decide for each destination.
+type tproxySession struct {
+	client *net.UDPAddr
+	// from is the address replies are sent to the client from, if empty
+	// each one is sent from the address it came from. Sessions of a fake
+	// destination set it, as the client expects replies from the fake
+	// address rather than from the real one of the host.
+	from  string
+	timer *time.Timer
+	// queue holds the datagrams of the client until they are written to
+	// the tunnel. The tunnel is dialed in the background, so that a slow
+	// server does not hold up the datagrams of other clients.
+	queue chan tproxyDatagram
+	done  chan struct{}
+
+	mu      sync.Mutex
+	conn    *routedPacketConn
+	replies map[string]net.PacketConn
+	closed  bool
+}
+
+type tproxyDatagram struct {
+	data []byte
+	dst  *socks5.AddrSpec
+}
+
+func serveTProxyUDP(client pb.ProxyServiceClient, conn *net.UDPConn) {
+	var mu sync.Mutex
+	sessions := make(map[string]*tproxySession)
+
+	buf := make([]byte, 65535)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, src, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			if !stopping() {
+				log.Printf("tproxy: %v", err)
+			}
+			return
+		}
+		dst, err := origDstAddr(oob[:oobn])
+		if err != nil {
+			log.Printf("tproxy: datagram from %v: %v", src, err)
+			continue
+		}
+
+		key, from := src.String(), ""
+		if unfake(dst.String()) != dst.String() {
+			key, from = key+" "+dst.String(), dst.String()
+		}
+		mu.Lock()
+		s, ok := sessions[key]
+		if !ok {
+			s = &tproxySession{
+				client:  src,
+				from:    from,
+				queue:   make(chan tproxyDatagram, tproxyQueueLen),
+				done:    make(chan struct{}),
+				replies: make(map[string]net.PacketConn),
+			}
+			remove := func() {
+				s.timer.Stop()
+				mu.Lock()
+				if sessions[key] == s {
+					delete(sessions, key)
+				}
+				mu.Unlock()
+				s.close()
+			}
+			s.timer = time.AfterFunc(udpSessionTimeout, remove)
+			sessions[key] = s
+			go s.run(client, remove)
+		}
+		mu.Unlock()
+
+		s.timer.Reset(udpSessionTimeout)
+		d := tproxyDatagram{
+			data: append([]byte(nil), buf[:n]...),
+			dst:  &socks5.AddrSpec{IP: dst.IP, Port: dst.Port},
+		}
+		select {
+		case s.queue <- d:
+		default:
+			log.Printf("tproxy: datagram from %v to %v dropped, tunnel not keeping up", src, dst)
+		}
+	}
+}
+
+// run dials the tunnel of the session and routes the queued datagrams
+// until the session is closed. remove is called if the dial fails.
+func (s *tproxySession) run(client pb.ProxyServiceClient, remove func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), constants.ConnTimeout)
+	tunnel, err := transport.DialPacketTunnel(ctx, client)
+	cancel()
+	if err != nil {
+		log.Printf("tproxy: datagrams from %v: %v", s.client, err)
+		remove()
+		return
+	}
+	conn := newRoutedPacketConn(tunnelPacketConn{tunnel}, s.client.String())
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conn = conn
+	s.mu.Unlock()
+	go s.relayReplies(conn)
+
+	for {
+		select {
+		case d := <-s.queue:
+			if _, err := conn.WriteTo(d.data, d.dst); err != nil && err != errRejected {
+				log.Printf("tproxy: datagram to %v: %v", d.dst.Address(), err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// relayReplies sends the datagrams coming back through conn to the client,
+// each from the address of the host that sent it.
+func (s *tproxySession) relayReplies(conn *routedPacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, spec, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.timer.Reset(udpSessionTimeout)
+
+		addr := spec.Address()
+		if s.from != "" {
+			addr = s.from
+		}
+		reply, err := s.replyConn(addr)
+		if err != nil {
+			log.Printf("tproxy: reply from %s: %v", addr, err)
+			continue
+		}
+		if _, err := reply.WriteTo(buf[:n], s.client); err != nil {
+			log.Printf("tproxy: reply from %s: %v", addr, err)
+		}
+	}
+}
+
+// replyConn returns a socket bound to the foreign address addr.
+func (s *tproxySession) replyConn(addr string) (net.PacketConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if conn, ok := s.replies[addr]; ok {
+		return conn, nil
+	}
+	if s.replies == nil {
+		return nil, fmt.Errorf("session closed")
+	}
+
+	lc := net.ListenConfig{Control: replyControl}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.replies[addr] = conn
+	return conn, nil
+}
+
+func (s *tproxySession) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	for _, conn := range s.replies {
+		conn.Close()
+	}
+	s.replies = nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"log"
+
+	pb "github.com/Randomsock5/tcptunnel/proto"
+)
+
+func serveRedirect(client pb.ProxyServiceClient) {
+	log.Fatalln("redirect mode is only supported on Linux")
+}
+
+func serveTProxy(client pb.ProxyServiceClient) {
+	log.Fatalln("tproxy mode is only supported on Linux")
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/Randomsock5/tcptunnel/acl"
+)
+
+var aclFile = flag.String("acl", "", "Set the rule file restricting the destinations clients may choose, see package acl")
+
+// policy checks the destinations of -egress streams. Without -acl it
+// allows all public addresses.
+var policy = acl.New()
+
+// loadACL loads the -acl file into policy.
+func loadACL() error {
+	if *aclFile == "" {
+		policy.Reset()
+		return nil
+	}
+	return policy.Load(*aclFile)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"sync"
+
+	"github.com/Randomsock5/tcptunnel/config"
+)
+
+// serverConfig is the layout of the -config file, see package config.
+type serverConfig struct {
+	Password *string `toml:"password" flag:"password"`
+
+	Listen struct {
+		Port       *int    `toml:"port" flag:"port"`
+		Admin      *string `toml:"admin" flag:"admin"`
+		AdminToken *string `toml:"admin_token" flag:"admin_token"`
+	} `toml:"listen"`
+
+	TLS struct {
+		CertFile *string `toml:"cert_file" flag:"cert_file"`
+		KeyFile  *string `toml:"key_file" flag:"key_file"`
+		CAFile   *string `toml:"ca_file" flag:"ca_file"`
+
+		Identities *string `toml:"identities" flag:"identities"`
+		CRLFile    *string `toml:"crl_file" flag:"crl_file"`
+		DenyFile   *string `toml:"deny_file" flag:"deny_file"`
+	} `toml:"tls"`
+
+	Transport struct {
+		Forward        *string `toml:"forward" flag:"forward"`
+		Egress         *bool   `toml:"egress" flag:"egress"`
+		ACL            *string `toml:"acl" flag:"acl"`
+		HealthInterval *string `toml:"health_interval" flag:"health_interval"`
+		Reflection     *bool   `toml:"reflection" flag:"reflection"`
+		DrainTimeout   *string `toml:"drain_timeout" flag:"drain_timeout"`
+		DrainGrace     *string `toml:"drain_grace" flag:"drain_grace"`
+	} `toml:"transport"`
+
+	Limits struct {
+		RateUserUp     *string `toml:"rate_user_up" flag:"rate_user_up"`
+		RateUserDown   *string `toml:"rate_user_down" flag:"rate_user_down"`
+		RateStreamUp   *string `toml:"rate_stream_up" flag:"rate_stream_up"`
+		RateStreamDown *string `toml:"rate_stream_down" flag:"rate_stream_down"`
+		QuotaDaily     *string `toml:"quota_daily" flag:"quota_daily"`
+		QuotaMonthly   *string `toml:"quota_monthly" flag:"quota_monthly"`
+		QuotaFile      *string `toml:"quota_file" flag:"quota_file"`
+
+		MaxStreams       *int     `toml:"max_streams" flag:"max_streams"`
+		MaxClientStreams *int     `toml:"max_client_streams" flag:"max_client_streams"`
+		StreamRate       *float64 `toml:"stream_rate" flag:"stream_rate"`
+	} `toml:"limits"`
+}
+
+// reloadable are the flags whose changes are applied on reload, changes of
+// the others need a restart.
+var reloadable = []string{"cert_file", "key_file", "ca_file", "acl", "identities", "crl_file", "deny_file",
+	"rate_user_up", "rate_user_down", "rate_stream_up", "rate_stream_down", "quota_daily", "quota_monthly",
+	"max_streams", "max_client_streams", "stream_rate"}
+
+var configFile = config.NewFile(flag.CommandLine, readConfig, reloadable...)
+
+// reloadMu serializes reloads, which may be started by SIGHUP, the admin
+// service and the revocation watcher at the same time and set and read the
+// same flags.
+var reloadMu sync.Mutex
+
+// readConfig returns the flag values set by the -config file at path.
+func readConfig(path string) (map[string]string, error) {
+	var c serverConfig
+	if err := config.Load(path, &c); err != nil {
+		return nil, err
+	}
+	return config.Flags(&c), nil
+}
+
+// reloadConfig rereads the -config file, if any, the TLS certificates, the
+// -acl and the -identities file and the revoked certificates and applies
+// the limits. Active streams are not affected, except those of newly
+// revoked certificates, which are terminated, and by new rates.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if err := configFile.Reload(); err != nil {
+		return err
+	}
+	if err := loadTLSConfig(); err != nil {
+		return err
+	}
+	if err := loadACL(); err != nil {
+		return err
+	}
+	if err := loadIdentities(); err != nil {
+		return err
+	}
+	loadLimits()
+	return loadRevocation()
+}
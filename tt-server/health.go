@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/Randomsock5/tcptunnel/constants"
+	"github.com/Randomsock5/tcptunnel/transport"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// proxyServiceName is the service name reported by the health service in
+// addition to the overall server status "".
+const proxyServiceName = "proto.ProxyService"
+
+// probeForward periodically dials the forward target and reports the result
+// through hs. An empty target is not probed and the server reported as
+// SERVING, with -egress clients choose their destinations and the forward
+// target says nothing about the health of the server. Once the registry
+// starts draining the server is reported as NOT_SERVING for good.
+func probeForward(hs *health.Server, registry *transport.Registry, target string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := healthpb.HealthCheckResponse_UNKNOWN
+	for {
+		status := healthpb.HealthCheckResponse_SERVING
+		var err error
+		if target != "" {
+			var conn net.Conn
+			conn, err = net.DialTimeout("tcp", target, constants.ConnTimeout)
+			if err != nil {
+				status = healthpb.HealthCheckResponse_NOT_SERVING
+			} else {
+				conn.Close()
+			}
+		}
+
+		if status != last {
+			switch {
+			case err != nil:
+				log.Printf("health: forward target %s unreachable: %v", target, err)
+			case target != "":
+				log.Printf("health: forward target %s reachable", target)
+			}
+			hs.SetServingStatus("", status)
+			hs.SetServingStatus(proxyServiceName, status)
+			last = status
+		}
+
+		select {
+		case <-ticker.C:
+		case <-registry.DrainNotify():
+			log.Println("health: draining, reporting NOT_SERVING")
+			hs.Shutdown()
+			return
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/Randomsock5/tcptunnel/identity"
+)
+
+var identitiesFile = flag.String("identities", "", "Set the file mapping client certificate names to policy groups, see package identity")
+
+// identities assigns clients to the groups ACL rules refer to.
+var identities = identity.NewMap()
+
+// loadIdentities loads the -identities file into identities.
+func loadIdentities() error {
+	if *identitiesFile == "" {
+		identities.Reset()
+		return nil
+	}
+	return identities.Load(*identitiesFile)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/Randomsock5/tcptunnel/limit"
+)
+
+var (
+	rates     limit.Rates
+	quotaDay  limit.Size
+	quotaMon  limit.Size
+	quotaFile = flag.String("quota_file", "", "Set the file quota usage is kept in across restarts, empty to keep it in memory")
+
+	maxStreams       = flag.Int("max_streams", 0, "Set the maximum number of concurrent streams, 0 for no limit")
+	maxClientStreams = flag.Int("max_client_streams", 0, "Set the maximum number of concurrent streams of each client, 0 for no limit")
+	streamRate       = flag.Float64("stream_rate", 0, "Set the number of streams each client may open per second, 0 for no limit")
+)
+
+func init() {
+	flag.Var(&rates.UserUp, "rate_user_up", "Set the upload rate limit of each client in bytes per second, e.g. 1M, 0 for none")
+	flag.Var(&rates.UserDown, "rate_user_down", "Set the download rate limit of each client in bytes per second, 0 for none")
+	flag.Var(&rates.StreamUp, "rate_stream_up", "Set the upload rate limit of each stream in bytes per second, 0 for none")
+	flag.Var(&rates.StreamDown, "rate_stream_down", "Set the download rate limit of each stream in bytes per second, 0 for none")
+	flag.Var(&quotaDay, "quota_daily", "Set the bytes each client may transfer per day, e.g. 10G, 0 for no limit")
+	flag.Var(&quotaMon, "quota_monthly", "Set the bytes each client may transfer per month, 0 for no limit")
+}
+
+// quotaSaveInterval is how often quota usage is written to -quota_file.
+const quotaSaveInterval = time.Minute
+
+// limiter enforces the limits of the flags, quota counts usage against
+// the quotas.
+var (
+	limiter *limit.Limiter
+	quota   *limit.Quota
+)
+
+// startLimits creates limiter and quota from the flags. Usage is restored
+// from -quota_file and saved to it periodically.
+func startLimits() error {
+	var err error
+	quota, err = limit.NewQuota(quotaDay, quotaMon, *quotaFile)
+	if err != nil {
+		return err
+	}
+	if *quotaFile != "" {
+		go func() {
+			for range time.Tick(quotaSaveInterval) {
+				saveQuota()
+			}
+		}()
+	}
+	limiter = limit.NewLimiter(rates, streamLimits(), quota)
+	return nil
+}
+
+// loadLimits applies the limit flags to limiter and quota, open streams
+// take up the new rates.
+func loadLimits() {
+	limiter.Set(rates, streamLimits())
+	quota.SetLimits(quotaDay, quotaMon)
+}
+
+func streamLimits() limit.Streams {
+	return limit.Streams{Max: *maxStreams, PerUser: *maxClientStreams, Rate: *streamRate}
+}
+
+// saveQuota adds the quota usage to -quota_file. A process draining after
+// an upgrade keeps saving, so the traffic of its streams is counted too.
+func saveQuota() {
+	if err := quota.Save(); err != nil {
+		log.Printf("saving quota usage: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Environment variables through which listeners are inherited. A process
+// started by upgrade gets the names of its inherited listeners, in file
+// descriptor order from 3, in listenFDsEnv and the descriptor to report
+// readiness on in readyFDEnv. Under systemd socket activation LISTEN_FDS
+// and LISTEN_FDNAMES describe the sockets: those named "admin" and
+// "debug" serve the admin service and pprof, the first other one the
+// tunnel.
+const (
+	listenFDsEnv = "TT_LISTEN_FDS"
+	readyFDEnv   = "TT_READY_FD"
+
+	// listenFDsStart is the first inherited file descriptor.
+	listenFDsStart = 3
+)
+
+// Names of the listeners
+const (
+	mainListener  = "main"
+	adminListener = "admin"
+	debugListener = "debug"
+)
+
+var (
+	inheritOnce sync.Once
+	inherited   map[string]*os.File
+
+	// handoff holds the listeners passed on by upgrade.
+	handoffMu sync.Mutex
+	handoff   []namedListener
+)
+
+type namedListener struct {
+	name string
+	l    net.Listener
+}
+
+// listen returns the TCP listener called name, inherited from the parent
+// process or systemd if there is one and listening on addr otherwise.
+func listen(name, addr string) (net.Listener, error) {
+	inheritOnce.Do(inheritListeners)
+
+	var l net.Listener
+	if f, ok := inherited[name]; ok {
+		var err error
+		if l, err = net.FileListener(f); err != nil {
+			return nil, fmt.Errorf("inherited %s listener: %v", name, err)
+		}
+		f.Close()
+		log.Printf("inherited %s listener on %s", name, l.Addr())
+	} else {
+		var err error
+		if l, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+
+	handoffMu.Lock()
+	handoff = append(handoff, namedListener{name, l})
+	handoffMu.Unlock()
+	return l, nil
+}
+
+func inheritListeners() {
+	inherited = make(map[string]*os.File)
+
+	if names := os.Getenv(listenFDsEnv); names != "" {
+		for i, name := range strings.Split(names, ",") {
+			inherited[name] = os.NewFile(uintptr(listenFDsStart+i), name)
+		}
+		os.Unsetenv(listenFDsEnv)
+		return
+	}
+
+	// systemd socket activation
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n; i++ {
+		name := mainListener
+		if i < len(names) && (names[i] == adminListener || names[i] == debugListener) {
+			name = names[i]
+		}
+		if _, ok := inherited[name]; !ok {
+			inherited[name] = os.NewFile(uintptr(listenFDsStart+i), name)
+		}
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+}
+
+// notifyReady tells the process that started this one by upgrade, and
+// systemd if it asked with NOTIFY_SOCKET, that the server is about to
+// serve.
+func notifyReady() {
+	if fd, err := strconv.Atoi(os.Getenv(readyFDEnv)); err == nil {
+		f := os.NewFile(uintptr(fd), "ready")
+		f.Write([]byte{1})
+		f.Close()
+		os.Unsetenv(readyFDEnv)
+	}
+
+	if socket := os.Getenv("NOTIFY_SOCKET"); socket != "" {
+		// MAINPID moves the service over to this process after an upgrade,
+		// which needs NotifyAccess=all
+		state := fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid())
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+		if err != nil {
+			log.Printf("systemd notify: %v", err)
+			return
+		}
+		conn.Write([]byte(state))
+		conn.Close()
+	}
+}
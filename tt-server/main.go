@@ -7,14 +7,25 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/Randomsock5/tcptunnel/admin"
+	"github.com/Randomsock5/tcptunnel/config"
 	"github.com/Randomsock5/tcptunnel/constants"
 
 	pb "github.com/Randomsock5/tcptunnel/proto"
 	"github.com/Randomsock5/tcptunnel/transport"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 
 	_ "net/http/pprof"
 )
@@ -22,46 +33,215 @@ import (
 var (
 	port     = flag.Int("port", 8443, "Set listen port")
 	forward  = flag.String("forward", "127.0.0.1:3128", "Set forward address")
+	egress   = flag.Bool("egress", false, "Allow clients to choose the destination of a stream")
 	password = flag.String("password", "password", "password")
 
 	certFile = flag.String("cert_file", "server2client.crt", "The TLS cert file")
 	keyFile  = flag.String("key_file", "server.key", "The TLS key file")
 	caFile   = flag.String("ca_file", "ca.crt", "The TLS ca file")
+
+	adminAddr  = flag.String("admin", "", "Set admin service listen address, empty to disable")
+	adminToken = flag.String("admin_token", "", "The bearer token required by the admin service")
+
+	healthInterval   = flag.Duration("health_interval", 10*time.Second, "Set forward target health probe interval")
+	drainTimeout     = flag.Duration("drain_timeout", 30*time.Second, "Set how long shutdown waits for active streams before closing them")
+	drainGrace       = flag.Duration("drain_grace", 3*time.Second, "Set how long shutdown reports NOT_SERVING before telling clients to go away")
+	enableReflection = flag.Bool("reflection", false, "Enable gRPC server reflection")
 )
 
+// tlsConfig holds the most recently loaded server TLS configuration so that
+// certificates can be replaced without restarting the listener.
+var tlsConfig atomic.Value
+
 func main() {
 	flag.Parse()
+	if err := configFile.Load(); err != nil {
+		log.Fatalln(err)
+	}
 
+	debug, err := listen(debugListener, fmt.Sprintf(":%d", *port+1))
+	if err != nil {
+		log.Fatalln(err)
+	}
 	go func() {
-		log.Println(http.ListenAndServe(fmt.Sprintf(":%d", *port+1), nil))
+		log.Println(http.Serve(debug, nil))
 	}()
 
-	listen, err := transport.Listen(fmt.Sprintf(":%d", *port), *password)
+	raw, err := listen(mainListener, fmt.Sprintf(":%d", *port))
 	if err != nil {
 		log.Fatalln(err)
 		return
 	}
-	defer listen.Close()
+	tunnelListener := transport.NewListener(raw, *password)
+	defer tunnelListener.Close()
+
+	if err := loadTLSConfig(); err != nil {
+		log.Fatalln(err)
+		return
+	}
+	if err := loadACL(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := loadIdentities(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := loadRevocation(); err != nil {
+		log.Fatalln(err)
+	}
+	ta := credentials.NewTLS(&tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return tlsConfig.Load().(*tls.Config), nil
+		},
+	})
 
+	config.OnHangup(func() {
+		if err := reloadConfig(); err != nil {
+			log.Printf("reload failed: %v", err)
+			return
+		}
+		log.Println("configuration reloaded")
+	})
+
+	registry := transport.NewRegistry()
+	go watchRevocation(registry)
+	if *adminAddr != "" {
+		go serveAdmin(registry)
+	}
+
+	healthServer := health.NewServer()
+	probeTarget := *forward
+	if *egress {
+		probeTarget = ""
+	}
+	go probeForward(healthServer, registry, probeTarget, *healthInterval)
+
+	if err := startLimits(); err != nil {
+		log.Fatalln(err)
+	}
+
+	proxyOpts := []transport.ServerOption{
+		transport.WithRegistry(registry),
+		transport.WithLimiter(limiter),
+		transport.WithIdentities(identities),
+		transport.WithRevocation(revoked),
+	}
+	if *egress {
+		proxyOpts = append(proxyOpts, transport.WithEgress(), transport.WithPolicy(policy))
+	}
+
+	var opts []grpc.ServerOption
+	opts = []grpc.ServerOption{
+		grpc.Creds(ta),
+		grpc.ConnectionTimeout(constants.ConnTimeout),
+	}
+
+	grpcServer := grpc.NewServer(opts...)
+	pb.RegisterProxyServiceServer(grpcServer, transport.NewServer(*forward, proxyOpts...))
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	if *enableReflection {
+		reflection.Register(grpcServer)
+	}
+
+	notifyReady()
+	if err := serve(grpcServer, tunnelListener, registry, healthServer); err != nil {
+		log.Fatalln(err)
+	}
+	saveQuota()
+}
+
+// serve serves on l until it fails or SIGTERM or SIGINT is received, or an
+// upgrade on SIGUSR2 succeeds. Shutting down drains the registry, so that
+// new streams are refused, and reports NOT_SERVING through hs. On a signal
+// that lasts for -drain_grace, so that health checks of clients notice
+// before the server stops gracefully; after an upgrade the new process
+// already accepts in its place and the server stops right away. Stopping
+// gracefully sends GOAWAY, which tells clients to open new streams
+// elsewhere, and gives active streams -drain_timeout to finish before they
+// are closed. A second SIGTERM or SIGINT closes them right away.
+func serve(grpcServer *grpc.Server, l net.Listener, registry *transport.Registry, hs *health.Server) error {
+	errc := make(chan error, 1)
+	go func() { errc <- grpcServer.Serve(l) }()
+
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, syscall.SIGTERM, os.Interrupt)
+	if upgradeSignal != nil {
+		signal.Notify(sigc, upgradeSignal)
+	}
+
+	var sig os.Signal
+	upgraded := false
+	for sig == nil {
+		select {
+		case err := <-errc:
+			return err
+		case s := <-sigc:
+			if s == upgradeSignal {
+				if err := upgrade(); err != nil {
+					log.Printf("upgrade failed: %v", err)
+					continue
+				}
+				// The new process serves the listener from now on
+				signal.Reset(upgradeSignal)
+				upgraded = true
+			}
+			sig = s
+		}
+	}
+
+	log.Printf("%v: shutting down, draining %d sessions", sig, registry.Len())
+	registry.Drain()
+	hs.Shutdown()
+
+	if !upgraded {
+		grace := time.NewTimer(*drainGrace)
+		select {
+		case <-grace.C:
+		case <-sigc:
+			grace.Stop()
+			log.Printf("closing %d sessions", registry.Len())
+			grpcServer.Stop()
+			return nil
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	deadline := time.NewTimer(*drainTimeout)
+	defer deadline.Stop()
+	select {
+	case <-stopped:
+		return nil
+	case <-deadline.C:
+	case <-sigc:
+	}
+	log.Printf("closing %d sessions", registry.Len())
+	grpcServer.Stop()
+	return nil
+}
+
+func loadTLSConfig() error {
 	caCert, err := ioutil.ReadFile(*caFile)
 	if err != nil {
-		log.Fatalf("read ca cert file error:%v", err)
-		return
+		return fmt.Errorf("read ca cert file error:%v", err)
 	}
 	caCertPool := x509.NewCertPool()
 	caCertPool.AppendCertsFromPEM(caCert)
 
 	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
 	if err != nil {
-		log.Fatalf("read ca cert file error:%v", err)
-		return
+		return fmt.Errorf("load peer cert/key error:%v", err)
 	}
 
-	ta := credentials.NewTLS(&tls.Config{
+	tlsConfig.Store(&tls.Config{
 		Certificates: []tls.Certificate{cert},
 		ClientCAs:    caCertPool,
 		ClientAuth:   tls.RequireAndVerifyClientCert,
 		ServerName:   "Unknown",
+		NextProtos:   []string{"h2"},
 		MinVersion:   tls.VersionTLS12,
 		CurvePreferences: []tls.CurveID{
 			tls.CurveP521,
@@ -75,21 +255,34 @@ func main() {
 		},
 		PreferServerCipherSuites:    true,
 		DynamicRecordSizingDisabled: false,
+		VerifyPeerCertificate:       verifyNotRevoked,
 	})
+	return nil
+}
 
-	var opts []grpc.ServerOption
-	opts = []grpc.ServerOption{
-		grpc.Creds(ta),
-		grpc.ConnectionTimeout(constants.ConnTimeout),
+func serveAdmin(registry *transport.Registry) {
+	if *adminToken == "" {
+		log.Fatalln("admin service requires -admin_token")
 	}
 
-	for {
-		grpcServer := grpc.NewServer(opts...)
-		pb.RegisterProxyServiceServer(grpcServer, transport.NewServer(*forward))
-
-		err = grpcServer.Serve(listen)
-		if err != nil {
-			fmt.Println(err)
-		}
+	l, err := listen(adminListener, *adminAddr)
+	if err != nil {
+		log.Fatalln(err)
 	}
+
+	ta := credentials.NewTLS(&tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &tlsConfig.Load().(*tls.Config).Certificates[0], nil
+		},
+		MinVersion: tls.VersionTLS12,
+	})
+
+	adminServer := grpc.NewServer(
+		grpc.Creds(ta),
+		grpc.UnaryInterceptor(admin.TokenAuth(*adminToken)),
+	)
+	pb.RegisterAdminServer(adminServer, admin.NewServer(registry, reloadConfig))
+
+	log.Printf("admin service listening on %s", l.Addr())
+	log.Println(adminServer.Serve(l))
 }
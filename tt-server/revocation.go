@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Randomsock5/tcptunnel/revocation"
+	"github.com/Randomsock5/tcptunnel/transport"
+)
+
+var (
+	crlFile  = flag.String("crl_file", "", "Set the file of CRLs, signed by the -ca_file CA, revoking client certificates")
+	denyFile = flag.String("deny_file", "", "Set the file listing revoked client certificates by serial number or SHA-256 fingerprint, see package revocation")
+)
+
+// revocationPollInterval is how often -crl_file and -deny_file are checked
+// for changes.
+const revocationPollInterval = 10 * time.Second
+
+// revoked holds the client certificates that are refused.
+var revoked = revocation.New()
+
+// revocationLoaded is signalled whenever revoked has been reloaded.
+var revocationLoaded = make(chan struct{}, 1)
+
+// loadRevocation loads -crl_file and -deny_file into revoked.
+func loadRevocation() error {
+	var cas []*x509.Certificate
+	if *crlFile != "" {
+		var err error
+		if cas, err = readCertificates(*caFile); err != nil {
+			return err
+		}
+	}
+	if err := revoked.Load(*crlFile, *denyFile, cas); err != nil {
+		return err
+	}
+
+	select {
+	case revocationLoaded <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// verifyNotRevoked fails the handshake of a client whose certificate, or
+// the certificate of an intermediate CA, is revoked.
+func verifyNotRevoked(_ [][]byte, chains [][]*x509.Certificate) error {
+	if err := revoked.CheckChains(chains); err != nil {
+		log.Printf("handshake refused: %v", err)
+		return err
+	}
+	return nil
+}
+
+// watchRevocation reloads -crl_file and -deny_file when they change and
+// terminates the sessions of the clients whose certificate got revoked,
+// here and on any other reload. Once a CRL passes its next update the
+// sessions of the clients of its CA are terminated too, as Check refuses
+// them until a newer CRL is loaded.
+func watchRevocation(registry *transport.Registry) {
+	modTimes := revocationModTimes()
+	expired := false
+	ticker := time.NewTicker(revocationPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if next := revoked.NextUpdate(); !expired && !next.IsZero() && !time.Now().Before(next) {
+				expired = true
+				log.Printf("-crl_file expired at %v, refusing the clients of its CA until it is updated", next)
+				killRevoked(registry)
+			}
+			m := revocationModTimes()
+			if m == modTimes {
+				continue
+			}
+			modTimes = m
+			// A successful load signals revocationLoaded
+			reloadMu.Lock()
+			err := loadRevocation()
+			reloadMu.Unlock()
+			if err != nil {
+				log.Printf("reloading revoked certificates: %v", err)
+				continue
+			}
+			log.Println("revoked certificates reloaded")
+		case <-revocationLoaded:
+			expired = false
+			killRevoked(registry)
+		}
+	}
+}
+
+func killRevoked(registry *transport.Registry) {
+	for _, s := range registry.Sessions() {
+		if err := revoked.CheckChains(s.Chains); err != nil {
+			registry.Terminate(s.ID, err.Error())
+			log.Printf("killed session %d of %s: %v", s.ID, s.Peer, err)
+		}
+	}
+}
+
+func revocationModTimes() (m [2]time.Time) {
+	for i, path := range []string{*crlFile, *denyFile} {
+		if fi, err := os.Stat(path); err == nil {
+			m[i] = fi.ModTime()
+		}
+	}
+	return m
+}
+
+// readCertificates returns the certificates in the PEM file at path.
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
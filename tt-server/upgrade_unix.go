@@ -0,0 +1,114 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upgradeTimeout bounds how long upgrade waits for the new process.
+const upgradeTimeout = time.Minute
+
+// upgradeSignal asks the server to upgrade.
+var upgradeSignal os.Signal = syscall.SIGUSR2
+
+// upgrade starts the current executable again with the same arguments,
+// handing it the listeners, and waits until it is ready to serve. This
+// process then stops accepting, so that new connections all go to the new
+// process, and should drain. On errors the new process is killed and this
+// one keeps serving.
+func upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	handoffMu.Lock()
+	var names []string
+	var files []*os.File
+	for _, nl := range handoff {
+		tl, ok := nl.l.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := tl.File()
+		if err != nil {
+			handoffMu.Unlock()
+			closeFiles(files)
+			return err
+		}
+		names = append(names, nl.name)
+		files = append(files, f)
+	}
+	handoffMu.Unlock()
+	defer closeFiles(files)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// The new process continues from the usage counted so far
+	saveQuota()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(),
+		listenFDsEnv+"="+strings.Join(names, ","),
+		fmt.Sprintf("%s=%d", readyFDEnv, listenFDsStart+len(files)),
+	)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("upgrade: started %s as pid %d", exe, cmd.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := r.Read(b[:])
+		if err == io.EOF {
+			err = errors.New("new process exited before being ready")
+		}
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = errors.New("timed out waiting for the new process")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	// The new process is not waited for, it outlives this one
+	cmd.Process.Release()
+
+	handoffMu.Lock()
+	for _, nl := range handoff {
+		nl.l.Close()
+	}
+	handoffMu.Unlock()
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
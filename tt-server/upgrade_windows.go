@@ -0,0 +1,13 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// upgradeSignal is nil as there is no signal to upgrade with.
+var upgradeSignal os.Signal
+
+func upgrade() error {
+	return errors.New("upgrade is not supported on Windows")
+}